@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/config"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// adminTimeout bounds the calls of the admin commands.
+const adminTimeout = time.Minute
+
+// load loads the configuration of an admin command. Logs go to stderr, so
+// the output of the command can be piped.
+func load(path string) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	logger, _, err := logging.New(cfg.LogConfig(), os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return cfg, nil
+}
+
+// adminContext is canceled on SIGINT or after adminTimeout.
+func adminContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	ctx, cancel := context.WithTimeout(ctx, adminTimeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// runSubcommand runs the subcommand named by the first argument.
+func runSubcommand(name string, args []string, subcommands []command) error {
+	if len(args) > 0 {
+		for _, subcommand := range subcommands {
+			if subcommand.name == args[0] {
+				return subcommand.run(args[1:])
+			}
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name+" "+args[0])
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s %s <command> [flags] [arguments]\n\nCommands:\n", os.Args[0], name)
+	for _, subcommand := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", subcommand.name, subcommand.summary)
+	}
+	return errUsage
+}
+
+func validateConfig(args []string) error {
+	flags, configFile := newFlagSet("validate-config", "")
+	flags.Parse(args)
+
+	if _, err := config.Load(*configFile); err != nil {
+		return err
+	}
+	fmt.Println("configuration is valid")
+	return nil
+}
+
+// sendTest posts a synthetic card, checking the app credentials and that
+// the bot is a member of the chat. The card is tracked in memory only, so
+// the server does not remind or reconcile it.
+func sendTest(args []string) error {
+	flags, configFile := newFlagSet("send-test", "")
+	chat := flags.String("chat", "", "ID of the chat to post to, e.g. oc_xxx")
+	tenantName := flags.String("tenant", "", "tenant posting the card, by default the first one listing the chat or the default one")
+	flags.Parse(args)
+	if *chat == "" {
+		flags.Usage()
+		return errUsage
+	}
+
+	cfg, err := load(*configFile)
+	if err != nil {
+		return err
+	}
+	alertRepository, err := repository.New(
+		repository.Config{Backend: repository.BackendMemory},
+
+		slog.Default(),
+	)
+	if err != nil {
+		return err
+	}
+	defer alertRepository.(io.Closer).Close()
+	alertmanagers, err := alertmanager.NewRegistry(cfg.AlertmanagerEndpoints())
+	if err != nil {
+		return err
+	}
+	httpClient, closeHTTPClient, err := larkHTTPClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeHTTPClient()
+	tenants, err := lark.NewTenants(cfg.LarkTenants(), httpClient)
+	if err != nil {
+		return err
+	}
+	tenant := tenants.ForChat(*chat)
+	if *tenantName != "" {
+		var ok bool
+		if tenant, ok = tenants.Get(*tenantName); !ok {
+			return fmt.Errorf("unknown tenant %q, the tenants are %s", *tenantName, strings.Join(tenants.Names(), ", "))
+		}
+	}
+	notifier := lark.New(
+		tenants,
+		cfg.LarkOptions(),
+
+		alertRepository,
+		nil,
+		alertmanagers,
+
+		slog.Default(),
+	)
+
+	ctx, cancel := adminContext()
+	defer cancel()
+	ctx = lark.WithTenant(ctx, tenant.Name)
+	hostname, _ := os.Hostname()
+	webhook := model.Webhook{
+		Channel: *chat,
+		Alerts: []model.WebhookAlert{{
+			Color:      "blue",
+			CallbackID: fmt.Sprintf("send-test-%d,", time.Now().Unix()),
+			Title:      "[TEST] Katulampa Lark App",
+			Text:       "This is a test notification, no alert is firing.",
+			Fields: []model.WebhookAlertField{
+				{Title: "Sent from", Value: hostname, Short: true},
+				{Title: "Sent at", Value: time.Now().Format(time.RFC3339), Short: true},
+			},
+		}},
+	}
+	if err := notifier.NotifyAlerts(ctx, webhook); err != nil {
+		return fmt.Errorf("failed to post test card: %w", err)
+	}
+	fmt.Printf("test card posted to %s by tenant %s\n", *chat, tenant.Name)
+	return nil
+}
+
+// render prints the cards of a notification payload as a JSON array, one
+// item per message, and the warnings of /preview on stderr. Only the card
+// settings of the configuration are used.
+func render(args []string) error {
+	flags, configFile := newFlagSet("render", "")
+	input := flags.String("input", "", "Slack or Alertmanager webhook payload file, - reads stdin")
+	flags.Parse(args)
+	if *input == "" {
+		flags.Usage()
+		return errUsage
+	}
+
+	cfg, err := config.Read(*configFile)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if *input == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(*input)
+	}
+	if err != nil {
+		return err
+	}
+
+	preview, err := lark.PreviewPayload(cfg.LarkOptions().Card, body)
+	if err != nil {
+		return fmt.Errorf("failed to render %s: %w", *input, err)
+	}
+	for _, warning := range preview.Warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	messages := make([]json.RawMessage, 0, len(preview.Cards))
+	for _, card := range preview.Cards {
+		messages = append(messages, card...)
+	}
+	return printJSON(messages)
+}
+
+func silences(args []string) error {
+	return runSubcommand("silences", args, []command{
+		{"list", "list the active and pending silences", listSilences},
+		{"expire", "expire silences by ID", expireSilences},
+	})
+}
+
+// loadAlertmanagers returns the registry and the Alertmanagers named by
+// the -alertmanager flag, or every one when it is empty.
+func loadAlertmanagers(configFile, name string) (*alertmanager.Registry, []string, error) {
+	cfg, err := load(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	alertmanagers, err := alertmanager.NewRegistry(cfg.AlertmanagerEndpoints())
+	if err != nil {
+		return nil, nil, err
+	}
+	names := alertmanagers.Names()
+	if name == "" {
+		return alertmanagers, names, nil
+	}
+	if !slices.Contains(names, name) {
+		return nil, nil, fmt.Errorf("unknown alertmanager %q, configured: %s", name, strings.Join(names, ", "))
+	}
+	return alertmanagers, []string{name}, nil
+}
+
+func listSilences(args []string) error {
+	flags, configFile := newFlagSet("silences list", "")
+	name := flags.String("alertmanager", "", "only list the silences of this Alertmanager")
+	all := flags.Bool("all", false, "also list the expired silences")
+	flags.Parse(args)
+
+	alertmanagers, names, err := loadAlertmanagers(*configFile, *name)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := adminContext()
+	defer cancel()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ALERTMANAGER\tID\tSTATE\tENDS AT\tCREATED BY\tMATCHERS")
+	for _, name := range names {
+		silences, err := alertmanagers.Get(name).ListSilences(ctx)
+		if err != nil {
+			return fmt.Errorf("alertmanager %s: %w", name, err)
+		}
+		for _, silence := range silences {
+			state := *silence.Status.State
+			if state == models.SilenceStatusStateExpired && !*all {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				name,
+				*silence.ID,
+				state,
+				time.Time(*silence.EndsAt).Local().Format(time.RFC3339),
+				*silence.CreatedBy,
+				formatMatchers(silence.Matchers),
+			)
+		}
+	}
+	return w.Flush()
+}
+
+func formatMatchers(matchers models.Matchers) string {
+	formatted := make([]string, 0, len(matchers))
+	for _, matcher := range matchers {
+		operator := "="
+		if matcher.IsRegex != nil && *matcher.IsRegex {
+			operator = "=~"
+		}
+		if matcher.IsEqual != nil && !*matcher.IsEqual {
+			operator = strings.Replace(operator, "=", "!", 1)
+		}
+		formatted = append(formatted, fmt.Sprintf("%s%s%q", *matcher.Name, operator, *matcher.Value))
+	}
+	return strings.Join(formatted, ",")
+}
+
+func expireSilences(args []string) error {
+	flags, configFile := newFlagSet("silences expire", "<silence ID>...")
+	name := flags.String("alertmanager", "", "Alertmanager of the silences, the default one when empty")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	alertmanagers, names, err := loadAlertmanagers(*configFile, *name)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := adminContext()
+	defer cancel()
+
+	am := alertmanagers.Get(names[0])
+	var errs []error
+	for _, silenceID := range flags.Args() {
+		if err := am.ExpireSilence(ctx, silenceID); err != nil {
+			errs = append(errs, fmt.Errorf("silence %s: %w", silenceID, err))
+			continue
+		}
+		fmt.Printf("silence %s expired on %s\n", silenceID, names[0])
+	}
+	return errors.Join(errs...)
+}
+
+func state(args []string) error {
+	return runSubcommand("state", args, []command{
+		{"list", "list the tracked alert groups", listStates},
+		{"get", "print a tracked alert group as JSON", getState},
+		{"delete", "stop tracking an alert group", deleteState},
+		{"migrate", "move message IDs stored by older versions into alert groups", migrateStates},
+	})
+}
+
+// loadRepository opens the repository the server shares its state in.
+func loadRepository(configFile string) (pkg.Repository, error) {
+	cfg, err := load(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Repository.Backend == repository.BackendMemory {
+		return nil, fmt.Errorf("the %s repository backend is not shared with the server", repository.BackendMemory)
+	}
+	return repository.New(
+		cfg.RepositoryConfig(),
+
+		slog.Default(),
+	)
+}
+
+func listStates(args []string) error {
+	flags, configFile := newFlagSet("state list", "")
+	flags.Parse(args)
+
+	alertRepository, err := loadRepository(*configFile)
+	if err != nil {
+		return err
+	}
+	defer alertRepository.(io.Closer).Close()
+	ctx, cancel := adminContext()
+	defer cancel()
+
+	states, err := alertRepository.ListAlertStates(ctx)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(states, func(a, b *model.AlertState) int {
+		return b.LastFiredAt.Compare(a.LastFiredAt)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSTATUS\tLAST FIRED AT\tCHATS\tSILENCES")
+	for _, state := range states {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n",
+			state.Key,
+			state.Status,
+			state.LastFiredAt.Local().Format(time.RFC3339),
+			len(state.Messages),
+			len(state.Silences),
+		)
+	}
+	return w.Flush()
+}
+
+func getState(args []string) error {
+	flags, configFile := newFlagSet("state get", "<key>")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errUsage
+	}
+
+	alertRepository, err := loadRepository(*configFile)
+	if err != nil {
+		return err
+	}
+	defer alertRepository.(io.Closer).Close()
+	ctx, cancel := adminContext()
+	defer cancel()
+
+	state, err := alertRepository.GetAlertState(ctx, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("alert group %s: %w", flags.Arg(0), err)
+	}
+	return printJSON(state)
+}
+
+func deleteState(args []string) error {
+	flags, configFile := newFlagSet("state delete", "<key>")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errUsage
+	}
+
+	alertRepository, err := loadRepository(*configFile)
+	if err != nil {
+		return err
+	}
+	defer alertRepository.(io.Closer).Close()
+	ctx, cancel := adminContext()
+	defer cancel()
+
+	key := flags.Arg(0)
+	if _, err := alertRepository.GetAlertState(ctx, key); err != nil {
+		return fmt.Errorf("alert group %s: %w", key, err)
+	}
+	if err := alertRepository.DeleteAlertState(ctx, key); err != nil {
+		return err
+	}
+	fmt.Printf("alert group %s deleted\n", key)
+	return nil
+}
+
+// migrateStates moves the message IDs older versions stored under the bare
+// callback ID into alert states, and deletes the old keys.
+func migrateStates(args []string) error {
+	flags, configFile := newFlagSet("state migrate", "")
+	flags.Parse(args)
+
+	alertRepository, err := loadRepository(*configFile)
+	if err != nil {
+		return err
+	}
+	defer alertRepository.(io.Closer).Close()
+	ctx, cancel := adminContext()
+	defer cancel()
+
+	migrated, err := alertRepository.(repository.LegacyMigrator).MigrateLegacyMessageIDs(ctx)
+	fmt.Printf("%d legacy message ids migrated\n", migrated)
+	return err
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
@@ -1,67 +1,76 @@
 package main
 
 import (
-	"log/slog"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
-
-	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
-	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
-	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/server"
-	
+	"strings"
 )
 
-func main() {
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	})))
+// errUsage reports a command called with the wrong arguments, after its
+// usage was printed.
+var errUsage = errors.New("invalid arguments")
 
-	// TODO: refactor this somewhere
-	redisAddress := os.Getenv("REDIS_ADDRESS")
-	if redisAddress == "" {
-		panic("REDIS_ADDRESS is required")
-	}
-	redisPassword := os.Getenv("REDIS_PASSWORD")
-	
-	redisRepository := repository.New(
-		redisAddress,
-		redisPassword,
-		0,
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
 
-		slog.Default(),
-	)
+var commands = []command{
+	{"serve", "run the server (the default)", serve},
+	{"validate-config", "validate the configuration and exit", validateConfig},
+	{"send-test", "post a test card to a chat", sendTest},
+	{"render", "print the cards of a notification payload", render},
+	{"silences", "list or expire the silences of the Alertmanagers", silences},
+	{"state", "list, get, delete or migrate tracked alert groups", state},
+}
 
-	alertmanagerHost := os.Getenv("ALERTMANAGER_HOST")
-	if alertmanagerHost == "" {
-		panic("ALERTMANAGER_HOST is required")
+// main runs the command named by the first argument. Without one, or with
+// flags only, the server is run as before there were commands.
+func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	verificationToken := os.Getenv("VERIFICATION_TOKEN")
-	if verificationToken == "" {
-		panic("VERIFICATION_TOKEN is required")
+	for _, command := range commands {
+		if command.name != name {
+			continue
+		}
+		if err := command.run(args); err != nil {
+			if !errors.Is(err, errUsage) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		return
 	}
-	// TODO: refactor this somewhere
-	larkAppID := os.Getenv("LARK_APP_ID")
-	if larkAppID == "" {
-		panic("LARK_APP_ID is required")
-	}
-	larkAppSecret := os.Getenv("LARK_APP_SECRET")
-	if larkAppSecret == "" {
-		panic("lark_app_secret is required")
+
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
 	}
-	larkNotifier := lark.New(
-		larkAppID,
-		larkAppSecret,
+	usage()
+	os.Exit(2)
+}
 
-		redisRepository,
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [arguments]\n\nCommands:\n", os.Args[0])
+	for _, command := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", command.name, command.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
 
-		slog.Default(),
-	)
-	server := server.New(
-		larkNotifier,
-		8080,
-		alertmanagerHost,
-		verificationToken,
-		slog.Default(),
-	)
-	server.Start()
+// newFlagSet returns the flags of a command, with the -config flag every
+// command has. arguments describes the positional arguments in the usage.
+func newFlagSet(name, arguments string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s\n\nFlags:\n", strings.TrimSpace(fmt.Sprintf("%s %s [flags] %s", os.Args[0], name, arguments)))
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML config file, environment variables override it")
+	return flags, configFile
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/config"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/graph"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/health"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/reconciler"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/reminder"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/server"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+)
+
+// serve runs the server, with the reminder and the reconciler, until
+// SIGTERM.
+func serve(args []string) error {
+	flags, configFile := newFlagSet("serve", "")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return err
+	}
+
+	logger, logLevel, err := logging.New(cfg.LogConfig(), os.Stdout)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	// Background jobs stop on SIGTERM, and are drained with the server
+	// before the repository is closed.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	var jobs sync.WaitGroup
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TracingConfig())
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+
+	alertRepository, err := repository.New(
+		cfg.RepositoryConfig(),
+
+		slog.Default(),
+	)
+	if err != nil {
+		fatal("failed to create repository", err)
+	}
+
+	alertmanagers, err := alertmanager.NewRegistry(cfg.AlertmanagerEndpoints())
+	if err != nil {
+		fatal("failed to create alertmanager clients", err)
+	}
+
+	var grapher pkg.Grapher
+	if cfg.Graph.PrometheusURL != "" {
+		grapher, err = graph.New(
+			cfg.GraphConfig(),
+
+			slog.Default(),
+		)
+		if err != nil {
+			fatal("failed to create grapher", err)
+		}
+	}
+
+	httpClient, closeHTTPClient, err := larkHTTPClient(cfg)
+	if err != nil {
+		fatal("failed to create lark dry run", err)
+	}
+	defer closeHTTPClient()
+	tenants, err := lark.NewTenants(cfg.LarkTenants(), httpClient)
+	if err != nil {
+		fatal("failed to create lark tenants", err)
+	}
+	larkNotifier := lark.New(
+		tenants,
+		cfg.LarkOptions(),
+
+		alertRepository,
+		grapher,
+		alertmanagers,
+
+		slog.Default(),
+	)
+	if cfg.Reminder.Enabled {
+		silenceReminder := reminder.New(
+			cfg.ReminderConfig(),
+
+			alertRepository,
+			larkNotifier,
+			alertmanagers,
+
+			slog.Default(),
+		)
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			silenceReminder.Run(ctx)
+		}()
+	}
+	if cfg.Reconcile.Enabled {
+		stateReconciler := reconciler.New(
+			cfg.ReconcilerConfig(),
+
+			alertRepository,
+			larkNotifier,
+			alertmanagers,
+
+			slog.Default(),
+		)
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			stateReconciler.Run(ctx)
+		}()
+	}
+
+	silenceHandler := lark.NewHandler(
+		alertmanagers,
+		cfg.Routing.SilenceMode,
+		alertRepository,
+	)
+
+	if *configFile != "" {
+		watcher := config.NewWatcher(
+			*configFile,
+			config.DefaultWatchInterval,
+			cfg,
+
+			slog.Default(),
+		)
+		go watcher.Run(ctx, func(next *config.Config) {
+			if err := alertmanagers.Reload(next.AlertmanagerEndpoints()); err != nil {
+				slog.Error("failed to reload alertmanagers, keeping the current ones",
+					slog.String("error", err.Error()),
+				)
+			}
+			if err := logging.SetLevel(logLevel, next.Log.Level); err != nil {
+				slog.Error("failed to change the log level",
+					slog.String("error", err.Error()),
+				)
+			}
+			larkNotifier.SetOptions(next.LarkOptions())
+			silenceHandler.SetMode(next.Routing.SilenceMode)
+		})
+	}
+
+	checks := []health.Check{
+		{Name: "lark", Checker: tenants},
+		{Name: "alertmanager", Checker: alertmanagers},
+	}
+	if checker, ok := alertRepository.(pkg.HealthChecker); ok {
+		checks = append(checks, health.Check{Name: "repository", Checker: checker})
+	}
+	readiness := health.New(
+		cfg.HealthConfig(),
+		checks,
+
+		slog.Default(),
+	)
+
+	server := server.New(
+		larkNotifier,
+		silenceHandler,
+		readiness,
+		cfg.ServerConfig(),
+		tenants,
+
+		slog.Default(),
+	)
+	serverErr := server.Run(ctx)
+	// The server may also stop on its own, e.g. when the port is taken.
+	stop()
+	jobs.Wait()
+	larkNotifier.Wait()
+
+	if closer, ok := alertRepository.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Warn("failed to close repository",
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	// The pending spans are flushed within the same bound as the drain.
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("failed to flush traces",
+			slog.String("error", err.Error()),
+		)
+	}
+	if serverErr != nil {
+		fatal("server stopped", serverErr)
+	}
+	slog.Info("shut down")
+	return nil
+}
+
+func fatal(message string, err error) {
+	slog.Error(message,
+		slog.String("error", err.Error()),
+	)
+	os.Exit(1)
+}
+
+// larkHTTPClient returns the client the Lark SDK sends its requests with:
+// nil to send them to Lark, or the dry run of the configuration.
+func larkHTTPClient(cfg *config.Config) (larkcore.HttpClient, func(), error) {
+	if !cfg.Lark.DryRun {
+		return nil, func() {}, nil
+	}
+	dryRun, err := lark.NewDryRun(
+		cfg.Lark.DryRunOutput,
+
+		slog.Default(),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	slog.Warn("lark dry run, requests are not sent to Lark",
+		slog.String("output", cfg.Lark.DryRunOutput),
+	)
+	return dryRun, func() { dryRun.Close() }, nil
+}
@@ -1,65 +1,182 @@
 package alertmanager
 
 import (
+	"context"
+	"errors"
 	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-openapi/strfmt"
 	"github.com/prometheus/alertmanager/api/v2/client"
 	"github.com/prometheus/alertmanager/api/v2/client/alert"
+	"github.com/prometheus/alertmanager/api/v2/client/general"
 	"github.com/prometheus/alertmanager/api/v2/client/silence"
 	"github.com/prometheus/alertmanager/api/v2/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
 )
 
 type Alertmanager interface {
 	GetAlerts(param *alert.GetAlertsParams) (*alert.GetAlertsOK, error)
-	Silence(comment, createdBy string, matchers []*models.Matcher, startAt time.Time, endsAt time.Time) (string, error)
-	GetSilence(silenceID string) (*models.GettableSilence, error)
-	GetAlertsByFingerprints(fingerprints []string) (*models.GettableAlerts, error)
+	Silence(ctx context.Context, comment, createdBy string, matchers []*models.Matcher, startAt time.Time, endsAt time.Time) (string, error)
+	GetSilence(ctx context.Context, silenceID string) (*models.GettableSilence, error)
+	ListSilences(ctx context.Context) (models.GettableSilences, error)
+	ExpireSilence(ctx context.Context, silenceID string) error
+	ExtendSilence(ctx context.Context, silence *models.GettableSilence, endsAt time.Time) (string, error)
+	FindAlertsByFingerprints(ctx context.Context, fingerprints []string, filter AlertFilter) (models.GettableAlerts, error)
+	CheckHealth(ctx context.Context) error
 }
 
 type alertmanager struct {
-	client *client.AlertmanagerAPI
+	peers []*peerClient
+	// current is the index of the peer that answered last.
+	current atomic.Int32
+	cache   *alertCache
 }
 
-func NewAlertmanager(hostname string) *alertmanager {
-	alertClient := client.NewHTTPClientWithConfig(nil, &client.TransportConfig{
-		Host:     hostname,
-		BasePath: "/api/v2",
-		Schemes:  client.DefaultSchemes,
-	})
-	if alertClient == nil {
-		slog.Error("Failed to create Alertmanager client")
-	} else {
-		slog.Info("Successfully created Alertmanager client", "hostname", hostname)
+func NewAlertmanager(config Config) (*alertmanager, error) {
+	peers, err := newPeerClients(config)
+	if err != nil {
+		return nil, err
 	}
 	return &alertmanager{
-		client: alertClient,
+		peers: peers,
+		cache: newAlertCache(alertCacheTTL),
+	}, nil
+}
+
+// nonIdempotent are the operations that must not be sent twice, see
+// shouldFailover.
+var nonIdempotent = map[string]bool{
+	"post_silence": true,
+}
+
+// do runs the request against the peer that answered last, failing over
+// to the other peers in order. Each attempt is traced as its own span.
+func (am *alertmanager) do(ctx context.Context, operation string, request func(api *client.AlertmanagerAPI) error) error {
+	first := int(am.current.Load())
+	var err error
+	for i := range am.peers {
+		index := (first + i) % len(am.peers)
+		peer := am.peers[index]
+		_, span := tracing.Start(ctx, "alertmanager."+operation, trace.WithAttributes(
+			attribute.String("alertmanager.peer", peer.url),
+			attribute.Int("alertmanager.attempt", i+1),
+		))
+		start := time.Now()
+		err = request(peer.api)
+		o11y.ObserveAlertmanagerRequest(operation, start, err == nil)
+		tracing.End(span, err)
+		if err == nil {
+			am.current.Store(int32(index))
+			return nil
+		}
+		if !shouldFailover(err, !nonIdempotent[operation]) {
+			return err
+		}
+		if len(am.peers) > 1 && i < len(am.peers)-1 {
+			o11y.IncreaseRetryCounter("alertmanager")
+			logging.FromContext(ctx).WarnContext(ctx, "alertmanager peer failed, trying the next one",
+				slog.String("peer", peer.url),
+				slog.String("error", err.Error()),
+			)
+		}
 	}
+	return err
 }
 
+// CheckHealth asks a peer for the Alertmanager status, failing over like
+// any other request.
+func (am *alertmanager) CheckHealth(ctx context.Context) error {
+	param := general.NewGetStatusParamsWithContext(ctx)
+	return am.do(ctx, "get_status", func(api *client.AlertmanagerAPI) error {
+		_, err := api.General.GetStatus(param)
+		return err
+	})
+}
+
+// GetAlerts is traced under the context of param, when set.
 func (am *alertmanager) GetAlerts(param *alert.GetAlertsParams) (*alert.GetAlertsOK, error) {
-	return am.client.Alert.GetAlerts(param)
+	ctx := param.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var resp *alert.GetAlertsOK
+	err := am.do(ctx, "get_alerts", func(api *client.AlertmanagerAPI) error {
+		var err error
+		resp, err = api.Alert.GetAlerts(param)
+		return err
+	})
+	return resp, err
 }
 
-func (am *alertmanager) GetSilence(silenceID string) (*models.GettableSilence, error) {
-	param := silence.NewGetSilenceParams()
+func (am *alertmanager) GetSilence(ctx context.Context, silenceID string) (*models.GettableSilence, error) {
+	param := silence.NewGetSilenceParamsWithContext(ctx)
 	param.SilenceID = strfmt.UUID(silenceID)
-	resp, err := am.client.Silence.GetSilence(param)
+	var resp *silence.GetSilenceOK
+	err := am.do(ctx, "get_silence", func(api *client.AlertmanagerAPI) error {
+		var err error
+		resp, err = api.Silence.GetSilence(param)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp.GetPayload(), nil
 }
 
-func (am *alertmanager) Silence(comment, createdBy string, matchers []*models.Matcher, startAt time.Time, endsAt time.Time) (string, error) {
+// IsSilenceNotFound tells whether err is Alertmanager answering that the
+// silence does not exist, e.g. because it expired past its retention.
+func IsSilenceNotFound(err error) bool {
+	var notFound *silence.GetSilenceNotFound
+	return errors.As(err, &notFound)
+}
+
+// ListSilences returns every silence, including the expired ones
+// Alertmanager still keeps.
+func (am *alertmanager) ListSilences(ctx context.Context) (models.GettableSilences, error) {
+	param := silence.NewGetSilencesParamsWithContext(ctx)
+	var resp *silence.GetSilencesOK
+	err := am.do(ctx, "get_silences", func(api *client.AlertmanagerAPI) error {
+		var err error
+		resp, err = api.Silence.GetSilences(param)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetPayload(), nil
+}
+
+// ExpireSilence ends the silence now.
+func (am *alertmanager) ExpireSilence(ctx context.Context, silenceID string) error {
+	param := silence.NewDeleteSilenceParamsWithContext(ctx)
+	param.SilenceID = strfmt.UUID(silenceID)
+	err := am.do(ctx, "delete_silence", func(api *client.AlertmanagerAPI) error {
+		_, err := api.Silence.DeleteSilence(param)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// The cached alerts are still silenced by it.
+	am.cache.clear()
+	return nil
+}
+
+func (am *alertmanager) Silence(ctx context.Context, comment, createdBy string, matchers []*models.Matcher, startAt time.Time, endsAt time.Time) (string, error) {
 	startAtStr := strfmt.DateTime(startAt)
 	endsAtStr := strfmt.DateTime(endsAt)
+	logger := logging.FromContext(ctx)
 	for _, matcher := range matchers {
-		slog.Info("Matcher Details silence",
-			"Name", matcher.Name,
-			"Value", matcher.Value,
-			"IsRegex", matcher.IsRegex,
+		logger.DebugContext(ctx, "silence matcher",
+			slog.String("name", *matcher.Name),
+			slog.String("value", *matcher.Value),
+			slog.Bool("is_regex", *matcher.IsRegex),
 		)
 	}
 	silenceObj := models.PostableSilence{
@@ -71,39 +188,103 @@ func (am *alertmanager) Silence(comment, createdBy string, matchers []*models.Ma
 			EndsAt:    &endsAtStr,
 		},
 	}
-	params := silence.NewPostSilencesParams()
+	params := silence.NewPostSilencesParamsWithContext(ctx)
 	params.SetSilence(&silenceObj)
-	resp, err := am.client.Silence.PostSilences(params)
+	var resp *silence.PostSilencesOK
+	err := am.do(ctx, "post_silence", func(api *client.AlertmanagerAPI) error {
+		var err error
+		resp, err = api.Silence.PostSilences(params)
+		return err
+	})
 	if err != nil {
-		slog.Error("Error post silences: %v", "ERROR: ", err)
+		logger.ErrorContext(ctx, "failed to post silence",
+			slog.String("error", err.Error()),
+		)
 		return "", err
 	}
+	// The cached alerts do not show the new silence yet.
+	am.cache.clear()
 	return resp.GetPayload().SilenceID, nil
 }
 
-func (am *alertmanager) GetAlertsByFingerprints(fingerprints []string) (*models.GettableAlerts, error) {
-	alerts := models.GettableAlerts{}
+// ExtendSilence moves the end of an existing silence, keeping its ID when
+// the Alertmanager allows updating it in place.
+func (am *alertmanager) ExtendSilence(ctx context.Context, existing *models.GettableSilence, endsAt time.Time) (string, error) {
+	endsAtStr := strfmt.DateTime(endsAt)
+	silenceObj := models.PostableSilence{
+		ID:      *existing.ID,
+		Silence: existing.Silence,
+	}
+	silenceObj.EndsAt = &endsAtStr
 
-	resp, err := am.GetAlerts(nil)
+	params := silence.NewPostSilencesParamsWithContext(ctx)
+	params.SetSilence(&silenceObj)
+	var resp *silence.PostSilencesOK
+	err := am.do(ctx, "post_silence", func(api *client.AlertmanagerAPI) error {
+		var err error
+		resp, err = api.Silence.PostSilences(params)
+		return err
+	})
 	if err != nil {
-		slog.Error("Failed to fetch alerts from alertmanager %v", "ERROR: ", err)
+		logging.FromContext(ctx).ErrorContext(ctx, "failed to extend silence",
+			slog.String("silence_id", *existing.ID),
+			slog.String("error", err.Error()),
+		)
+		return "", err
+	}
+	am.cache.clear()
+	return resp.GetPayload().SilenceID, nil
+}
+
+// FindAlertsByFingerprints returns the alerts matching any of the
+// fingerprints in a single filtered request. Fingerprints that no longer
+// match an alert are skipped.
+func (am *alertmanager) FindAlertsByFingerprints(ctx context.Context, fingerprints []string, filter AlertFilter) (models.GettableAlerts, error) {
+	alerts, err := am.findAlerts(ctx, filter)
+	if err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "failed to fetch alerts from alertmanager",
+			slog.String("error", err.Error()),
+		)
 		return nil, err
 	}
-	if resp == nil || len(resp.Payload) == 0 {
-		slog.Error("No alerts found.")
-		return &alerts, nil
-	}
-	target := fingerprints[0]
-	for _, alert := range resp.Payload {
-		if alert.Fingerprint != nil && *alert.Fingerprint == target {
-			alerts = append(alerts, alert)
-			slog.Info("Alert fingerprint found %s", "fingerprint: ", target)
-			slog.Info("Details of ", "alert: ", alert)
-			break // Found it, no need to continue
+
+	targets := make(map[string]bool, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		targets[fingerprint] = true
+	}
+	found := models.GettableAlerts{}
+	for _, alert := range alerts {
+		if alert.Fingerprint != nil && targets[*alert.Fingerprint] {
+			found = append(found, alert)
+			delete(targets, *alert.Fingerprint)
 		}
 	}
-	if len(alerts) == 0 {
-		slog.Info("Alert fingerprint not found %s", "fingerprint: ", target)
+	for fingerprint := range targets {
+		logging.FromContext(ctx).DebugContext(ctx, "alert fingerprint not found",
+			slog.String("fingerprint", fingerprint),
+		)
+	}
+	return found, nil
+}
+
+// findAlerts returns the alerts matching the filter, from the cache when
+// the same filter was queried less than alertCacheTTL ago, unless the
+// filter asks for fresh alerts.
+func (am *alertmanager) findAlerts(ctx context.Context, filter AlertFilter) (models.GettableAlerts, error) {
+	key := filter.cacheKey()
+	if alerts, ok := am.cache.get(key); ok && !filter.Fresh {
+		trace.SpanFromContext(ctx).AddEvent("alertmanager.alerts_cached")
+		return alerts, nil
+	}
+
+	resp, err := am.GetAlerts(filter.params().WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	alerts := models.GettableAlerts{}
+	if resp != nil {
+		alerts = resp.Payload
 	}
-	return &alerts, nil
+	am.cache.set(key, alerts)
+	return alerts, nil
 }
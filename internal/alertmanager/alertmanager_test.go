@@ -0,0 +1,271 @@
+package alertmanager
+
+import (
+	"context"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// testPeer is an Alertmanager replica answering with handler, counting the
+// requests it gets.
+type testPeer struct {
+	*httptest.Server
+	requests atomic.Int32
+}
+
+func newTestPeer(t *testing.T, handler http.HandlerFunc) *testPeer {
+	t.Helper()
+	peer := &testPeer{}
+	peer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer.requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+func answer(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}
+}
+
+func serverError(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "unavailable", http.StatusServiceUnavailable)
+}
+
+// unreachablePeer returns the address of a closed port.
+func unreachablePeer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func newTestAlertmanager(t *testing.T, peers ...string) *alertmanager {
+	t.Helper()
+	am, err := NewAlertmanager(Config{Peers: peers, Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewAlertmanager() error = %v", err)
+	}
+	return am
+}
+
+func postTestSilence(am *alertmanager) (string, error) {
+	name, value, isRegex := "alertname", "Test", false
+	matchers := []*models.Matcher{{Name: &name, Value: &value, IsRegex: &isRegex}}
+	return am.Silence(context.Background(), "test", "alice", matchers, time.Now(), time.Now().Add(time.Hour))
+}
+
+func TestSilenceFailover(t *testing.T) {
+	const created = `{"silenceID":"0b6a2e2d-3f4c-4d2b-9d0e-1f2a3b4c5d6e"}`
+
+	tests := []struct {
+		name        string
+		first       http.HandlerFunc
+		wantErr     bool
+		wantRetried bool
+	}{
+		{
+			name:    "server error is not retried",
+			first:   serverError,
+			wantErr: true,
+		},
+		{
+			name: "timeout is not retried",
+			first: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(500 * time.Millisecond)
+				answer(created)(w, r)
+			},
+			wantErr: true,
+		},
+		{
+			name:        "unreachable peer is retried",
+			wantRetried: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			second := newTestPeer(t, answer(created))
+			first := unreachablePeer(t)
+			var firstPeer *testPeer
+			if tt.first != nil {
+				firstPeer = newTestPeer(t, tt.first)
+				first = firstPeer.URL
+			}
+			am := newTestAlertmanager(t, first, second.URL)
+
+			_, err := postTestSilence(am)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Silence() error = %v, want error %v", err, tt.wantErr)
+			}
+			if firstPeer != nil && firstPeer.requests.Load() != 1 {
+				t.Errorf("first peer got %d requests, want 1", firstPeer.requests.Load())
+			}
+			if retried := second.requests.Load() > 0; retried != tt.wantRetried {
+				t.Errorf("sent to the second peer = %v, want %v", retried, tt.wantRetried)
+			}
+		})
+	}
+}
+
+func TestReadFailover(t *testing.T) {
+	first := newTestPeer(t, serverError)
+	second := newTestPeer(t, answer(`[]`))
+	am := newTestAlertmanager(t, first.URL, second.URL)
+
+	if _, err := am.ListSilences(context.Background()); err != nil {
+		t.Fatalf("ListSilences() error = %v", err)
+	}
+	if first.requests.Load() != 1 || second.requests.Load() != 1 {
+		t.Errorf("peers got %d and %d requests, want 1 each", first.requests.Load(), second.requests.Load())
+	}
+
+	// The peer that answered is asked first from then on.
+	if _, err := am.ListSilences(context.Background()); err != nil {
+		t.Fatalf("ListSilences() error = %v", err)
+	}
+	if first.requests.Load() != 1 || second.requests.Load() != 2 {
+		t.Errorf("peers got %d and %d requests, want 1 and 2", first.requests.Load(), second.requests.Load())
+	}
+}
+
+func TestClientErrorIsNotRetried(t *testing.T) {
+	first := newTestPeer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `"bad request"`, http.StatusBadRequest)
+	})
+	second := newTestPeer(t, answer(`[]`))
+	am := newTestAlertmanager(t, first.URL, second.URL)
+
+	if _, err := am.ListSilences(context.Background()); err == nil {
+		t.Fatal("ListSilences() error = nil, want the client error")
+	}
+	if second.requests.Load() != 0 {
+		t.Errorf("second peer got %d requests, want 0", second.requests.Load())
+	}
+}
+
+func TestGroupFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		state        *model.AlertState
+		wantLabels   map[string]string
+		wantReceiver string
+	}{
+		{
+			name: "labels shared by the firing alerts",
+			state: &model.AlertState{
+				Receiver: "lark.payments",
+				Labels:   map[string]string{"alertname": "HighErrorRate"},
+				Alerts: map[string]*model.TrackedAlert{
+					"fp1": {Status: model.AlertStatusFiring, Labels: map[string]string{"alertname": "HighErrorRate", "env": "prod", "pod": "a"}},
+					"fp2": {Status: model.AlertStatusFiring, Labels: map[string]string{"alertname": "HighErrorRate", "env": "prod", "pod": "b"}},
+					"fp3": {Status: model.AlertStatusResolved, Labels: map[string]string{"alertname": "HighErrorRate", "env": "staging"}},
+				},
+			},
+			wantLabels:   map[string]string{"alertname": "HighErrorRate", "env": "prod"},
+			wantReceiver: `^lark\.payments$`,
+		},
+		{
+			name: "alert labels unknown",
+			state: &model.AlertState{
+				Labels: map[string]string{"alertname": "HighErrorRate"},
+				Alerts: map[string]*model.TrackedAlert{
+					"fp1": {Status: model.AlertStatusFiring},
+				},
+			},
+			wantLabels: map[string]string{"alertname": "HighErrorRate"},
+		},
+		{
+			name:       "legacy state",
+			state:      &model.AlertState{Key: "fp1,fp2"},
+			wantLabels: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := GroupFilter(tt.state)
+			if !maps.Equal(filter.Labels, tt.wantLabels) || filter.Receiver != tt.wantReceiver {
+				t.Errorf("GroupFilter() = %v %q, want %v %q", filter.Labels, filter.Receiver, tt.wantLabels, tt.wantReceiver)
+			}
+			if filter.Active != nil || filter.Silenced != nil || filter.Inhibited != nil {
+				t.Errorf("GroupFilter() selects alert states, want the Alertmanager defaults")
+			}
+		})
+	}
+}
+
+func TestFindAlertsFresh(t *testing.T) {
+	peer := newTestPeer(t, answer(`[]`))
+	am := newTestAlertmanager(t, peer.URL)
+	filter := AlertFilter{Labels: map[string]string{"alertname": "HighErrorRate"}}
+
+	for range 2 {
+		if _, err := am.FindAlertsByFingerprints(context.Background(), []string{"fp1"}, filter); err != nil {
+			t.Fatalf("FindAlertsByFingerprints() error = %v", err)
+		}
+	}
+	if peer.requests.Load() != 1 {
+		t.Errorf("peer got %d requests, want the second lookup cached", peer.requests.Load())
+	}
+
+	filter.Fresh = true
+	if _, err := am.FindAlertsByFingerprints(context.Background(), []string{"fp1"}, filter); err != nil {
+		t.Fatalf("FindAlertsByFingerprints() error = %v", err)
+	}
+	if peer.requests.Load() != 2 {
+		t.Errorf("peer got %d requests, want the fresh lookup sent", peer.requests.Load())
+	}
+}
+
+func TestRegistryResolve(t *testing.T) {
+	registry, err := NewRegistry([]Endpoint{
+		{Name: "default", Client: Config{Peers: []string{"am-default:9093"}}},
+		{Name: "id", Client: Config{Peers: []string{"am-id:9093"}}, ExternalURL: "https://am.example.com/id/"},
+		{Name: "root", Client: Config{Peers: []string{"am-root:9093"}}, ExternalURL: "http://am-root.example.com:9093"},
+		{Name: "payments", Client: Config{Peers: []string{"am-payments:9093"}}, Receivers: []string{"lark.payments"}},
+		{Name: "sg", Client: Config{Peers: []string{"am-sg:9093"}}, Labels: map[string]string{"region": "sg"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		source Source
+		want   string
+	}{
+		{"external url", Source{ExternalURL: "https://am.example.com/id"}, "id"},
+		{"link below the external url", Source{ExternalURL: "https://am.example.com/id/#/alerts?receiver=lark"}, "id"},
+		{"host in another case", Source{ExternalURL: "https://AM.example.com/id/"}, "id"},
+		{"path sharing a prefix", Source{ExternalURL: "https://am.example.com/idx"}, "default"},
+		{"other scheme", Source{ExternalURL: "http://am.example.com/id"}, "default"},
+		{"host sharing a prefix", Source{ExternalURL: "https://am.example.com.evil.io/id"}, "default"},
+		{"port sharing a prefix", Source{ExternalURL: "http://am-root.example.com:90931/"}, "default"},
+		{"any path below a root url", Source{ExternalURL: "http://am-root.example.com:9093/#/alerts"}, "root"},
+		{"receiver", Source{ExternalURL: "https://other.example.com", Receiver: "lark.payments"}, "payments"},
+		{"labels", Source{Labels: map[string]string{"region": "sg", "env": "prod"}}, "sg"},
+		{"nothing matches", Source{Receiver: "lark", Labels: map[string]string{"region": "id"}}, "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := registry.Resolve(tt.source); got != tt.want {
+				t.Errorf("Resolve(%+v) = %q, want %q", tt.source, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package alertmanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-openapi/runtime"
+	httptransport "github.com/go-openapi/runtime/client"
+	"github.com/go-openapi/strfmt"
+	"github.com/prometheus/alertmanager/api/v2/client"
+)
+
+const (
+	DefaultScheme   = "http"
+	DefaultBasePath = "/api/v2"
+	DefaultTimeout  = 30 * time.Second
+)
+
+// Config is how to reach an Alertmanager and its HA replicas.
+type Config struct {
+	// Peers are the URLs, or host:port, of the replicas of the
+	// Alertmanager. Requests go to the first replica that answers.
+	Peers []string
+	// Scheme is used for peers without one.
+	Scheme string
+	// BasePath of the API, appended to the path of each peer URL.
+	BasePath string
+
+	Username string
+	Password string
+	// BearerToken, or the token in BearerTokenFile which is read on
+	// every request so it can be rotated.
+	BearerToken     string
+	BearerTokenFile string
+
+	TLS TLSConfig
+
+	Timeout time.Duration
+}
+
+type TLSConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func (c Config) validate() error {
+	if len(c.Peers) == 0 {
+		return fmt.Errorf("at least one peer is required")
+	}
+	if c.Username != "" && (c.BearerToken != "" || c.BearerTokenFile != "") {
+		return fmt.Errorf("basic auth and bearer token are mutually exclusive")
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return fmt.Errorf("bearer token and bearer token file are mutually exclusive")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls cert file and key file must be set together")
+	}
+	return nil
+}
+
+// newPeerClients returns an API client per peer, sharing one HTTP client.
+func newPeerClients(config Config) ([]*peerClient, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.Scheme == "" {
+		config.Scheme = DefaultScheme
+	}
+	if config.BasePath == "" {
+		config.BasePath = DefaultBasePath
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	auth := newAuth(config)
+
+	peers := make([]*peerClient, 0, len(config.Peers))
+	for _, peer := range config.Peers {
+		peerURL, err := parsePeer(peer, config.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		transport := httptransport.NewWithClient(
+			peerURL.Host,
+			path.Join("/", peerURL.Path, config.BasePath),
+			[]string{peerURL.Scheme},
+			httpClient,
+		)
+		transport.DefaultAuthentication = auth
+		peers = append(peers, &peerClient{
+			url: peerURL.Redacted(),
+			api: client.New(transport, strfmt.Default),
+		})
+	}
+	return peers, nil
+}
+
+func parsePeer(peer, scheme string) (*url.URL, error) {
+	if !strings.Contains(peer, "://") {
+		peer = scheme + "://" + peer
+	}
+	peerURL, err := url.Parse(peer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alertmanager peer %s: %w", peer, err)
+	}
+	if peerURL.Host == "" {
+		return nil, fmt.Errorf("invalid alertmanager peer %s: missing host", peer)
+	}
+	return peerURL, nil
+}
+
+func newHTTPClient(config Config) (*http.Client, error) {
+	if config.TLS == (TLSConfig{}) {
+		return &http.Client{Timeout: config.Timeout}, nil
+	}
+
+	httpClient, err := httptransport.TLSClient(httptransport.TLSClientOptions{
+		CA:                 config.TLS.CAFile,
+		Certificate:        config.TLS.CertFile,
+		Key:                config.TLS.KeyFile,
+		ServerName:         config.TLS.ServerName,
+		InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure alertmanager tls: %w", err)
+	}
+	httpClient.Timeout = config.Timeout
+	return httpClient, nil
+}
+
+func newAuth(config Config) runtime.ClientAuthInfoWriter {
+	switch {
+	case config.Username != "":
+		return httptransport.BasicAuth(config.Username, config.Password)
+	case config.BearerToken != "":
+		return httptransport.BearerToken(config.BearerToken)
+	case config.BearerTokenFile != "":
+		return runtime.ClientAuthInfoWriterFunc(func(request runtime.ClientRequest, registry strfmt.Registry) error {
+			token, err := os.ReadFile(config.BearerTokenFile)
+			if err != nil {
+				return fmt.Errorf("failed to read alertmanager bearer token file: %w", err)
+			}
+			return request.SetHeaderParam(runtime.HeaderAuthorization, "Bearer "+strings.TrimSpace(string(token)))
+		})
+	default:
+		return nil
+	}
+}
+
+type peerClient struct {
+	url string
+	api *client.AlertmanagerAPI
+}
+
+// shouldFailover tells whether a request failing with err may succeed on
+// another replica. Client errors would fail on every replica. A request
+// that is not idempotent, e.g. posting a silence, may have taken effect on
+// a replica that timed out or failed, and the replicas gossip, so it only
+// goes to another replica when it never reached the first one.
+func shouldFailover(err error, idempotent bool) bool {
+	if !idempotent {
+		return notSent(err)
+	}
+	var response interface{ IsClientError() bool }
+	if errors.As(err, &response) {
+		return !response.IsClientError()
+	}
+	return true
+}
+
+// notSent tells whether err means the request could not be sent because no
+// connection to the replica was made.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
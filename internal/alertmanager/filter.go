@@ -0,0 +1,166 @@
+package alertmanager
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/alertmanager/api/v2/client/alert"
+	"github.com/prometheus/alertmanager/api/v2/models"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// alertCacheTTL is how long the alerts of a filter are reused, e.g. by the
+// background jobs looking up the same group.
+const alertCacheTTL = 10 * time.Second
+
+// AlertFilter narrows an alert lookup on the Alertmanager side.
+type AlertFilter struct {
+	// Labels are equality matchers on the alert labels.
+	Labels map[string]string
+	// Receiver is a regular expression on the receiver name.
+	Receiver string
+
+	// Active, Silenced and Inhibited select alerts by state. Nil leaves
+	// the Alertmanager default, which includes them.
+	Active    *bool
+	Silenced  *bool
+	Inhibited *bool
+
+	// Fresh skips the cached alerts. The cache is only cleared on the
+	// replica that changed a silence, so lookups deciding whether to post
+	// one must not use it.
+	Fresh bool
+}
+
+// GroupFilter narrows a lookup to the alerts with the labels and receiver
+// of the tracked group. A state without either matches every alert.
+func GroupFilter(state *model.AlertState) AlertFilter {
+	filter := AlertFilter{Labels: trackedLabels(state)}
+	if state.Receiver != "" {
+		filter.Receiver = "^" + regexp.QuoteMeta(state.Receiver) + "$"
+	}
+	return filter
+}
+
+// trackedLabels returns the labels shared by every firing alert of the
+// tracked group, or its common labels when the alerts' labels are unknown.
+func trackedLabels(state *model.AlertState) map[string]string {
+	var common map[string]string
+	for _, alert := range state.Alerts {
+		if alert.Status != model.AlertStatusFiring {
+			continue
+		}
+		if alert.Labels == nil {
+			return state.Labels
+		}
+		if common == nil {
+			common = maps.Clone(alert.Labels)
+			continue
+		}
+		for name, value := range common {
+			if alert.Labels[name] != value {
+				delete(common, name)
+			}
+		}
+	}
+	if common == nil {
+		return state.Labels
+	}
+	return common
+}
+
+func (f AlertFilter) matchers() []string {
+	matchers := make([]string, 0, len(f.Labels))
+	for _, name := range slices.Sorted(maps.Keys(f.Labels)) {
+		matchers = append(matchers, name+"="+strconv.Quote(f.Labels[name]))
+	}
+	return matchers
+}
+
+func (f AlertFilter) params() *alert.GetAlertsParams {
+	params := alert.NewGetAlertsParams()
+	params.Filter = f.matchers()
+	params.Active = f.Active
+	params.Silenced = f.Silenced
+	params.Inhibited = f.Inhibited
+	if f.Receiver != "" {
+		params.Receiver = &f.Receiver
+	}
+	return params
+}
+
+func (f AlertFilter) cacheKey() string {
+	state := func(value *bool) string {
+		if value == nil {
+			return "-"
+		}
+		return strconv.FormatBool(*value)
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%s",
+		strings.Join(f.matchers(), ","),
+		f.Receiver,
+		state(f.Active),
+		state(f.Silenced),
+		state(f.Inhibited),
+	)
+}
+
+type alertCacheEntry struct {
+	alerts    models.GettableAlerts
+	expiresAt time.Time
+}
+
+// alertCache keeps the result of recent alert lookups by filter.
+type alertCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]alertCacheEntry
+}
+
+func newAlertCache(ttl time.Duration) *alertCache {
+	return &alertCache{
+		ttl:     ttl,
+		entries: make(map[string]alertCacheEntry),
+	}
+}
+
+func (c *alertCache) get(key string) (models.GettableAlerts, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.alerts, true
+}
+
+func (c *alertCache) set(key string, alerts models.GettableAlerts) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[key] = alertCacheEntry{
+		alerts:    alerts,
+		expiresAt: now.Add(c.ttl),
+	}
+}
+
+func (c *alertCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+}
@@ -0,0 +1,210 @@
+package alertmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+)
+
+// Endpoint is a named Alertmanager and the alerts it is the source of.
+type Endpoint struct {
+	Name   string
+	Client Config
+
+	// ExternalURL matches the external URL, or title link, of a
+	// notification with the same scheme and host, and a path at or below
+	// its own.
+	ExternalURL string
+	// Receivers are the receivers only this Alertmanager routes to.
+	Receivers []string
+	// Labels are matched against the alert labels, every label has to
+	// be equal.
+	Labels map[string]string
+}
+
+// Source is what a notification tells about the Alertmanager it came from.
+type Source struct {
+	ExternalURL string
+	Receiver    string
+	Labels      map[string]string
+}
+
+// Registry holds a client per named Alertmanager. The first endpoint is
+// the default for alerts that match none.
+type Registry struct {
+	mu        sync.RWMutex
+	endpoints []Endpoint
+	clients   map[string]Alertmanager
+}
+
+var _ pkg.HealthChecker = (*Registry)(nil)
+
+func NewRegistry(endpoints []Endpoint) (*Registry, error) {
+	r := &Registry{}
+	if err := r.Reload(endpoints); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload replaces the endpoints. Clients whose connection settings did not
+// change are kept, along with their cache and the peer that answered last.
+// The registry is left untouched when any endpoint is invalid.
+func (r *Registry) Reload(endpoints []Endpoint) error {
+	if len(endpoints) == 0 {
+		return fmt.Errorf("at least one alertmanager is required")
+	}
+
+	r.mu.RLock()
+	previous := make(map[string]Endpoint, len(r.endpoints))
+	for _, endpoint := range r.endpoints {
+		previous[endpoint.Name] = endpoint
+	}
+	r.mu.RUnlock()
+
+	clients := make(map[string]Alertmanager, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.Name == "" {
+			return fmt.Errorf("alertmanager name is required")
+		}
+		if _, ok := clients[endpoint.Name]; ok {
+			return fmt.Errorf("alertmanager %s is defined more than once", endpoint.Name)
+		}
+		if old, ok := previous[endpoint.Name]; ok && reflect.DeepEqual(old.Client, endpoint.Client) {
+			clients[endpoint.Name] = r.Get(endpoint.Name)
+			continue
+		}
+		client, err := NewAlertmanager(endpoint.Client)
+		if err != nil {
+			return fmt.Errorf("alertmanager %s: %w", endpoint.Name, err)
+		}
+		clients[endpoint.Name] = client
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endpoints = endpoints
+	r.clients = clients
+	return nil
+}
+
+// Default is the name of the default Alertmanager.
+func (r *Registry) Default() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.endpoints[0].Name
+}
+
+// Names lists the Alertmanagers, the default one first.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.endpoints))
+	for _, endpoint := range r.endpoints {
+		names = append(names, endpoint.Name)
+	}
+	return names
+}
+
+// Get returns the client of the named Alertmanager. Unknown names, e.g.
+// recorded before an Alertmanager was removed, get the default one.
+func (r *Registry) Get(name string) Alertmanager {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if client, ok := r.clients[name]; ok {
+		return client
+	}
+	return r.clients[r.endpoints[0].Name]
+}
+
+// Lookup returns the client of the named Alertmanager, and whether it is
+// configured.
+func (r *Registry) Lookup(name string) (Alertmanager, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	client, ok := r.clients[name]
+	return client, ok
+}
+
+// Resolve returns the name of the Alertmanager the source came from,
+// matching the external URL first, then the receiver, then the labels.
+func (r *Registry) Resolve(source Source) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if source.ExternalURL != "" {
+		for _, endpoint := range r.endpoints {
+			if matchExternalURL(endpoint.ExternalURL, source.ExternalURL) {
+				return endpoint.Name
+			}
+		}
+	}
+	if source.Receiver != "" {
+		for _, endpoint := range r.endpoints {
+			if slices.Contains(endpoint.Receivers, source.Receiver) {
+				return endpoint.Name
+			}
+		}
+	}
+	if len(source.Labels) > 0 {
+		for _, endpoint := range r.endpoints {
+			if len(endpoint.Labels) > 0 && matchLabels(endpoint.Labels, source.Labels) {
+				return endpoint.Name
+			}
+		}
+	}
+	return r.endpoints[0].Name
+}
+
+// CheckHealth checks every Alertmanager, reporting all that are unreachable.
+func (r *Registry) CheckHealth(ctx context.Context) error {
+	r.mu.RLock()
+	clients := maps.Clone(r.clients)
+	r.mu.RUnlock()
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(clients)) {
+		if err := clients[name].CheckHealth(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("alertmanager %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// matchExternalURL reports whether link is the configured external URL or
+// below it, so that http://am:9093/a matches neither http://am:9093/ab nor
+// http://am:90931/a.
+func matchExternalURL(configured, link string) bool {
+	if configured == "" {
+		return false
+	}
+	want, err := url.Parse(configured)
+	if err != nil {
+		return false
+	}
+	got, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	if !strings.EqualFold(got.Scheme, want.Scheme) || !strings.EqualFold(got.Host, want.Host) {
+		return false
+	}
+	path := strings.TrimSuffix(want.Path, "/")
+	return path == "" || got.Path == path || strings.HasPrefix(got.Path, path+"/")
+}
+
+func matchLabels(matchers, labels map[string]string) bool {
+	for name, value := range matchers {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,574 @@
+// Package config reads the app configuration from a YAML file, overridden
+// by environment variables, with secrets optionally read from files.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/graph"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/health"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/reconciler"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/reminder"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/server"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
+)
+
+const DefaultPort = 8080
+
+type Config struct {
+	Server        ServerConfig         `yaml:"server"`
+	Log           LogConfig            `yaml:"log"`
+	Metrics       MetricsConfig        `yaml:"metrics"`
+	Health        HealthConfig         `yaml:"health"`
+	Tracing       TracingConfig        `yaml:"tracing"`
+	Lark          LarkConfig           `yaml:"lark"`
+	Tenants       []TenantConfig       `yaml:"tenants"`
+	Repository    RepositoryConfig     `yaml:"repository"`
+	Alertmanagers []AlertmanagerConfig `yaml:"alertmanagers"`
+	Routing       RoutingConfig        `yaml:"routing"`
+	Card          CardConfig           `yaml:"card"`
+	Graph         GraphConfig          `yaml:"graph"`
+	Reminder      ReminderConfig       `yaml:"reminder"`
+	Reconcile     ReconcileConfig      `yaml:"reconcile"`
+}
+
+type ServerConfig struct {
+	Port                  int    `yaml:"port"`
+	VerificationToken     string `yaml:"verification_token"`
+	VerificationTokenFile string `yaml:"verification_token_file"`
+
+	ReadHeaderTimeout time.Duration   `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration   `yaml:"read_timeout"`
+	WriteTimeout      time.Duration   `yaml:"write_timeout"`
+	IdleTimeout       time.Duration   `yaml:"idle_timeout"`
+	ShutdownTimeout   time.Duration   `yaml:"shutdown_timeout"`
+	MaxBodyBytes      int             `yaml:"max_body_bytes"`
+	TLS               ServerTLSConfig `yaml:"tls"`
+}
+
+type ServerTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	// RedactFields are the log fields redacted besides tokens, secrets
+	// and passwords, e.g. email.
+	RedactFields []string `yaml:"redact_fields"`
+}
+
+type MetricsConfig struct {
+	// Port serves the metrics separately from the main port when set.
+	Port int    `yaml:"port"`
+	Path string `yaml:"path"`
+}
+
+type HealthConfig struct {
+	// CacheTTL is how long readiness results are reused between probes.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// Timeout bounds each dependency check.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the OTLP/HTTP traces URL, the OTEL_EXPORTER_OTLP_*
+	// variables apply when empty.
+	Endpoint    string  `yaml:"endpoint"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+	ServiceName string  `yaml:"service_name"`
+}
+
+// LarkConfig is the Lark app when there are no tenants, with the
+// verification token of server.
+type LarkConfig struct {
+	AppID          string `yaml:"app_id"`
+	AppSecret      string `yaml:"app_secret"`
+	AppSecretFile  string `yaml:"app_secret_file"`
+	Domain         string `yaml:"domain"`
+	EncryptKey     string `yaml:"encrypt_key"`
+	EncryptKeyFile string `yaml:"encrypt_key_file"`
+	// DryRun writes the requests to Lark to DryRunOutput instead of
+	// sending them: "log", "stdout" or a file path.
+	DryRun       bool   `yaml:"dry_run"`
+	DryRunOutput string `yaml:"dry_run_output"`
+}
+
+// TenantConfig is a Lark app of one business unit.
+type TenantConfig struct {
+	Name          string `yaml:"name"`
+	AppID         string `yaml:"app_id"`
+	AppSecret     string `yaml:"app_secret"`
+	AppSecretFile string `yaml:"app_secret_file"`
+	// Domain is feishu, larksuite or the base URL of the Open API.
+	Domain                string `yaml:"domain"`
+	VerificationToken     string `yaml:"verification_token"`
+	VerificationTokenFile string `yaml:"verification_token_file"`
+	EncryptKey            string `yaml:"encrypt_key"`
+	EncryptKeyFile        string `yaml:"encrypt_key_file"`
+	// Chats are the chats the tenant posts to, any chat when empty.
+	Chats []string `yaml:"chats"`
+}
+
+type RepositoryConfig struct {
+	Backend  string        `yaml:"backend"`
+	TTL      time.Duration `yaml:"ttl"`
+	FilePath string        `yaml:"file_path"`
+	Redis    RedisConfig   `yaml:"redis"`
+}
+
+type RedisConfig struct {
+	URL                string         `yaml:"url"`
+	Address            string         `yaml:"address"`
+	Password           string         `yaml:"password"`
+	PasswordFile       string         `yaml:"password_file"`
+	DB                 int            `yaml:"db"`
+	SentinelMasterName string         `yaml:"sentinel_master_name"`
+	SentinelAddresses  []string       `yaml:"sentinel_addresses"`
+	ClusterAddresses   []string       `yaml:"cluster_addresses"`
+	TLS                RedisTLSConfig `yaml:"tls"`
+	PoolSize           int            `yaml:"pool_size"`
+	MinIdleConns       int            `yaml:"min_idle_conns"`
+	DialTimeout        time.Duration  `yaml:"dial_timeout"`
+	ReadTimeout        time.Duration  `yaml:"read_timeout"`
+	WriteTimeout       time.Duration  `yaml:"write_timeout"`
+	PoolTimeout        time.Duration  `yaml:"pool_timeout"`
+	IdleTimeout        time.Duration  `yaml:"idle_timeout"`
+}
+
+type RedisTLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type AlertmanagerConfig struct {
+	Name string `yaml:"name"`
+	// Peers are the HA replicas, as URLs or host:port.
+	Peers           []string      `yaml:"peers"`
+	Scheme          string        `yaml:"scheme"`
+	BasePath        string        `yaml:"base_path"`
+	Username        string        `yaml:"username"`
+	Password        string        `yaml:"password"`
+	PasswordFile    string        `yaml:"password_file"`
+	BearerToken     string        `yaml:"bearer_token"`
+	BearerTokenFile string        `yaml:"bearer_token_file"`
+	TLS             TLSConfig     `yaml:"tls"`
+	Timeout         time.Duration `yaml:"timeout"`
+
+	// ExternalURL, Receivers and Labels route notifications to this
+	// Alertmanager.
+	ExternalURL string            `yaml:"external_url"`
+	Receivers   []string          `yaml:"receivers"`
+	Labels      map[string]string `yaml:"labels"`
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type RoutingConfig struct {
+	// GroupLabels identify the group of a native Alertmanager notification.
+	GroupLabels []string `yaml:"group_labels"`
+	SilenceMode string   `yaml:"silence_mode"`
+}
+
+type CardConfig struct {
+	MaxBytes int    `yaml:"max_bytes"`
+	Overflow string `yaml:"overflow"`
+	// ImageAllowedHosts are the only hosts attachment images are
+	// downloaded from, any public host when empty.
+	ImageAllowedHosts []string      `yaml:"image_allowed_hosts"`
+	ImageTimeout      time.Duration `yaml:"image_timeout"`
+}
+
+type GraphConfig struct {
+	PrometheusURL string        `yaml:"prometheus_url"`
+	Range         time.Duration `yaml:"range"`
+	Timeout       time.Duration `yaml:"timeout"`
+	MaxBytes      int           `yaml:"max_bytes"`
+}
+
+type ReminderConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Lead        time.Duration `yaml:"lead"`
+	Interval    time.Duration `yaml:"interval"`
+	AllSilences bool          `yaml:"all_silences"`
+}
+
+type ReconcileConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Interval  time.Duration `yaml:"interval"`
+	MinAge    time.Duration `yaml:"min_age"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+// Default returns the configuration used for anything the file and the
+// environment leave unset.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              DefaultPort,
+			ReadHeaderTimeout: server.DefaultReadHeaderTimeout,
+			ReadTimeout:       server.DefaultReadTimeout,
+			WriteTimeout:      server.DefaultWriteTimeout,
+			IdleTimeout:       server.DefaultIdleTimeout,
+			ShutdownTimeout:   server.DefaultShutdownTimeout,
+			MaxBodyBytes:      server.DefaultMaxBodyBytes,
+		},
+		Log: LogConfig{
+			Level:  logging.DefaultLevel,
+			Format: logging.DefaultFormat,
+		},
+		Metrics: MetricsConfig{
+			Path: server.DefaultMetricsPath,
+		},
+		Health: HealthConfig{
+			CacheTTL: health.DefaultCacheTTL,
+			Timeout:  health.DefaultTimeout,
+		},
+		Tracing: TracingConfig{
+			SampleRatio: tracing.DefaultSampleRatio,
+			ServiceName: tracing.DefaultServiceName,
+		},
+		Lark: LarkConfig{
+			DryRunOutput: lark.DryRunOutputLog,
+		},
+		Repository: RepositoryConfig{
+			Backend: repository.BackendRedis,
+			TTL:     repository.DefaultTTL,
+			Redis: RedisConfig{
+				DialTimeout: 5 * time.Second,
+			},
+		},
+		Routing: RoutingConfig{
+			SilenceMode: lark.SilenceModeGroup,
+		},
+		Card: CardConfig{
+			MaxBytes:     lark.DefaultCardMaxBytes,
+			Overflow:     lark.CardOverflowTruncate,
+			ImageTimeout: lark.DefaultImageTimeout,
+		},
+		Graph: GraphConfig{
+			Range:    graph.DefaultRange,
+			Timeout:  graph.DefaultTimeout,
+			MaxBytes: graph.DefaultMaxBytes,
+		},
+		Reminder: ReminderConfig{
+			Enabled:  true,
+			Lead:     reminder.DefaultLead,
+			Interval: reminder.DefaultInterval,
+		},
+		Reconcile: ReconcileConfig{
+			Enabled:   true,
+			Interval:  reconciler.DefaultInterval,
+			MinAge:    reconciler.DefaultMinAge,
+			Retention: reconciler.DefaultRetention,
+		},
+	}
+}
+
+// Load reads the file at path, when given, over the defaults, applies the
+// environment overrides, reads the secret files and validates the result.
+func Load(path string) (*Config, error) {
+	config, problems, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return config, nil
+}
+
+// Read is Load without the validation, for tools that only need part of
+// the configuration, e.g. the card settings.
+func Read(path string) (*Config, error) {
+	config, problems, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return config, nil
+}
+
+func read(path string) (*Config, []string, error) {
+	config := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := decode(data, config); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	problems := applyEnv(config)
+	problems = append(problems, config.readSecrets()...)
+	return config, problems, nil
+}
+
+// decode rejects unknown fields, so typos do not silently fall back to the
+// defaults.
+func decode(data []byte, config *Config) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// readSecrets fills the secrets left empty from their files.
+func (c *Config) readSecrets() []string {
+	type secret struct {
+		value *string
+		file  string
+		field string
+	}
+	secrets := []secret{
+		{&c.Server.VerificationToken, c.Server.VerificationTokenFile, "server.verification_token_file"},
+		{&c.Lark.AppSecret, c.Lark.AppSecretFile, "lark.app_secret_file"},
+		{&c.Lark.EncryptKey, c.Lark.EncryptKeyFile, "lark.encrypt_key_file"},
+		{&c.Repository.Redis.Password, c.Repository.Redis.PasswordFile, "repository.redis.password_file"},
+	}
+	for i := range c.Tenants {
+		tenant := &c.Tenants[i]
+		secrets = append(secrets,
+			secret{&tenant.AppSecret, tenant.AppSecretFile, fmt.Sprintf("tenants[%d].app_secret_file", i)},
+			secret{&tenant.VerificationToken, tenant.VerificationTokenFile, fmt.Sprintf("tenants[%d].verification_token_file", i)},
+			secret{&tenant.EncryptKey, tenant.EncryptKeyFile, fmt.Sprintf("tenants[%d].encrypt_key_file", i)},
+		)
+	}
+	for i := range c.Alertmanagers {
+		am := &c.Alertmanagers[i]
+		secrets = append(secrets, secret{&am.Password, am.PasswordFile, fmt.Sprintf("alertmanagers[%d].password_file", i)})
+	}
+
+	problems := make([]string, 0)
+	for _, secret := range secrets {
+		if *secret.value != "" || secret.file == "" {
+			continue
+		}
+		data, err := os.ReadFile(secret.file)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", secret.field, err))
+			continue
+		}
+		*secret.value = strings.TrimSpace(string(data))
+	}
+	return problems
+}
+
+func (c *Config) ServerConfig() server.Config {
+	return server.Config{
+		Port:              c.Server.Port,
+		ReadHeaderTimeout: c.Server.ReadHeaderTimeout,
+		ReadTimeout:       c.Server.ReadTimeout,
+		WriteTimeout:      c.Server.WriteTimeout,
+		IdleTimeout:       c.Server.IdleTimeout,
+		ShutdownTimeout:   c.Server.ShutdownTimeout,
+		MaxBodyBytes:      int64(c.Server.MaxBodyBytes),
+		TLS: server.TLSConfig{
+			CertFile: c.Server.TLS.CertFile,
+			KeyFile:  c.Server.TLS.KeyFile,
+		},
+		MetricsPort: c.Metrics.Port,
+		MetricsPath: c.Metrics.Path,
+	}
+}
+
+// LogConfig redacts the configured secrets from the logs, wherever they
+// appear.
+func (c *Config) LogConfig() logging.Config {
+	secrets := []string{
+		c.Server.VerificationToken,
+		c.Lark.AppSecret,
+		c.Lark.EncryptKey,
+		c.Repository.Redis.Password,
+	}
+	for _, tenant := range c.Tenants {
+		secrets = append(secrets, tenant.AppSecret, tenant.VerificationToken, tenant.EncryptKey)
+	}
+	for _, am := range c.Alertmanagers {
+		secrets = append(secrets, am.Password, am.BearerToken)
+	}
+	return logging.Config{
+		Level:        c.Log.Level,
+		Format:       c.Log.Format,
+		RedactFields: c.Log.RedactFields,
+		Secrets:      secrets,
+	}
+}
+
+func (c *Config) HealthConfig() health.Config {
+	return health.Config{
+		CacheTTL: c.Health.CacheTTL,
+		Timeout:  c.Health.Timeout,
+	}
+}
+
+func (c *Config) TracingConfig() tracing.Config {
+	return tracing.Config{
+		Enabled:     c.Tracing.Enabled,
+		Endpoint:    c.Tracing.Endpoint,
+		SampleRatio: c.Tracing.SampleRatio,
+		ServiceName: c.Tracing.ServiceName,
+	}
+}
+
+func (c *Config) RepositoryConfig() repository.Config {
+	redis := c.Repository.Redis
+	return repository.Config{
+		Backend: c.Repository.Backend,
+		TTL:     c.Repository.TTL,
+		Redis: repository.RedisConfig{
+			URL:                redis.URL,
+			Address:            redis.Address,
+			Password:           redis.Password,
+			DB:                 redis.DB,
+			SentinelMasterName: redis.SentinelMasterName,
+			SentinelAddresses:  redis.SentinelAddresses,
+			ClusterAddresses:   redis.ClusterAddresses,
+			TLS: repository.RedisTLSConfig{
+				Enabled:            redis.TLS.Enabled,
+				CAFile:             redis.TLS.CAFile,
+				CertFile:           redis.TLS.CertFile,
+				KeyFile:            redis.TLS.KeyFile,
+				ServerName:         redis.TLS.ServerName,
+				InsecureSkipVerify: redis.TLS.InsecureSkipVerify,
+			},
+			PoolSize:     redis.PoolSize,
+			MinIdleConns: redis.MinIdleConns,
+			DialTimeout:  redis.DialTimeout,
+			ReadTimeout:  redis.ReadTimeout,
+			WriteTimeout: redis.WriteTimeout,
+			PoolTimeout:  redis.PoolTimeout,
+			IdleTimeout:  redis.IdleTimeout,
+		},
+		FilePath: c.Repository.FilePath,
+	}
+}
+
+func (c *Config) AlertmanagerEndpoints() []alertmanager.Endpoint {
+	endpoints := make([]alertmanager.Endpoint, 0, len(c.Alertmanagers))
+	for _, am := range c.Alertmanagers {
+		endpoints = append(endpoints, alertmanager.Endpoint{
+			Name: am.Name,
+			Client: alertmanager.Config{
+				Peers:           am.Peers,
+				Scheme:          am.Scheme,
+				BasePath:        am.BasePath,
+				Username:        am.Username,
+				Password:        am.Password,
+				BearerToken:     am.BearerToken,
+				BearerTokenFile: am.BearerTokenFile,
+				TLS: alertmanager.TLSConfig{
+					CAFile:             am.TLS.CAFile,
+					CertFile:           am.TLS.CertFile,
+					KeyFile:            am.TLS.KeyFile,
+					ServerName:         am.TLS.ServerName,
+					InsecureSkipVerify: am.TLS.InsecureSkipVerify,
+				},
+				Timeout: am.Timeout,
+			},
+			ExternalURL: am.ExternalURL,
+			Receivers:   am.Receivers,
+			Labels:      am.Labels,
+		})
+	}
+	return endpoints
+}
+
+// LarkTenants returns the tenants, or the default one of the lark section
+// when there are none.
+func (c *Config) LarkTenants() []lark.Tenant {
+	if len(c.Tenants) == 0 {
+		return []lark.Tenant{{
+			Name:              lark.DefaultTenant,
+			AppID:             c.Lark.AppID,
+			AppSecret:         c.Lark.AppSecret,
+			Domain:            c.Lark.Domain,
+			VerificationToken: c.Server.VerificationToken,
+			EncryptKey:        c.Lark.EncryptKey,
+		}}
+	}
+
+	tenants := make([]lark.Tenant, 0, len(c.Tenants))
+	for _, tenant := range c.Tenants {
+		tenants = append(tenants, lark.Tenant{
+			Name:              tenant.Name,
+			AppID:             tenant.AppID,
+			AppSecret:         tenant.AppSecret,
+			Domain:            tenant.Domain,
+			VerificationToken: tenant.VerificationToken,
+			EncryptKey:        tenant.EncryptKey,
+			Chats:             tenant.Chats,
+		})
+	}
+	return tenants
+}
+
+func (c *Config) LarkOptions() lark.Options {
+	return lark.Options{
+		Card: lark.CardOptions{
+			MaxBytes: c.Card.MaxBytes,
+			Overflow: c.Card.Overflow,
+		},
+		GroupLabels: c.Routing.GroupLabels,
+		Images: lark.ImageOptions{
+			AllowedHosts: c.Card.ImageAllowedHosts,
+			Timeout:      c.Card.ImageTimeout,
+		},
+		GraphTimeout: c.Graph.Timeout,
+	}
+}
+
+func (c *Config) GraphConfig() graph.Config {
+	return graph.Config{
+		PrometheusURL: c.Graph.PrometheusURL,
+		Range:         c.Graph.Range,
+		Timeout:       c.Graph.Timeout,
+		MaxBytes:      c.Graph.MaxBytes,
+	}
+}
+
+func (c *Config) ReminderConfig() reminder.Config {
+	return reminder.Config{
+		Interval:    c.Reminder.Interval,
+		Lead:        c.Reminder.Lead,
+		AllSilences: c.Reminder.AllSilences,
+	}
+}
+
+func (c *Config) ReconcilerConfig() reconciler.Config {
+	return reconciler.Config{
+		Interval:  c.Reconcile.Interval,
+		MinAge:    c.Reconcile.MinAge,
+		Retention: c.Reconcile.Retention,
+	}
+}
@@ -0,0 +1,445 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes the content to a file in a temporary directory and
+// returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// validConfig returns the smallest configuration without problems.
+func validConfig() *Config {
+	c := Default()
+	c.Server.VerificationToken = "token"
+	c.Lark.AppID = "cli_app"
+	c.Lark.AppSecret = "secret"
+	c.Repository.Redis.Address = "redis:6379"
+	c.Alertmanagers = []AlertmanagerConfig{{Name: "default", Peers: []string{"am:9093"}}}
+	return c
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	secretFile := writeFile(t, "app-secret", "secret-from-file\n")
+	passwordFile := writeFile(t, "redis-password", "password-from-file")
+	configFile := writeFile(t, "config.yaml", `
+server:
+  port: 9000
+  verification_token: token
+log:
+  level: debug
+lark:
+  app_id: cli_file
+  app_secret_file: `+secretFile+`
+repository:
+  redis:
+    address: redis:6379
+    password_file: `+passwordFile+`
+alertmanagers:
+- name: id
+  peers: [am-id-0:9093]
+  timeout: 10s
+- name: sg
+  peers: [am-sg-0:9093]
+`)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(t *testing.T, c *Config)
+	}{
+		{
+			name: "file over defaults",
+			check: func(t *testing.T, c *Config) {
+				if c.Server.Port != 9000 || c.Log.Level != "debug" || c.Lark.AppID != "cli_file" {
+					t.Errorf("port, level, app ID = %d, %q, %q, want the file's", c.Server.Port, c.Log.Level, c.Lark.AppID)
+				}
+				if c.Log.Format != "text" {
+					t.Errorf("log format = %q, want the default", c.Log.Format)
+				}
+			},
+		},
+		{
+			name: "env over file",
+			env:  map[string]string{"PORT": "9100", "LARK_APP_ID": "cli_env"},
+			check: func(t *testing.T, c *Config) {
+				if c.Server.Port != 9100 || c.Lark.AppID != "cli_env" {
+					t.Errorf("port, app ID = %d, %q, want the env's", c.Server.Port, c.Lark.AppID)
+				}
+				if c.Log.Level != "debug" {
+					t.Errorf("log level = %q, want the file's", c.Log.Level)
+				}
+			},
+		},
+		{
+			name: "secret files fill empty secrets",
+			check: func(t *testing.T, c *Config) {
+				if c.Lark.AppSecret != "secret-from-file" {
+					t.Errorf("app secret = %q, want the trimmed file content", c.Lark.AppSecret)
+				}
+				if c.Repository.Redis.Password != "password-from-file" {
+					t.Errorf("redis password = %q, want the file content", c.Repository.Redis.Password)
+				}
+			},
+		},
+		{
+			name: "env secrets over secret files",
+			env:  map[string]string{"LARK_APP_SECRET": "secret-from-env"},
+			check: func(t *testing.T, c *Config) {
+				if c.Lark.AppSecret != "secret-from-env" {
+					t.Errorf("app secret = %q, want the env's", c.Lark.AppSecret)
+				}
+			},
+		},
+		{
+			name: "env secret file over file secret file",
+			env:  map[string]string{"REDIS_PASSWORD_FILE": secretFile},
+			check: func(t *testing.T, c *Config) {
+				if c.Repository.Redis.Password != "secret-from-file" {
+					t.Errorf("redis password = %q, want the content of the env's file", c.Repository.Redis.Password)
+				}
+			},
+		},
+		{
+			name: "alertmanager env overrides file entries",
+			env: map[string]string{
+				"ALERTMANAGER_ID_PEERS":   "am-id-1:9093,am-id-2:9093",
+				"ALERTMANAGER_SG_TIMEOUT": "20s",
+			},
+			check: func(t *testing.T, c *Config) {
+				want := []AlertmanagerConfig{
+					{Name: "id", Peers: []string{"am-id-0:9093", "am-id-1:9093", "am-id-2:9093"}, Timeout: 10 * time.Second},
+					{Name: "sg", Peers: []string{"am-sg-0:9093"}, Timeout: 20 * time.Second},
+				}
+				if !reflect.DeepEqual(c.Alertmanagers, want) {
+					t.Errorf("alertmanagers = %+v, want %+v", c.Alertmanagers, want)
+				}
+			},
+		},
+		{
+			name: "ALERTMANAGERS replaces file entries",
+			env: map[string]string{
+				"ALERTMANAGERS":         "eu=am-eu-0:9093, us=am-us-0:9093",
+				"ALERTMANAGER_EU_PEERS": "am-eu-1:9093",
+				"ALERTMANAGER_ID_PEERS": "am-id-1:9093",
+			},
+			check: func(t *testing.T, c *Config) {
+				want := []AlertmanagerConfig{
+					{Name: "eu", Peers: []string{"am-eu-0:9093", "am-eu-1:9093"}},
+					{Name: "us", Peers: []string{"am-us-0:9093"}},
+				}
+				if !reflect.DeepEqual(c.Alertmanagers, want) {
+					t.Errorf("alertmanagers = %+v, want %+v", c.Alertmanagers, want)
+				}
+			},
+		},
+		{
+			name: "ALERTMANAGER_HOST replaces file entries",
+			env: map[string]string{
+				"ALERTMANAGER_HOST":     "am:9093",
+				"ALERTMANAGER_PEERS":    "am-1:9093",
+				"ALERTMANAGER_USERNAME": "admin",
+			},
+			check: func(t *testing.T, c *Config) {
+				want := []AlertmanagerConfig{
+					{Name: "default", Peers: []string{"am:9093", "am-1:9093"}, Username: "admin"},
+				}
+				if !reflect.DeepEqual(c.Alertmanagers, want) {
+					t.Errorf("alertmanagers = %+v, want %+v", c.Alertmanagers, want)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			c, err := Load(configFile)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	configFile := writeFile(t, "config.yaml", `
+server:
+  verification_token: token
+lark:
+  app_id: cli_app
+  app_secret: secret
+repository:
+  backend: etcd
+alertmanagers:
+- name: default
+  peers: [am:9093]
+  password_file: /nonexistent/password
+`)
+	t.Setenv("PORT", "http")
+	t.Setenv("TRACING_ENABLED", "sometimes")
+	t.Setenv("HEALTH_TIMEOUT", "5")
+	t.Setenv("TRACING_SAMPLE_RATIO", "half")
+	t.Setenv("ALERTMANAGER_DEFAULT_LABELS", "env=prod,region")
+	t.Setenv("LARK_TENANTS", "payments")
+
+	_, err := Load(configFile)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Load() error = %v, want a ValidationError", err)
+	}
+	want := []string{
+		`PORT: "http" is not a number`,
+		`HEALTH_TIMEOUT: "5" is not a duration`,
+		`TRACING_ENABLED: "sometimes" is not a boolean`,
+		`TRACING_SAMPLE_RATIO: "half" is not a number`,
+		`LARK_TENANTS: "payments" is not a name=app_id pair`,
+		`ALERTMANAGER_DEFAULT_LABELS: "region" is not a name=value pair`,
+		"alertmanagers[0].password_file: open /nonexistent/password: no such file or directory",
+		`repository.backend: must be one of redis, memory, file, got "etcd"`,
+	}
+	if !reflect.DeepEqual(validationErr.Problems, want) {
+		t.Errorf("problems = %q, want %q", validationErr.Problems, want)
+	}
+	if !strings.HasPrefix(err.Error(), "invalid configuration:\n  - PORT: ") {
+		t.Errorf("error = %q, want every problem on its own line", err)
+	}
+
+	if _, err := Read(configFile); !errors.As(err, &validationErr) || len(validationErr.Problems) != 7 {
+		t.Errorf("Read() error = %v, want the problems without the validation", err)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	configFile := writeFile(t, "config.yaml", "card:\n  max_byte: 1000\n")
+	_, err := Load(configFile)
+	if err == nil || !strings.Contains(err.Error(), "field max_byte not found") {
+		t.Errorf("Load() error = %v, want the unknown field", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if problems := validConfig().validate(); len(problems) != 0 {
+		t.Fatalf("validConfig() has problems %q", problems)
+	}
+
+	tenant := func(name, appID string) TenantConfig {
+		return TenantConfig{Name: name, AppID: appID, AppSecret: "secret", VerificationToken: "token"}
+	}
+	withTenants := func(c *Config, tenants ...TenantConfig) {
+		c.Server.VerificationToken = ""
+		c.Lark.AppID, c.Lark.AppSecret = "", ""
+		c.Tenants = tenants
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(c *Config)
+		want   string
+	}{
+		{"port", func(c *Config) { c.Server.Port = 70000 }, "server.port: must be between 1 and 65535, got 70000"},
+		{"server timeout", func(c *Config) { c.Server.ReadTimeout = 0 }, "server.read_timeout: must be a positive duration, got 0s"},
+		{"body limit", func(c *Config) { c.Server.MaxBodyBytes = 0 }, "server.max_body_bytes: must be positive, got 0"},
+		{"server tls", func(c *Config) { c.Server.TLS.CertFile = "tls.crt" }, "server.tls: cert_file and key_file must be set together"},
+		{"log level", func(c *Config) { c.Log.Level = "loud" }, `log.level: must be one of debug, info, warn, error, got "loud"`},
+		{"log format", func(c *Config) { c.Log.Format = "xml" }, `log.format: must be one of text, json, got "xml"`},
+		{"metrics port", func(c *Config) { c.Metrics.Port = -1 }, "metrics.port: must be between 0 and 65535, got -1"},
+		{"metrics path", func(c *Config) { c.Metrics.Path = "metrics" }, `metrics.path: must start with /, got "metrics"`},
+		{"health", func(c *Config) { c.Health.CacheTTL = -time.Second }, "health.cache_ttl: must be a positive duration, got -1s"},
+		{
+			"tracing endpoint",
+			func(c *Config) { c.Tracing.Enabled, c.Tracing.Endpoint = true, "collector:4318" },
+			`tracing.endpoint: must be an absolute URL, got "collector:4318"`,
+		},
+		{
+			"tracing ratio",
+			func(c *Config) { c.Tracing.Enabled, c.Tracing.SampleRatio = true, 1.5 },
+			"tracing.sample_ratio: must be between 0 and 1, got 1.5",
+		},
+		{"tracing disabled", func(c *Config) { c.Tracing.SampleRatio = 1.5 }, ""},
+		{"verification token", func(c *Config) { c.Server.VerificationToken = "" }, "server.verification_token: is required"},
+		{"app secret", func(c *Config) { c.Lark.AppSecret = "" }, "lark.app_secret: is required"},
+		{"dry run credentials", func(c *Config) { c.Lark.DryRun, c.Lark.AppID, c.Lark.AppSecret = true, "", "" }, ""},
+		{"domain", func(c *Config) { c.Lark.Domain = "lark" }, `lark.domain: must be feishu, larksuite or an absolute URL, got "lark"`},
+		{"custom domain", func(c *Config) { c.Lark.Domain = "https://open.example.com" }, ""},
+		{"tenants", func(c *Config) { withTenants(c, tenant("payments", "cli_a"), tenant("logistics", "cli_b")) }, ""},
+		{
+			"tenants with lark app",
+			func(c *Config) { withTenants(c, tenant("payments", "cli_a")); c.Lark.AppID = "cli_app" },
+			"lark: app_id, app_secret and encrypt_key cannot be combined with tenants",
+		},
+		{
+			"tenants with lark domain",
+			func(c *Config) { withTenants(c, tenant("payments", "cli_a")); c.Lark.Domain = "larksuite" },
+			"lark.domain: cannot be combined with tenants",
+		},
+		{
+			"tenants with verification token",
+			func(c *Config) { withTenants(c, tenant("payments", "cli_a")); c.Server.VerificationToken = "token" },
+			"server.verification_token: cannot be combined with tenants",
+		},
+		{"tenant name", func(c *Config) { withTenants(c, tenant("", "cli_a")) }, "tenants[0].name: is required"},
+		{
+			"tenant name twice",
+			func(c *Config) { withTenants(c, tenant("payments", "cli_a"), tenant("payments", "cli_b")) },
+			"tenants[payments].name: is defined more than once",
+		},
+		{
+			"tenant app shared",
+			func(c *Config) { withTenants(c, tenant("payments", "cli_a"), tenant("logistics", "cli_a")) },
+			"tenants[logistics].app_id: belongs to another tenant",
+		},
+		{
+			"tenant token",
+			func(c *Config) { withTenants(c, TenantConfig{Name: "payments", AppID: "cli_a", AppSecret: "secret"}) },
+			"tenants[payments].verification_token: is required",
+		},
+		{
+			"tenant domain",
+			func(c *Config) { withTenants(c, tenant("payments", "cli_a")); c.Tenants[0].Domain = "feishu.cn" },
+			`tenants[payments].domain: must be feishu, larksuite or an absolute URL, got "feishu.cn"`,
+		},
+		{"repository ttl", func(c *Config) { c.Repository.TTL = 0 }, "repository.ttl: must be a positive duration, got 0s"},
+		{"memory backend", func(c *Config) { c.Repository.Backend, c.Repository.Redis.Address = "memory", "" }, ""},
+		{"file path", func(c *Config) { c.Repository.Backend = "file" }, "repository.file_path: is required"},
+		{"redis address", func(c *Config) { c.Repository.Redis.Address = "" }, "repository.redis: url, address, sentinel_master_name or cluster_addresses is required"},
+		{
+			"redis cluster and sentinel",
+			func(c *Config) {
+				c.Repository.Redis.ClusterAddresses = []string{"redis-0:6379"}
+				c.Repository.Redis.SentinelMasterName = "master"
+			},
+			"repository.redis.cluster_addresses: cannot be combined with sentinel_master_name",
+		},
+		{
+			"redis sentinel",
+			func(c *Config) { c.Repository.Redis.SentinelMasterName = "master" },
+			"repository.redis.sentinel_addresses: is required with sentinel_master_name",
+		},
+		{"redis db", func(c *Config) { c.Repository.Redis.DB = -1 }, "repository.redis.db: must not be negative, got -1"},
+		{
+			"redis url and db",
+			func(c *Config) { c.Repository.Redis.URL, c.Repository.Redis.DB = "redis://redis:6379/2", 3 },
+			"repository.redis.db: cannot be combined with url, select the database in the url path",
+		},
+		{"redis pool size", func(c *Config) { c.Repository.Redis.PoolSize = -1 }, "repository.redis.pool_size: must not be negative, got -1"},
+		{"redis min idle conns", func(c *Config) { c.Repository.Redis.MinIdleConns = -1 }, "repository.redis.min_idle_conns: must not be negative, got -1"},
+		{"redis read timeout", func(c *Config) { c.Repository.Redis.ReadTimeout = -time.Second }, "repository.redis.read_timeout: must not be negative, got -1s"},
+		{"redis tls", func(c *Config) { c.Repository.Redis.TLS.KeyFile = "tls.key" }, "repository.redis.tls: cert_file and key_file must be set together"},
+		{"no alertmanagers", func(c *Config) { c.Alertmanagers = nil }, "alertmanagers: at least one is required"},
+		{"alertmanager name", func(c *Config) { c.Alertmanagers[0].Name = "" }, "alertmanagers[0].name: is required"},
+		{
+			"alertmanager name twice",
+			func(c *Config) { c.Alertmanagers = append(c.Alertmanagers, c.Alertmanagers[0]) },
+			"alertmanagers[default].name: is defined more than once",
+		},
+		{"alertmanager peers", func(c *Config) { c.Alertmanagers[0].Peers = nil }, "alertmanagers[default].peers: at least one is required"},
+		{"alertmanager scheme", func(c *Config) { c.Alertmanagers[0].Scheme = "ftp" }, `alertmanagers[default].scheme: must be one of http, https, got "ftp"`},
+		{
+			"alertmanager auth",
+			func(c *Config) { c.Alertmanagers[0].Username, c.Alertmanagers[0].BearerTokenFile = "admin", "token" },
+			"alertmanagers[default]: basic auth and bearer token are mutually exclusive",
+		},
+		{
+			"alertmanager bearer token",
+			func(c *Config) { c.Alertmanagers[0].BearerToken, c.Alertmanagers[0].BearerTokenFile = "token", "token" },
+			"alertmanagers[default]: bearer_token and bearer_token_file are mutually exclusive",
+		},
+		{"alertmanager tls", func(c *Config) { c.Alertmanagers[0].TLS.CertFile = "tls.crt" }, "alertmanagers[default].tls: cert_file and key_file must be set together"},
+		{"alertmanager timeout", func(c *Config) { c.Alertmanagers[0].Timeout = -time.Second }, "alertmanagers[default].timeout: must not be negative, got -1s"},
+		{"silence mode", func(c *Config) { c.Routing.SilenceMode = "chat" }, `routing.silence_mode: must be one of group, alert, got "chat"`},
+		{"card bytes", func(c *Config) { c.Card.MaxBytes = 0 }, "card.max_bytes: must be positive, got 0"},
+		{"card overflow", func(c *Config) { c.Card.Overflow = "drop" }, `card.overflow: must be one of truncate, split, got "drop"`},
+		{"image timeout", func(c *Config) { c.Card.ImageTimeout = 0 }, "card.image_timeout: must be a positive duration, got 0s"},
+		{
+			"image hosts",
+			func(c *Config) { c.Card.ImageAllowedHosts = []string{"https://grafana.example.com"} },
+			`card.image_allowed_hosts: must be host names, got "https://grafana.example.com"`,
+		},
+		{
+			"graph url",
+			func(c *Config) { c.Graph.PrometheusURL = "prometheus:9090" },
+			`graph.prometheus_url: must be an absolute URL, got "prometheus:9090"`,
+		},
+		{
+			"graph timeout",
+			func(c *Config) { c.Graph.PrometheusURL, c.Graph.Timeout = "http://prometheus:9090", 0 },
+			"graph.timeout: must be a positive duration, got 0s",
+		},
+		{
+			"graph bytes",
+			func(c *Config) { c.Graph.PrometheusURL, c.Graph.MaxBytes = "http://prometheus:9090", 0 },
+			"graph.max_bytes: must be positive, got 0",
+		},
+		{"graph disabled", func(c *Config) { c.Graph.Timeout = 0 }, ""},
+		{"reminder", func(c *Config) { c.Reminder.Lead = 0 }, "reminder.lead: must be a positive duration, got 0s"},
+		{"reminder disabled", func(c *Config) { c.Reminder.Enabled, c.Reminder.Lead = false, 0 }, ""},
+		{"reconcile", func(c *Config) { c.Reconcile.Retention = 0 }, "reconcile.retention: must be a positive duration, got 0s"},
+		{"reconcile disabled", func(c *Config) { c.Reconcile.Enabled, c.Reconcile.Retention = false, 0 }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.mutate(c)
+			var want []string
+			if tt.want != "" {
+				want = []string{tt.want}
+			}
+			if problems := c.validate(); !slices.Equal(problems, want) {
+				t.Errorf("validate() = %q, want %q", problems, want)
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(c *Config)
+		want   []string
+	}{
+		{"unchanged", func(c *Config) {}, []string{}},
+		{"log level", func(c *Config) { c.Log.Level = "debug" }, []string{}},
+		{"alertmanagers", func(c *Config) { c.Alertmanagers[0].Peers = []string{"am-1:9093"} }, []string{}},
+		{"routing", func(c *Config) { c.Routing.SilenceMode = "alert" }, []string{}},
+		{"card", func(c *Config) { c.Card.MaxBytes = 1000 }, []string{}},
+		{"log format", func(c *Config) { c.Log.Format = "json" }, []string{"log"}},
+		{"server", func(c *Config) { c.Server.Port = 9000 }, []string{"server"}},
+		{"tenants", func(c *Config) { c.Tenants = []TenantConfig{{Name: "payments"}} }, []string{"tenants"}},
+		{
+			"several",
+			func(c *Config) {
+				c.Repository.TTL = time.Hour
+				c.Graph.Timeout = time.Second
+				c.Reconcile.Enabled = false
+				c.Log.Level = "debug"
+			},
+			[]string{"repository", "graph", "reconcile"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := validConfig()
+			tt.mutate(next)
+			if got := validConfig().restartRequired(next); !slices.Equal(got, tt.want) {
+				t.Errorf("restartRequired() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// env reads overrides from the environment, collecting the invalid values
+// instead of stopping at the first one.
+type env struct {
+	problems []string
+}
+
+func (e *env) string(name string, target *string) {
+	if value := os.Getenv(name); value != "" {
+		*target = value
+	}
+}
+
+func (e *env) list(name string, target *[]string) {
+	if value := os.Getenv(name); value != "" {
+		*target = splitList(value)
+	}
+}
+
+func (e *env) int(name string, target *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a number", name, value))
+		return
+	}
+	*target = parsed
+}
+
+func (e *env) bool(name string, target *bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a boolean", name, value))
+		return
+	}
+	*target = parsed
+}
+
+func (e *env) float(name string, target *float64) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a number", name, value))
+		return
+	}
+	*target = parsed
+}
+
+func (e *env) duration(name string, target *time.Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a duration", name, value))
+		return
+	}
+	*target = parsed
+}
+
+func (e *env) labels(name string, target *map[string]string) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	labels := make(map[string]string)
+	for _, item := range splitList(value) {
+		label, labelValue, ok := strings.Cut(item, "=")
+		if !ok {
+			e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a name=value pair", name, item))
+			return
+		}
+		labels[strings.TrimSpace(label)] = strings.TrimSpace(labelValue)
+	}
+	*target = labels
+}
+
+// applyEnv overrides the configuration with the environment variables
+// documented in the README.
+func applyEnv(config *Config) []string {
+	e := &env{}
+
+	e.int("PORT", &config.Server.Port)
+	e.string("VERIFICATION_TOKEN", &config.Server.VerificationToken)
+	e.string("VERIFICATION_TOKEN_FILE", &config.Server.VerificationTokenFile)
+	e.duration("SERVER_READ_HEADER_TIMEOUT", &config.Server.ReadHeaderTimeout)
+	e.duration("SERVER_READ_TIMEOUT", &config.Server.ReadTimeout)
+	e.duration("SERVER_WRITE_TIMEOUT", &config.Server.WriteTimeout)
+	e.duration("SERVER_IDLE_TIMEOUT", &config.Server.IdleTimeout)
+	e.duration("SERVER_SHUTDOWN_TIMEOUT", &config.Server.ShutdownTimeout)
+	e.int("SERVER_MAX_BODY_BYTES", &config.Server.MaxBodyBytes)
+	e.string("SERVER_TLS_CERT_FILE", &config.Server.TLS.CertFile)
+	e.string("SERVER_TLS_KEY_FILE", &config.Server.TLS.KeyFile)
+
+	e.string("LOG_LEVEL", &config.Log.Level)
+	e.string("LOG_FORMAT", &config.Log.Format)
+	e.list("LOG_REDACT_FIELDS", &config.Log.RedactFields)
+
+	e.int("METRICS_PORT", &config.Metrics.Port)
+	e.string("METRICS_PATH", &config.Metrics.Path)
+
+	e.duration("HEALTH_CACHE_TTL", &config.Health.CacheTTL)
+	e.duration("HEALTH_TIMEOUT", &config.Health.Timeout)
+
+	e.bool("TRACING_ENABLED", &config.Tracing.Enabled)
+	e.string("TRACING_ENDPOINT", &config.Tracing.Endpoint)
+	e.float("TRACING_SAMPLE_RATIO", &config.Tracing.SampleRatio)
+	e.string("OTEL_SERVICE_NAME", &config.Tracing.ServiceName)
+
+	e.string("LARK_APP_ID", &config.Lark.AppID)
+	e.string("LARK_APP_SECRET", &config.Lark.AppSecret)
+	e.string("LARK_APP_SECRET_FILE", &config.Lark.AppSecretFile)
+	e.string("LARK_DOMAIN", &config.Lark.Domain)
+	e.string("LARK_ENCRYPT_KEY", &config.Lark.EncryptKey)
+	e.string("LARK_ENCRYPT_KEY_FILE", &config.Lark.EncryptKeyFile)
+	e.bool("LARK_DRY_RUN", &config.Lark.DryRun)
+	e.string("LARK_DRY_RUN_OUTPUT", &config.Lark.DryRunOutput)
+	e.tenants(config)
+
+	repository := &config.Repository
+	e.string("REPOSITORY_BACKEND", &repository.Backend)
+	e.duration("STATE_TTL", &repository.TTL)
+	e.string("REPOSITORY_FILE_PATH", &repository.FilePath)
+	redis := &repository.Redis
+	e.string("REDIS_URL", &redis.URL)
+	e.string("REDIS_ADDRESS", &redis.Address)
+	e.string("REDIS_PASSWORD", &redis.Password)
+	e.string("REDIS_PASSWORD_FILE", &redis.PasswordFile)
+	e.int("REDIS_DB", &redis.DB)
+	e.string("REDIS_SENTINEL_MASTER_NAME", &redis.SentinelMasterName)
+	e.list("REDIS_SENTINEL_ADDRESSES", &redis.SentinelAddresses)
+	e.list("REDIS_CLUSTER_ADDRESSES", &redis.ClusterAddresses)
+	e.bool("REDIS_TLS_ENABLED", &redis.TLS.Enabled)
+	e.string("REDIS_TLS_CA_FILE", &redis.TLS.CAFile)
+	e.string("REDIS_TLS_CERT_FILE", &redis.TLS.CertFile)
+	e.string("REDIS_TLS_KEY_FILE", &redis.TLS.KeyFile)
+	e.string("REDIS_TLS_SERVER_NAME", &redis.TLS.ServerName)
+	e.bool("REDIS_TLS_INSECURE_SKIP_VERIFY", &redis.TLS.InsecureSkipVerify)
+	e.int("REDIS_POOL_SIZE", &redis.PoolSize)
+	e.int("REDIS_MIN_IDLE_CONNS", &redis.MinIdleConns)
+	e.duration("REDIS_DIAL_TIMEOUT", &redis.DialTimeout)
+	e.duration("REDIS_READ_TIMEOUT", &redis.ReadTimeout)
+	e.duration("REDIS_WRITE_TIMEOUT", &redis.WriteTimeout)
+	e.duration("REDIS_POOL_TIMEOUT", &redis.PoolTimeout)
+	e.duration("REDIS_IDLE_TIMEOUT", &redis.IdleTimeout)
+
+	e.alertmanagers(config)
+
+	e.list("GROUP_KEY_LABELS", &config.Routing.GroupLabels)
+	e.string("SILENCE_MODE", &config.Routing.SilenceMode)
+
+	e.int("CARD_MAX_BYTES", &config.Card.MaxBytes)
+	e.string("CARD_OVERFLOW", &config.Card.Overflow)
+	e.list("CARD_IMAGE_ALLOWED_HOSTS", &config.Card.ImageAllowedHosts)
+	e.duration("CARD_IMAGE_TIMEOUT", &config.Card.ImageTimeout)
+
+	e.string("GRAPH_PROMETHEUS_URL", &config.Graph.PrometheusURL)
+	e.duration("GRAPH_RANGE", &config.Graph.Range)
+	e.duration("GRAPH_TIMEOUT", &config.Graph.Timeout)
+	e.int("GRAPH_MAX_BYTES", &config.Graph.MaxBytes)
+
+	e.bool("SILENCE_REMINDER_ENABLED", &config.Reminder.Enabled)
+	e.duration("SILENCE_REMINDER_LEAD", &config.Reminder.Lead)
+	e.duration("SILENCE_REMINDER_INTERVAL", &config.Reminder.Interval)
+	e.bool("SILENCE_REMINDER_ALL_SILENCES", &config.Reminder.AllSilences)
+
+	e.bool("RECONCILE_ENABLED", &config.Reconcile.Enabled)
+	e.duration("RECONCILE_INTERVAL", &config.Reconcile.Interval)
+	e.duration("RECONCILE_MIN_AGE", &config.Reconcile.MinAge)
+	e.duration("STATE_RETENTION", &config.Reconcile.Retention)
+
+	return e.problems
+}
+
+// alertmanagers replaces the Alertmanagers of the file with the named ones
+// of ALERTMANAGERS, e.g. "id=am-id:9093,sg=am-sg:9093", or the single one
+// of ALERTMANAGER_HOST (or ALERTMANAGER_URL). The settings of each are
+// then overridden from ALERTMANAGER_<NAME>_*, or ALERTMANAGER_* for the
+// single one.
+func (e *env) alertmanagers(config *Config) {
+	host := os.Getenv("ALERTMANAGER_HOST")
+	if host == "" {
+		host = os.Getenv("ALERTMANAGER_URL")
+	}
+
+	switch {
+	case os.Getenv("ALERTMANAGERS") != "":
+		config.Alertmanagers = nil
+		for _, item := range splitList(os.Getenv("ALERTMANAGERS")) {
+			name, peer, ok := strings.Cut(item, "=")
+			if !ok {
+				e.problems = append(e.problems, fmt.Sprintf("ALERTMANAGERS: %q is not a name=host pair", item))
+				continue
+			}
+			config.Alertmanagers = append(config.Alertmanagers, AlertmanagerConfig{
+				Name:  strings.TrimSpace(name),
+				Peers: []string{strings.TrimSpace(peer)},
+			})
+		}
+	case host != "":
+		config.Alertmanagers = []AlertmanagerConfig{{
+			Name:  "default",
+			Peers: []string{host},
+		}}
+		e.alertmanager("ALERTMANAGER_", &config.Alertmanagers[0])
+		return
+	}
+
+	for i := range config.Alertmanagers {
+		am := &config.Alertmanagers[i]
+		e.alertmanager("ALERTMANAGER_"+envName(am.Name)+"_", am)
+	}
+}
+
+// tenants replaces the tenants of the file with the named ones of
+// LARK_TENANTS, e.g. "payments=cli_xxx,logistics=cli_yyy" by app ID. The
+// settings of each are then overridden from LARK_TENANT_<NAME>_*.
+func (e *env) tenants(config *Config) {
+	if value := os.Getenv("LARK_TENANTS"); value != "" {
+		config.Tenants = nil
+		for _, item := range splitList(value) {
+			name, appID, ok := strings.Cut(item, "=")
+			if !ok {
+				e.problems = append(e.problems, fmt.Sprintf("LARK_TENANTS: %q is not a name=app_id pair", item))
+				continue
+			}
+			config.Tenants = append(config.Tenants, TenantConfig{
+				Name:  strings.TrimSpace(name),
+				AppID: strings.TrimSpace(appID),
+			})
+		}
+	}
+
+	for i := range config.Tenants {
+		tenant := &config.Tenants[i]
+		prefix := "LARK_TENANT_" + envName(tenant.Name) + "_"
+		e.string(prefix+"APP_ID", &tenant.AppID)
+		e.string(prefix+"APP_SECRET", &tenant.AppSecret)
+		e.string(prefix+"APP_SECRET_FILE", &tenant.AppSecretFile)
+		e.string(prefix+"DOMAIN", &tenant.Domain)
+		e.string(prefix+"VERIFICATION_TOKEN", &tenant.VerificationToken)
+		e.string(prefix+"VERIFICATION_TOKEN_FILE", &tenant.VerificationTokenFile)
+		e.string(prefix+"ENCRYPT_KEY", &tenant.EncryptKey)
+		e.string(prefix+"ENCRYPT_KEY_FILE", &tenant.EncryptKeyFile)
+		e.list(prefix+"CHATS", &tenant.Chats)
+	}
+}
+
+func (e *env) alertmanager(prefix string, am *AlertmanagerConfig) {
+	var peers []string
+	e.list(prefix+"PEERS", &peers)
+	am.Peers = append(am.Peers, peers...)
+	e.string(prefix+"SCHEME", &am.Scheme)
+	e.string(prefix+"BASE_PATH", &am.BasePath)
+	e.string(prefix+"USERNAME", &am.Username)
+	e.string(prefix+"PASSWORD", &am.Password)
+	e.string(prefix+"PASSWORD_FILE", &am.PasswordFile)
+	e.string(prefix+"BEARER_TOKEN", &am.BearerToken)
+	e.string(prefix+"BEARER_TOKEN_FILE", &am.BearerTokenFile)
+	e.string(prefix+"TLS_CA_FILE", &am.TLS.CAFile)
+	e.string(prefix+"TLS_CERT_FILE", &am.TLS.CertFile)
+	e.string(prefix+"TLS_KEY_FILE", &am.TLS.KeyFile)
+	e.string(prefix+"TLS_SERVER_NAME", &am.TLS.ServerName)
+	e.bool(prefix+"TLS_INSECURE_SKIP_VERIFY", &am.TLS.InsecureSkipVerify)
+	e.duration(prefix+"TIMEOUT", &am.Timeout)
+	e.string(prefix+"EXTERNAL_URL", &am.ExternalURL)
+	e.list(prefix+"RECEIVERS", &am.Receivers)
+	e.labels(prefix+"LABELS", &am.Labels)
+}
+
+// envName upper-cases the name and replaces anything but letters and
+// digits with underscores.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimSpace(name))
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
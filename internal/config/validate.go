@@ -0,0 +1,224 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+)
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) check(ok bool, field, format string, args ...any) {
+	if !ok {
+		v.problems = append(v.problems, field+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (v *validator) required(value, field string) {
+	v.check(value != "", field, "is required")
+}
+
+func (v *validator) oneOf(value, field string, allowed ...string) {
+	v.check(slices.Contains(allowed, value), field, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+func (v *validator) positive(value time.Duration, field string) {
+	v.check(value > 0, field, "must be a positive duration, got %s", value)
+}
+
+// Validate reports every problem of the configuration at once.
+func (c *Config) Validate() error {
+	if problems := c.validate(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (c *Config) validate() []string {
+	v := &validator{}
+
+	v.check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	v.positive(c.Server.ReadHeaderTimeout, "server.read_header_timeout")
+	v.positive(c.Server.ReadTimeout, "server.read_timeout")
+	v.positive(c.Server.WriteTimeout, "server.write_timeout")
+	v.positive(c.Server.IdleTimeout, "server.idle_timeout")
+	v.positive(c.Server.ShutdownTimeout, "server.shutdown_timeout")
+	v.check(c.Server.MaxBodyBytes > 0, "server.max_body_bytes", "must be positive, got %d", c.Server.MaxBodyBytes)
+	v.check((c.Server.TLS.CertFile == "") == (c.Server.TLS.KeyFile == ""), "server.tls", "cert_file and key_file must be set together")
+	_, levelErr := logging.ParseLevel(c.Log.Level)
+	v.check(levelErr == nil, "log.level", "must be one of debug, info, warn, error, got %q", c.Log.Level)
+	v.oneOf(c.Log.Format, "log.format", logging.FormatText, logging.FormatJSON)
+	v.check(c.Metrics.Port >= 0 && c.Metrics.Port < 65536, "metrics.port", "must be between 0 and 65535, got %d", c.Metrics.Port)
+	v.check(strings.HasPrefix(c.Metrics.Path, "/"), "metrics.path", "must start with /, got %q", c.Metrics.Path)
+	v.positive(c.Health.CacheTTL, "health.cache_ttl")
+	v.positive(c.Health.Timeout, "health.timeout")
+	if c.Tracing.Enabled {
+		if c.Tracing.Endpoint != "" {
+			u, err := url.Parse(c.Tracing.Endpoint)
+			v.check(err == nil && u.Scheme != "" && u.Host != "", "tracing.endpoint", "must be an absolute URL, got %q", c.Tracing.Endpoint)
+		}
+		v.check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio", "must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+	}
+	c.validateTenants(v)
+
+	c.validateRepository(v)
+	c.validateAlertmanagers(v)
+
+	v.oneOf(c.Routing.SilenceMode, "routing.silence_mode", lark.SilenceModeGroup, lark.SilenceModeAlert)
+	v.check(c.Card.MaxBytes > 0, "card.max_bytes", "must be positive, got %d", c.Card.MaxBytes)
+	v.oneOf(c.Card.Overflow, "card.overflow", lark.CardOverflowTruncate, lark.CardOverflowSplit)
+	v.positive(c.Card.ImageTimeout, "card.image_timeout")
+	for _, host := range c.Card.ImageAllowedHosts {
+		v.check(host != "" && !strings.ContainsAny(host, "/:"), "card.image_allowed_hosts", "must be host names, got %q", host)
+	}
+
+	if c.Graph.PrometheusURL != "" {
+		u, err := url.Parse(c.Graph.PrometheusURL)
+		v.check(err == nil && u.Scheme != "" && u.Host != "", "graph.prometheus_url", "must be an absolute URL, got %q", c.Graph.PrometheusURL)
+		v.positive(c.Graph.Range, "graph.range")
+		v.positive(c.Graph.Timeout, "graph.timeout")
+		v.check(c.Graph.MaxBytes > 0, "graph.max_bytes", "must be positive, got %d", c.Graph.MaxBytes)
+	}
+
+	if c.Reminder.Enabled {
+		v.positive(c.Reminder.Lead, "reminder.lead")
+		v.positive(c.Reminder.Interval, "reminder.interval")
+	}
+	if c.Reconcile.Enabled {
+		v.positive(c.Reconcile.Interval, "reconcile.interval")
+		v.positive(c.Reconcile.MinAge, "reconcile.min_age")
+		v.positive(c.Reconcile.Retention, "reconcile.retention")
+	}
+
+	return v.problems
+}
+
+func (c *Config) validateRepository(v *validator) {
+	v.oneOf(c.Repository.Backend, "repository.backend", repository.BackendRedis, repository.BackendMemory, repository.BackendFile)
+	v.check(c.Repository.TTL > 0, "repository.ttl", "must be a positive duration, got %s", c.Repository.TTL)
+
+	switch c.Repository.Backend {
+	case repository.BackendFile:
+		v.required(c.Repository.FilePath, "repository.file_path")
+	case repository.BackendRedis:
+		redis := c.Repository.Redis
+		switch {
+		case len(redis.ClusterAddresses) > 0:
+			v.check(redis.SentinelMasterName == "", "repository.redis.cluster_addresses", "cannot be combined with sentinel_master_name")
+		case redis.SentinelMasterName != "":
+			v.check(len(redis.SentinelAddresses) > 0, "repository.redis.sentinel_addresses", "is required with sentinel_master_name")
+		default:
+			v.check(redis.URL != "" || redis.Address != "", "repository.redis", "url, address, sentinel_master_name or cluster_addresses is required")
+		}
+		v.check(redis.DB >= 0, "repository.redis.db", "must not be negative, got %d", redis.DB)
+		v.check(redis.URL == "" || redis.DB == 0, "repository.redis.db", "cannot be combined with url, select the database in the url path")
+		v.check(redis.PoolSize >= 0, "repository.redis.pool_size", "must not be negative, got %d", redis.PoolSize)
+		v.check(redis.MinIdleConns >= 0, "repository.redis.min_idle_conns", "must not be negative, got %d", redis.MinIdleConns)
+		for _, timeout := range []struct {
+			value time.Duration
+			field string
+		}{
+			{redis.DialTimeout, "repository.redis.dial_timeout"},
+			{redis.ReadTimeout, "repository.redis.read_timeout"},
+			{redis.WriteTimeout, "repository.redis.write_timeout"},
+			{redis.PoolTimeout, "repository.redis.pool_timeout"},
+			{redis.IdleTimeout, "repository.redis.idle_timeout"},
+		} {
+			v.check(timeout.value >= 0, timeout.field, "must not be negative, got %s", timeout.value)
+		}
+		v.check((redis.TLS.CertFile == "") == (redis.TLS.KeyFile == ""), "repository.redis.tls", "cert_file and key_file must be set together")
+	}
+}
+
+// validateTenants checks the tenants, or the single Lark app of the lark
+// section and its verification token when there are none.
+func (c *Config) validateTenants(v *validator) {
+	if len(c.Tenants) == 0 {
+		v.required(c.Server.VerificationToken, "server.verification_token")
+		// A dry run never authenticates against Lark.
+		if !c.Lark.DryRun {
+			v.required(c.Lark.AppID, "lark.app_id")
+			v.required(c.Lark.AppSecret, "lark.app_secret")
+		}
+		v.domain(c.Lark.Domain, "lark.domain")
+		return
+	}
+
+	// Credentials left outside of the tenants would be silently ignored.
+	v.check(c.Lark.AppID == "" && c.Lark.AppSecret == "" && c.Lark.EncryptKey == "", "lark", "app_id, app_secret and encrypt_key cannot be combined with tenants")
+	v.check(c.Lark.Domain == "", "lark.domain", "cannot be combined with tenants")
+	v.check(c.Server.VerificationToken == "", "server.verification_token", "cannot be combined with tenants")
+
+	names := make(map[string]bool, len(c.Tenants))
+	appIDs := make(map[string]bool, len(c.Tenants))
+	for i, tenant := range c.Tenants {
+		field := fmt.Sprintf("tenants[%d]", i)
+		if tenant.Name != "" {
+			field = fmt.Sprintf("tenants[%s]", tenant.Name)
+		}
+
+		v.required(tenant.Name, field+".name")
+		v.check(!names[tenant.Name], field+".name", "is defined more than once")
+		names[tenant.Name] = true
+
+		if !c.Lark.DryRun {
+			v.required(tenant.AppID, field+".app_id")
+			v.required(tenant.AppSecret, field+".app_secret")
+		}
+		v.check(tenant.AppID == "" || !appIDs[tenant.AppID], field+".app_id", "belongs to another tenant")
+		appIDs[tenant.AppID] = true
+		v.required(tenant.VerificationToken, field+".verification_token")
+		v.domain(tenant.Domain, field+".domain")
+	}
+}
+
+// domain checks a Lark domain: feishu, larksuite or an absolute URL.
+func (v *validator) domain(value, field string) {
+	if value == "" || value == lark.DomainFeishu || value == lark.DomainLarksuite {
+		return
+	}
+	u, err := url.Parse(value)
+	v.check(err == nil && u.Scheme != "" && u.Host != "", field, "must be %s, %s or an absolute URL, got %q", lark.DomainFeishu, lark.DomainLarksuite, value)
+}
+
+func (c *Config) validateAlertmanagers(v *validator) {
+	v.check(len(c.Alertmanagers) > 0, "alertmanagers", "at least one is required")
+
+	names := make(map[string]bool, len(c.Alertmanagers))
+	for i, am := range c.Alertmanagers {
+		field := fmt.Sprintf("alertmanagers[%d]", i)
+		if am.Name != "" {
+			field = fmt.Sprintf("alertmanagers[%s]", am.Name)
+		}
+
+		v.required(am.Name, field+".name")
+		v.check(!names[am.Name], field+".name", "is defined more than once")
+		names[am.Name] = true
+
+		v.check(len(am.Peers) > 0, field+".peers", "at least one is required")
+		if am.Scheme != "" {
+			v.oneOf(am.Scheme, field+".scheme", "http", "https")
+		}
+		v.check(am.Username == "" || (am.BearerToken == "" && am.BearerTokenFile == ""), field, "basic auth and bearer token are mutually exclusive")
+		v.check(am.BearerToken == "" || am.BearerTokenFile == "", field, "bearer_token and bearer_token_file are mutually exclusive")
+		v.check((am.TLS.CertFile == "") == (am.TLS.KeyFile == ""), field+".tls", "cert_file and key_file must be set together")
+		v.check(am.Timeout >= 0, field+".timeout", "must not be negative, got %s", am.Timeout)
+	}
+}
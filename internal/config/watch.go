@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// DefaultWatchInterval is how often the config file is checked for changes.
+const DefaultWatchInterval = 10 * time.Second
+
+// Watcher reloads the config file on SIGHUP, or when its content changes.
+// Polling the content rather than watching the file also catches mounted
+// ConfigMaps, which are swapped through a symlink.
+type Watcher struct {
+	path     string
+	interval time.Duration
+	current  *Config
+	checksum []byte
+
+	logger *slog.Logger
+}
+
+func NewWatcher(
+	path string,
+	interval time.Duration,
+	current *Config,
+
+	logger *slog.Logger,
+) *Watcher {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	w := &Watcher{
+		path:     path,
+		interval: interval,
+		current:  current,
+		logger:   logger,
+	}
+	w.checksum, _ = w.read()
+	return w
+}
+
+// Run calls apply with every valid configuration loaded until ctx is done.
+// An invalid configuration is reported and the current one kept.
+func (w *Watcher) Run(ctx context.Context, apply func(config *Config)) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			w.logger.Info("received SIGHUP, reloading configuration")
+			w.reload(apply)
+		case <-ticker.C:
+			checksum, err := w.read()
+			if err != nil {
+				w.logger.Warn("failed to read config file",
+					slog.String("path", w.path),
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+			if bytes.Equal(checksum, w.checksum) {
+				continue
+			}
+			w.logger.Info("config file changed, reloading configuration",
+				slog.String("path", w.path),
+			)
+			w.reload(apply)
+		}
+	}
+}
+
+func (w *Watcher) read() ([]byte, error) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	checksum := sha256.Sum256(data)
+	return checksum[:], nil
+}
+
+func (w *Watcher) reload(apply func(config *Config)) {
+	// Remember the content even when invalid, so it is reported once.
+	if checksum, err := w.read(); err == nil {
+		w.checksum = checksum
+	}
+
+	config, err := Load(w.path)
+	if err != nil {
+		w.logger.Error("keeping the current configuration",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	for _, section := range w.current.restartRequired(config) {
+		w.logger.Warn("configuration change takes effect after a restart",
+			slog.String("section", section),
+		)
+	}
+	apply(config)
+	w.current = config
+	w.logger.Info("configuration reloaded")
+}
+
+// restartRequired lists the sections that changed but are only read at
+// startup. Alertmanagers, routing, card settings and the log level are
+// reloaded.
+func (c *Config) restartRequired(next *Config) []string {
+	currentLog, nextLog := c.Log, next.Log
+	currentLog.Level, nextLog.Level = "", ""
+
+	sections := []struct {
+		name          string
+		current, next any
+	}{
+		{"server", c.Server, next.Server},
+		{"log", currentLog, nextLog},
+		{"metrics", c.Metrics, next.Metrics},
+		{"health", c.Health, next.Health},
+		{"tracing", c.Tracing, next.Tracing},
+		{"lark", c.Lark, next.Lark},
+		{"tenants", c.Tenants, next.Tenants},
+		{"repository", c.Repository, next.Repository},
+		{"graph", c.Graph, next.Graph},
+		{"reminder", c.Reminder, next.Reminder},
+		{"reconcile", c.Reconcile, next.Reconcile},
+	}
+
+	changed := make([]string, 0)
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.current, section.next) {
+			changed = append(changed, section.name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,136 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	larkmodel "source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+const (
+	DefaultRange    = time.Hour
+	DefaultTimeout  = 5 * time.Second
+	DefaultWidth    = 800
+	DefaultHeight   = 300
+	DefaultMaxBytes = 512 * 1024
+
+	// maxSeries caps how many series are drawn so a high-cardinality
+	// query cannot turn the graph into noise.
+	maxSeries = 10
+)
+
+type Config struct {
+	PrometheusURL string
+	Range         time.Duration
+	Timeout       time.Duration
+	Width         int
+	Height        int
+	MaxBytes      int
+}
+
+type Grapher struct {
+	api    promv1.API
+	config Config
+
+	logger *slog.Logger
+}
+
+var _ pkg.Grapher = (*Grapher)(nil)
+
+func New(
+	config Config,
+
+	logger *slog.Logger,
+) (*Grapher, error) {
+	client, err := api.NewClient(api.Config{
+		Address: config.PrometheusURL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create prometheus client: %w", err)
+	}
+
+	if config.Range <= 0 {
+		config.Range = DefaultRange
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.Width <= 0 {
+		config.Width = DefaultWidth
+	}
+	if config.Height <= 0 {
+		config.Height = DefaultHeight
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultMaxBytes
+	}
+
+	return &Grapher{
+		api:    promv1.NewAPI(client),
+		config: config,
+
+		logger: logger,
+	}, nil
+}
+
+func (g *Grapher) Render(ctx context.Context, alert larkmodel.WebhookAlert) ([]byte, error) {
+	query := QueryFromAlert(alert)
+	if query == "" {
+		return nil, nil
+	}
+	logger := g.logger.With(
+		slog.String("alert_id", alert.GroupKey),
+		slog.String("query", query),
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, g.config.Timeout)
+	defer cancel()
+
+	end := time.Now()
+	start := end.Add(-g.config.Range)
+	step := g.config.Range / time.Duration(g.config.Width)
+	if step < time.Second {
+		step = time.Second
+	}
+
+	logger.Debug("sending range query request")
+	value, warnings, err := g.api.QueryRange(ctx, query, promv1.Range{
+		Start: start,
+		End:   end,
+		Step:  step,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query range: %w", err)
+	}
+	for _, warning := range warnings {
+		logger.Warn("range query returned warning", slog.String("warning", warning))
+	}
+
+	matrix, ok := value.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("unexpected range query result type: %s", value.Type())
+	}
+	if len(matrix) == 0 {
+		logger.Debug("range query returned no series")
+		return nil, nil
+	}
+	if len(matrix) > maxSeries {
+		matrix = matrix[:maxSeries]
+	}
+
+	image, err := render(matrix, start, end, g.config.Width, g.config.Height)
+	if err != nil {
+		return nil, err
+	}
+	if len(image) > g.config.MaxBytes {
+		return nil, fmt.Errorf("rendered graph is %d bytes, exceeds limit of %d bytes", len(image), g.config.MaxBytes)
+	}
+
+	return image, nil
+}
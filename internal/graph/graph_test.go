@@ -0,0 +1,202 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	larkmodel "source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// newTestGrapher returns a grapher querying a fake Prometheus, which counts
+// the range queries and answers them with the response, or never when it is
+// "slow".
+func newTestGrapher(t *testing.T, config Config, response string) (*Grapher, *atomic.Int64) {
+	t.Helper()
+	var queries atomic.Int64
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" {
+			http.NotFound(w, r)
+			return
+		}
+		queries.Add(1)
+		if response == "slow" {
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(done) })
+
+	config.PrometheusURL = server.URL
+	g, err := New(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return g, &queries
+}
+
+// matrixResponse is a range query response with the number of series.
+func matrixResponse(series int) string {
+	now := time.Now().Unix()
+	results := make([]string, 0, series)
+	for i := range series {
+		results = append(results, fmt.Sprintf(`{"metric":{"pod":"checkout-%d"},"values":[[%d,"1"],[%d,"%d"],[%d,"NaN"],[%d,"3"]]}`,
+			i, now-3600, now-1800, i+2, now-900, now))
+	}
+	return `{"status":"success","data":{"resultType":"matrix","result":[` + strings.Join(results, ",") + `]}}`
+}
+
+var graphedAlert = larkmodel.WebhookAlert{
+	Actions: []larkmodel.WebhookAlertAction{
+		{Name: GraphQueryAction, Value: "rate(http_errors_total[5m])"},
+	},
+}
+
+func TestRender(t *testing.T) {
+	g, queries := newTestGrapher(t, Config{Width: 400, Height: 200}, matrixResponse(2))
+
+	image, err := g.Render(context.Background(), graphedAlert)
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("Render() returned an invalid png: %v", err)
+	}
+	if size := decoded.Bounds().Size(); size.X != 400 || size.Y != 200 {
+		t.Errorf("graph is %dx%d, want 400x200", size.X, size.Y)
+	}
+	if queries.Load() != 1 {
+		t.Errorf("sent %d range queries, want 1", queries.Load())
+	}
+}
+
+func TestRenderNothing(t *testing.T) {
+	tests := []struct {
+		name        string
+		alert       larkmodel.WebhookAlert
+		response    string
+		wantQueries int64
+	}{
+		{
+			name:        "no query",
+			alert:       larkmodel.WebhookAlert{Title: "HighErrorRate"},
+			response:    matrixResponse(1),
+			wantQueries: 0,
+		},
+		{
+			name:        "no series",
+			alert:       graphedAlert,
+			response:    matrixResponse(0),
+			wantQueries: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, queries := newTestGrapher(t, Config{}, tt.response)
+			image, err := g.Render(context.Background(), tt.alert)
+			if err != nil || image != nil {
+				t.Errorf("Render() = %d bytes, %v, want no graph and no error", len(image), err)
+			}
+			if queries.Load() != tt.wantQueries {
+				t.Errorf("sent %d range queries, want %d", queries.Load(), tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		response string
+		wantErr  string
+	}{
+		{
+			name:     "query error",
+			response: `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+			wantErr:  "failed to query range",
+		},
+		{
+			name:     "not a matrix",
+			response: `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"]}}`,
+			wantErr:  "unexpected range query result type: scalar",
+		},
+		{
+			name:     "over the size cap",
+			config:   Config{MaxBytes: 64},
+			response: matrixResponse(maxSeries + 5),
+			wantErr:  "exceeds limit of 64 bytes",
+		},
+		{
+			name:     "timeout",
+			config:   Config{Timeout: 50 * time.Millisecond},
+			response: "slow",
+			wantErr:  "failed to query range",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, _ := newTestGrapher(t, tt.config, tt.response)
+			image, err := g.Render(context.Background(), graphedAlert)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Render() error = %v, want %q", err, tt.wantErr)
+			}
+			if image != nil {
+				t.Errorf("Render() returned %d bytes with the error", len(image))
+			}
+		})
+	}
+}
+
+func TestValueRange(t *testing.T) {
+	series := func(values ...float64) *model.SampleStream {
+		stream := &model.SampleStream{}
+		for i, v := range values {
+			stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.Time(i), Value: model.SampleValue(v)})
+		}
+		return stream
+	}
+	tests := []struct {
+		name     string
+		matrix   model.Matrix
+		min, max float64
+	}{
+		{name: "padded", matrix: model.Matrix{series(0, 10), series(5, 20)}, min: -1, max: 21},
+		{name: "flat", matrix: model.Matrix{series(50, 50)}, min: 45, max: 55},
+		{name: "flat at zero", matrix: model.Matrix{series(0, 0)}, min: -1, max: 1},
+		{name: "no finite values", matrix: model.Matrix{series(math.NaN(), math.Inf(1))}, min: 0, max: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if min, max := valueRange(tt.matrix); min != tt.min || max != tt.max {
+				t.Errorf("valueRange() = %v, %v, want %v, %v", min, max, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRenderTooSmall(t *testing.T) {
+	if _, err := render(nil, time.Now().Add(-time.Hour), time.Now(), 2*margin, 100); err == nil {
+		t.Error("render() error = nil, want the graph size refused")
+	}
+}
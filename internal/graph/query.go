@@ -0,0 +1,55 @@
+package graph
+
+import (
+	"net/url"
+	"strings"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// GraphQueryAction is the action name used by templates to pass the
+// graph_query annotation, e.g.
+//
+//   - type: button
+//     text: Graph
+//     name: graph_query
+//     value: '{{ .CommonAnnotations.graph_query }}'
+const GraphQueryAction = "graph_query"
+
+// QueryFromAlert returns the PromQL expression to graph for the alert. An
+// explicit graph_query action wins over a Prometheus generator URL found in
+// the title link or the action URLs.
+func QueryFromAlert(alert model.WebhookAlert) string {
+	for _, action := range alert.Actions {
+		if action.Name == GraphQueryAction && strings.TrimSpace(action.Value) != "" {
+			return strings.TrimSpace(action.Value)
+		}
+	}
+
+	links := []string{alert.TitleLink}
+	for _, action := range alert.Actions {
+		links = append(links, action.URL)
+	}
+	for _, link := range links {
+		if query := queryFromGeneratorURL(link); query != "" {
+			return query
+		}
+	}
+
+	return ""
+}
+
+// queryFromGeneratorURL extracts the expression from a Prometheus generator
+// URL such as http://prometheus/graph?g0.expr=up&g0.tab=1.
+func queryFromGeneratorURL(link string) string {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return ""
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(u.Query().Get("g0.expr"))
+}
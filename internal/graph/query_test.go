@@ -0,0 +1,70 @@
+package graph
+
+import (
+	"testing"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+func TestQueryFromAlert(t *testing.T) {
+	generatorURL := "http://prometheus:9090/graph?g0.expr=rate%28http_errors_total%5B5m%5D%29+%3E+0.05&g0.tab=1"
+	tests := []struct {
+		name  string
+		alert model.WebhookAlert
+		want  string
+	}{
+		{
+			name:  "nothing to graph",
+			alert: model.WebhookAlert{TitleLink: "http://alertmanager:9093/#/alerts"},
+			want:  "",
+		},
+		{
+			name:  "generator url in the title link",
+			alert: model.WebhookAlert{TitleLink: generatorURL},
+			want:  "rate(http_errors_total[5m]) > 0.05",
+		},
+		{
+			name: "generator url in an action",
+			alert: model.WebhookAlert{
+				TitleLink: "http://alertmanager:9093/#/alerts",
+				Actions: []model.WebhookAlertAction{
+					{Name: "runbook", URL: "https://runbooks.example.com/high-error-rate"},
+					{Name: "query", URL: generatorURL},
+				},
+			},
+			want: "rate(http_errors_total[5m]) > 0.05",
+		},
+		{
+			name: "graph_query action wins",
+			alert: model.WebhookAlert{
+				TitleLink: generatorURL,
+				Actions: []model.WebhookAlertAction{
+					{Name: GraphQueryAction, Value: "  up{job=\"checkout\"} "},
+				},
+			},
+			want: `up{job="checkout"}`,
+		},
+		{
+			name: "empty graph_query action",
+			alert: model.WebhookAlert{
+				TitleLink: generatorURL,
+				Actions: []model.WebhookAlertAction{
+					{Name: GraphQueryAction, Value: " "},
+				},
+			},
+			want: "rate(http_errors_total[5m]) > 0.05",
+		},
+		{
+			name:  "invalid url",
+			alert: model.WebhookAlert{TitleLink: "http://[::1"},
+			want:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := QueryFromAlert(tt.alert); got != tt.want {
+				t.Errorf("QueryFromAlert() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
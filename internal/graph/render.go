@@ -0,0 +1,161 @@
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	margin    = 10
+	gridLines = 4
+)
+
+var (
+	background = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	gridColor  = color.RGBA{R: 229, G: 230, B: 235, A: 255}
+	axisColor  = color.RGBA{R: 143, G: 149, B: 158, A: 255}
+
+	palette = []color.RGBA{
+		{R: 51, G: 112, B: 255, A: 255},
+		{R: 245, G: 74, B: 69, A: 255},
+		{R: 52, G: 199, B: 36, A: 255},
+		{R: 255, G: 136, B: 0, A: 255},
+		{R: 127, G: 59, B: 245, A: 255},
+		{R: 20, G: 192, B: 255, A: 255},
+		{R: 240, G: 56, B: 157, A: 255},
+		{R: 255, G: 198, B: 10, A: 255},
+		{R: 0, G: 153, B: 128, A: 255},
+		{R: 100, G: 106, B: 115, A: 255},
+	}
+)
+
+// render draws the series as a line chart and encodes it as PNG.
+func render(matrix model.Matrix, start, end time.Time, width, height int) ([]byte, error) {
+	if width <= 2*margin || height <= 2*margin {
+		return nil, fmt.Errorf("graph size %dx%d is too small", width, height)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+
+	plot := image.Rect(margin, margin, width-margin, height-margin)
+	for i := 0; i <= gridLines; i++ {
+		y := plot.Min.Y + i*(plot.Dy()-1)/gridLines
+		drawLine(img, plot.Min.X, y, plot.Max.X-1, y, gridColor)
+	}
+	drawLine(img, plot.Min.X, plot.Min.Y, plot.Min.X, plot.Max.Y-1, axisColor)
+	drawLine(img, plot.Min.X, plot.Max.Y-1, plot.Max.X-1, plot.Max.Y-1, axisColor)
+
+	minValue, maxValue := valueRange(matrix)
+	from, to := start.Unix(), end.Unix()
+	if to <= from {
+		to = from + 1
+	}
+
+	x := func(t model.Time) int {
+		return plot.Min.X + int(float64(t.Unix()-from)/float64(to-from)*float64(plot.Dx()-1))
+	}
+	y := func(v model.SampleValue) int {
+		return plot.Max.Y - 1 - int((float64(v)-minValue)/(maxValue-minValue)*float64(plot.Dy()-1))
+	}
+
+	for i, series := range matrix {
+		c := palette[i%len(palette)]
+		prevX, prevY, hasPrev := 0, 0, false
+		for _, sample := range series.Values {
+			if !isFinite(float64(sample.Value)) {
+				hasPrev = false
+				continue
+			}
+			curX, curY := x(sample.Timestamp), y(sample.Value)
+			if hasPrev {
+				drawThickLine(img, prevX, prevY, curX, curY, c)
+			}
+			prevX, prevY, hasPrev = curX, curY, true
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode graph: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func valueRange(matrix model.Matrix) (float64, float64) {
+	minValue, maxValue := math.Inf(1), math.Inf(-1)
+	for _, series := range matrix {
+		for _, sample := range series.Values {
+			v := float64(sample.Value)
+			if !isFinite(v) {
+				continue
+			}
+			minValue = math.Min(minValue, v)
+			maxValue = math.Max(maxValue, v)
+		}
+	}
+	if math.IsInf(minValue, 0) || math.IsInf(maxValue, 0) {
+		return 0, 1
+	}
+	if minValue == maxValue {
+		pad := math.Max(math.Abs(minValue)*0.1, 1)
+		return minValue - pad, maxValue + pad
+	}
+	pad := (maxValue - minValue) * 0.05
+	return minValue - pad, maxValue + pad
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func drawThickLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	drawLine(img, x0, y0, x1, y1, c)
+	drawLine(img, x0, y0+1, x1, y1+1, c)
+}
+
+// drawLine draws a line using Bresenham's algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	dx := abs(x1 - x0)
+	dy := -abs(y1 - y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.SetRGBA(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
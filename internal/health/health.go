@@ -0,0 +1,143 @@
+// Package health runs the dependency checks of the readiness probe.
+package health
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+)
+
+const (
+	DefaultCacheTTL = 10 * time.Second
+	DefaultTimeout  = 5 * time.Second
+
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+type Config struct {
+	// CacheTTL is how long results are reused, so frequent probes do not
+	// hammer the dependencies.
+	CacheTTL time.Duration
+	// Timeout bounds each check.
+	Timeout time.Duration
+}
+
+// Check is a named dependency.
+type Check struct {
+	Name    string
+	Checker pkg.HealthChecker
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type CheckResult struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type Health struct {
+	config Config
+	checks []Check
+
+	// mu is held while checking, so concurrent probes share one run.
+	mu        sync.Mutex
+	report    Report
+	checkedAt time.Time
+
+	logger *slog.Logger
+}
+
+func New(
+	config Config,
+	checks []Check,
+
+	logger *slog.Logger,
+) *Health {
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = DefaultCacheTTL
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	return &Health{
+		config: config,
+		checks: checks,
+		logger: logger,
+	}
+}
+
+// Ready runs every check, or returns the results of the last run when it
+// is recent enough. The status is ok only when every check passed.
+func (h *Health) Ready(ctx context.Context) Report {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < h.config.CacheTTL {
+		return h.report
+	}
+
+	results := make(map[string]CheckResult, len(h.checks))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, check := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := h.run(ctx, check)
+			mu.Lock()
+			results[check.Name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	if report.Status != h.report.Status && !h.checkedAt.IsZero() {
+		h.logger.WarnContext(ctx, "readiness changed",
+			slog.String("status", report.Status),
+		)
+	}
+
+	h.report = report
+	h.checkedAt = time.Now()
+	return report
+}
+
+func (h *Health) run(ctx context.Context, check Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Checker.CheckHealth(ctx)
+	result := CheckResult{
+		Status:    StatusOK,
+		Duration:  time.Since(start).Round(time.Millisecond).String(),
+		CheckedAt: start,
+	}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+		h.logger.WarnContext(ctx, "health check failed",
+			slog.String("check", check.Name),
+			slog.String("error", err.Error()),
+		)
+	}
+	return result
+}
@@ -0,0 +1,186 @@
+package lark
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/graph"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// textAnnotations are rendered, in order, at the top of each alert.
+var textAnnotations = []string{"summary", "message", "description"}
+
+// NotifyAlertmanager posts a native Alertmanager notification to the chat.
+// The card mirrors what the lark.* templates render for Slack payloads.
+func (l *Lark) NotifyAlertmanager(ctx context.Context, webhook model.AlertmanagerWebhook, channel string) error {
+	if err := l.checkChat(ctx, channel); err != nil {
+		return err
+	}
+	alert := webhookAlertFromAlertmanager(webhook)
+	group := l.alertmanagerAlertGroup(webhook)
+	alert.GroupKey = group.Key
+
+	tracked := make(map[string]*model.TrackedAlert)
+	if state, err := l.repository.GetAlertState(ctx, group.Key); err == nil {
+		tracked = state.Alerts
+	}
+	if err := l.notifyAlert(ctx, alert, group, channel); err != nil {
+		return err
+	}
+	observeNotifyDelay(webhook, tracked)
+	return nil
+}
+
+// observeNotifyDelay records, for each alert whose status changed since it
+// was last tracked, how long after firing or resolving it was posted.
+// Repeated notifications, and copies posted to further chats, are skipped.
+func observeNotifyDelay(webhook model.AlertmanagerWebhook, tracked map[string]*model.TrackedAlert) {
+	for _, alert := range webhook.Alerts {
+		previous, ok := tracked[alert.Fingerprint]
+		if ok && previous.Status == alert.Status {
+			continue
+		}
+		switch alert.Status {
+		case model.AlertStatusFiring:
+			o11y.ObserveNotifyDelay(alert.Status, alert.StartsAt)
+		case model.AlertStatusResolved:
+			// An alert resolved before it was ever posted has no delay.
+			if ok {
+				o11y.ObserveNotifyDelay(alert.Status, alert.EndsAt)
+			}
+		}
+	}
+}
+
+func webhookAlertFromAlertmanager(webhook model.AlertmanagerWebhook) model.WebhookAlert {
+	fingerprints := make([]string, 0, len(webhook.Alerts))
+	firing := 0
+	for _, alert := range webhook.Alerts {
+		fingerprints = append(fingerprints, alert.Fingerprint)
+		if alert.Status == model.AlertStatusFiring {
+			firing++
+		}
+	}
+
+	title := fmt.Sprintf("[%s] %s", strings.ToUpper(webhook.Status), webhook.CommonLabels["alertname"])
+	if webhook.Status == model.AlertStatusFiring {
+		title = fmt.Sprintf("[FIRING:%d] %s", firing, webhook.CommonLabels["alertname"])
+	}
+
+	alert := model.WebhookAlert{
+		Color:      alertmanagerColor(webhook),
+		CallbackID: strings.Join(fingerprints, ",") + ",",
+		Title:      title,
+		TitleLink:  alertmanagerAlertsURL(webhook),
+		Text:       alertmanagerText(webhook),
+		Fields:     alertmanagerFields(webhook),
+	}
+	if webhook.TruncatedAlerts > 0 {
+		alert.Text += fmt.Sprintf("\n\n… %d more alerts truncated by Alertmanager", webhook.TruncatedAlerts)
+	}
+
+	if len(webhook.Alerts) > 0 {
+		first := webhook.Alerts[0]
+		for _, action := range []struct{ text, url string }{
+			{"Runbook", first.Annotations["runbook_url"]},
+			{"Query", first.GeneratorURL},
+			{"Dashboard", first.Annotations["dashboard"]},
+		} {
+			if action.url != "" {
+				alert.Actions = append(alert.Actions, model.WebhookAlertAction{
+					Text: action.text,
+					Type: "button",
+					URL:  action.url,
+				})
+			}
+		}
+		if query := first.Annotations["graph_query"]; query != "" {
+			alert.Actions = append(alert.Actions, model.WebhookAlertAction{
+				Type:  "button",
+				Name:  graph.GraphQueryAction,
+				Value: query,
+			})
+		}
+	}
+
+	return alert
+}
+
+// alertmanagerColor follows the lark.color template.
+func alertmanagerColor(webhook model.AlertmanagerWebhook) string {
+	if webhook.Status != model.AlertStatusFiring {
+		return "green"
+	}
+	switch webhook.CommonLabels["severity"] {
+	case "warning":
+		return "yellow"
+	case "critical":
+		return "red"
+	default:
+		return "blue"
+	}
+}
+
+// alertmanagerText lists the annotations of each alert followed by the
+// labels that are not common to the whole group, one paragraph per alert so
+// oversized cards are cut per alert.
+func alertmanagerText(webhook model.AlertmanagerWebhook) string {
+	paragraphs := make([]string, 0, len(webhook.Alerts))
+	for _, alert := range webhook.Alerts {
+		lines := make([]string, 0)
+		for _, name := range textAnnotations {
+			if value := alert.Annotations[name]; value != "" {
+				lines = append(lines, value)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(alert.Labels)) {
+			if _, ok := webhook.CommonLabels[name]; ok || name == "alertname" {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s", name, alert.Labels[name]))
+		}
+		paragraphs = append(paragraphs, strings.Join(lines, "\n"))
+	}
+
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// alertmanagerFields renders the labels common to the whole group as short
+// fields.
+func alertmanagerFields(webhook model.AlertmanagerWebhook) []model.WebhookAlertField {
+	fields := make([]model.WebhookAlertField, 0, len(webhook.CommonLabels))
+	for _, name := range slices.Sorted(maps.Keys(webhook.CommonLabels)) {
+		if name == "alertname" {
+			continue
+		}
+		fields = append(fields, model.WebhookAlertField{
+			Title: name,
+			Value: webhook.CommonLabels[name],
+			Short: true,
+		})
+	}
+	return fields
+}
+
+// alertmanagerAlertsURL links to the group's alerts in the Alertmanager UI.
+func alertmanagerAlertsURL(webhook model.AlertmanagerWebhook) string {
+	if webhook.ExternalURL == "" {
+		return ""
+	}
+
+	filters := make([]string, 0, len(webhook.GroupLabels))
+	for _, name := range slices.Sorted(maps.Keys(webhook.GroupLabels)) {
+		filters = append(filters, fmt.Sprintf("%s=%q", name, webhook.GroupLabels[name]))
+	}
+	query := url.Values{}
+	query.Set("receiver", webhook.Receiver)
+	query.Set("filter", "{"+strings.Join(filters, ",")+"}")
+
+	return strings.TrimSuffix(webhook.ExternalURL, "/") + "/#/alerts?" + query.Encode()
+}
@@ -2,26 +2,61 @@ package lark
 
 import (
 	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
 )
 
 // TODO: Add logging here
-type cardBuilder struct{}
+type cardBuilder struct {
+	options CardOptions
+}
 
-func newCardBuilder() *cardBuilder {
-	return &cardBuilder{}
+// cardMedia holds the keys of images uploaded to Lark for a card.
+type cardMedia struct {
+	ImageKey           string
+	ThumbImageKey      string
+	FooterIconImageKey string
+	// GraphImageKey is the metric graph, added once the card is posted.
+	GraphImageKey string
 }
 
-func (l *cardBuilder) Build(alert *model.WebhookAlert) *model.LarkCard {
+// cardTimezone is used to render attachment timestamps.
+var cardTimezone = time.FixedZone("WIB", 7*60*60)
+
+func newCardBuilder(options CardOptions) *cardBuilder {
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultCardMaxBytes
+	}
+	if options.Overflow == "" {
+		options.Overflow = CardOverflowTruncate
+	}
+
+	return &cardBuilder{
+		options: options,
+	}
+}
+
+func (l *cardBuilder) Build(alert *model.WebhookAlert, media *cardMedia) *model.LarkCard {
+	return l.build(alert, media, "")
+}
+
+// build renders the card, with an optional note below the alert text.
+func (l *cardBuilder) build(alert *model.WebhookAlert, media *cardMedia, note string) *model.LarkCard {
 	return &model.LarkCard{
 		Header:   l.buildCardHeader(alert),
-		Elements: l.buildCardElements(alert),
+		Elements: l.buildCardElements(alert, media, note),
 	}
 }
 
-func (l *cardBuilder) BuildJSON(alert *model.WebhookAlert) (string, error) {
-	card := l.Build(alert)
+func (l *cardBuilder) BuildJSON(alert *model.WebhookAlert, media *cardMedia) (string, error) {
+	return l.marshal(l.Build(alert, media))
+}
+
+func (l *cardBuilder) marshal(card *model.LarkCard) (string, error) {
 	jsonBytes, err := json.Marshal(card)
 	if err != nil {
 		return "", err
@@ -33,26 +68,181 @@ func (l *cardBuilder) BuildJSON(alert *model.WebhookAlert) (string, error) {
 func (l *cardBuilder) buildCardHeader(alert *model.WebhookAlert) *model.LarkCardHeader {
 	return &model.LarkCardHeader{
 		Title: &model.LarkCardText{
-			Content: alert.Title,
+			Content: l.formatTitle(alert),
 			Tag:     "plain_text",
 		},
 		Color: alert.Color,
 	}
 }
 
-func (l *cardBuilder) buildCardElements(alert *model.WebhookAlert) []*model.LarkCardElement {
-	return []*model.LarkCardElement{
-		{
-			Tag: "div",
+func (l *cardBuilder) buildCardElements(alert *model.WebhookAlert, media *cardMedia, note string) []*model.LarkCardElement {
+	if media == nil {
+		media = &cardMedia{}
+	}
+
+	elements := make([]*model.LarkCardElement, 0)
+	if alert.Pretext != "" {
+		elements = append(elements, l.buildCardMarkdown(l.formatMrkdwn(alert, "pretext", alert.Pretext)))
+	}
+	if alert.AuthorName != "" {
+		elements = append(elements, l.buildCardAuthor(alert))
+	}
+
+	text := l.buildCardMarkdown(l.formatText(alert))
+	if media.ThumbImageKey != "" {
+		text.Extra = l.buildCardImage(media.ThumbImageKey, alert.Title)
+		text.Extra.Mode = ""
+	}
+	elements = append(elements, text)
+	if note != "" {
+		elements = append(elements, l.buildCardNote(note))
+	}
+
+	if len(alert.Fields) > 0 {
+		elements = append(elements, l.buildCardFields(alert))
+	}
+	if media.ImageKey != "" {
+		elements = append(elements, l.buildCardImage(media.ImageKey, alert.Title))
+	}
+	if media.GraphImageKey != "" {
+		elements = append(elements, l.buildCardImage(media.GraphImageKey, alert.Title))
+	}
+
+	elements = append(elements,
+		&model.LarkCardElement{
+			Tag: "hr",
+		},
+		l.buildCardActions(alert),
+	)
+
+	if footer := l.buildCardFooter(alert, media); footer != nil {
+		elements = append(elements, footer)
+	}
+
+	return elements
+}
+
+func (l *cardBuilder) buildCardMarkdown(content string) *model.LarkCardElement {
+	return &model.LarkCardElement{
+		Tag: "div",
+		Text: &model.LarkCardText{
+			Content: content,
+			Tag:     "lark_md",
+		},
+	}
+}
+
+func (l *cardBuilder) buildCardAuthor(alert *model.WebhookAlert) *model.LarkCardElement {
+	author := stripMrkdwn(alert.AuthorName)
+	if alert.AuthorLink != "" {
+		author = fmt.Sprintf("[%s](%s)", author, alert.AuthorLink)
+	}
+	return l.buildCardMarkdown("**" + author + "**")
+}
+
+// buildCardFields lays out attachment fields as columns; short fields share
+// a row, like they do in Slack.
+func (l *cardBuilder) buildCardFields(alert *model.WebhookAlert) *model.LarkCardElement {
+	fields := make([]*model.LarkCardField, 0, len(alert.Fields))
+	for _, field := range alert.Fields {
+		content := l.formatMrkdwn(alert, "fields", field.Value)
+		if field.Title != "" {
+			content = "**" + stripMrkdwn(field.Title) + "**\n" + content
+		}
+		fields = append(fields, &model.LarkCardField{
+			IsShort: field.Short,
 			Text: &model.LarkCardText{
-				Content: alert.Text,
+				Content: content,
 				Tag:     "lark_md",
 			},
+		})
+	}
+
+	return &model.LarkCardElement{
+		Tag:    "div",
+		Fields: fields,
+	}
+}
+
+func (l *cardBuilder) buildCardNote(note string) *model.LarkCardElement {
+	return &model.LarkCardElement{
+		Tag: "note",
+		Elements: []*model.LarkCardElement{
+			{
+				Tag:     "lark_md",
+				Content: note,
+			},
 		},
-		{
-			Tag: "hr",
+	}
+}
+
+// buildCardFooter renders the footer, its icon and the attachment timestamp
+// as a note element.
+func (l *cardBuilder) buildCardFooter(alert *model.WebhookAlert, media *cardMedia) *model.LarkCardElement {
+	parts := make([]string, 0, 2)
+	if alert.Footer != "" {
+		parts = append(parts, l.formatMrkdwn(alert, "footer", alert.Footer))
+	}
+	if ts, err := alert.Ts.Float64(); err == nil && ts > 0 {
+		parts = append(parts, time.Unix(int64(ts), 0).In(cardTimezone).Format("2006-01-02 15:04:05 MST"))
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+
+	elements := make([]*model.LarkCardElement, 0, 2)
+	if media.FooterIconImageKey != "" {
+		icon := l.buildCardImage(media.FooterIconImageKey, alert.Footer)
+		icon.Mode, icon.Preview = "", false
+		elements = append(elements, icon)
+	}
+	elements = append(elements, &model.LarkCardElement{
+		Tag:     "lark_md",
+		Content: strings.Join(parts, " | "),
+	})
+
+	return &model.LarkCardElement{
+		Tag:      "note",
+		Elements: elements,
+	}
+}
+
+// formatTitle renders the title as plain text, since the card header does
+// not support markdown.
+func (l *cardBuilder) formatTitle(alert *model.WebhookAlert) string {
+	if !isMrkdwnIn(alert, "title") {
+		return alert.Title
+	}
+	return stripMrkdwn(alert.Title)
+}
+
+func (l *cardBuilder) formatText(alert *model.WebhookAlert) string {
+	return l.formatMrkdwn(alert, "text", alert.Text)
+}
+
+func (l *cardBuilder) formatMrkdwn(alert *model.WebhookAlert, field, content string) string {
+	if !isMrkdwnIn(alert, field) {
+		return content
+	}
+	return convertMrkdwn(content)
+}
+
+// isMrkdwnIn reports whether Slack would have rendered the attachment field
+// as mrkdwn.
+func isMrkdwnIn(alert *model.WebhookAlert, field string) bool {
+	return slices.Contains(alert.MrkdwnIn, field)
+}
+
+func (l *cardBuilder) buildCardImage(imageKey, alt string) *model.LarkCardElement {
+	return &model.LarkCardElement{
+		Tag:    "img",
+		ImgKey: imageKey,
+		Alt: &model.LarkCardText{
+			Content: alt,
+			Tag:     "plain_text",
 		},
-		l.buildCardActions(alert),
+		Mode:    "fit_horizontal",
+		Preview: true,
 	}
 }
 
@@ -93,9 +283,7 @@ func (l *cardBuilder) buildCardActions(alert *model.WebhookAlert) *model.LarkCar
 			{Text: &model.LarkCardText{Tag: "plain_text", Content: "1 month"}, Value: "1M"},
 			{Text: &model.LarkCardText{Tag: "plain_text", Content: "1 year"}, Value: "1Y"},
 		},
-		Value: map[string]string{
-			"alert_id": alert.CallbackID,
-		},
+		Value: buildActionValue(alert),
 	})
 	// Silence button (always uses default duration)
 	if alert.CallbackID != "" {
@@ -106,9 +294,7 @@ func (l *cardBuilder) buildCardActions(alert *model.WebhookAlert) *model.LarkCar
 				Tag:     "plain_text",
 				Content: "Silence",
 			},
-			Value: map[string]string{
-				"alert_id": alert.CallbackID,
-			},
+			Value: buildActionValue(alert),
 		})
 	}
 
@@ -117,3 +303,15 @@ func (l *cardBuilder) buildCardActions(alert *model.WebhookAlert) *model.LarkCar
 		Actions: cardActions,
 	}
 }
+
+// buildActionValue is the value sent back by the silence actions. The group
+// key lets the callback find the tracked group after its members changed.
+func buildActionValue(alert *model.WebhookAlert) map[string]string {
+	value := map[string]string{
+		"alert_id": alert.CallbackID,
+	}
+	if alert.GroupKey != "" {
+		value["group_key"] = alert.GroupKey
+	}
+	return value
+}
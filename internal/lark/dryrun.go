@@ -0,0 +1,201 @@
+package lark
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
+)
+
+// Where dry-run requests are written to, any other value is a file path.
+const (
+	DryRunOutputLog    = "log"
+	DryRunOutputStdout = "stdout"
+)
+
+// dryRunAppID stands in for the app ID and secret of a dry run without.
+const dryRunAppID = "dry-run"
+
+// DryRun stands in for the HTTP client of the Lark SDK. It writes every
+// request it would have sent and answers it as Lark would, so the whole
+// notification flow runs without reaching Lark.
+type DryRun struct {
+	mu     sync.Mutex
+	output io.Writer
+	file   *os.File
+	// sequence numbers the IDs of the fake messages and images.
+	sequence atomic.Int64
+
+	logger *slog.Logger
+}
+
+var _ larkcore.HttpClient = (*DryRun)(nil)
+
+// dryRunRequest is a line of the dry-run output.
+type dryRunRequest struct {
+	Time   time.Time       `json:"time"`
+	Method string          `json:"method"`
+	Host   string          `json:"host"`
+	Path   string          `json:"path"`
+	Query  string          `json:"query,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+func NewDryRun(
+	output string,
+
+	logger *slog.Logger,
+) (*DryRun, error) {
+	d := &DryRun{
+		logger: logger,
+	}
+	switch output {
+	case "", DryRunOutputLog:
+	case DryRunOutputStdout:
+		d.output = os.Stdout
+	default:
+		file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open dry-run output: %w", err)
+		}
+		d.output = file
+		d.file = file
+	}
+	return d, nil
+}
+
+func (d *DryRun) Do(req *http.Request) (*http.Response, error) {
+	body, err := dryRunBody(req)
+	if err != nil {
+		return nil, err
+	}
+	d.write(dryRunRequest{
+		Time:   time.Now(),
+		Method: req.Method,
+		Host:   req.URL.Host,
+		Path:   req.URL.Path,
+		Query:  req.URL.RawQuery,
+		Body:   body,
+	})
+
+	id := d.sequence.Add(1)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":              []string{"application/json"},
+			larkcore.HttpHeaderKeyLogId: []string{fmt.Sprintf("dry-run-%d", id)},
+		},
+		Body:    io.NopCloser(bytes.NewReader(dryRunResponse(req, id))),
+		Request: req,
+	}, nil
+}
+
+// dryRunBody returns the JSON body of the request. Credentials are left
+// out, and uploads are only described.
+func dryRunBody(req *http.Request) (json.RawMessage, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if strings.Contains(req.URL.Path, "/auth/") {
+		return json.RawMessage(`"[REDACTED]"`), nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" || !json.Valid(data) {
+		return json.Marshal(fmt.Sprintf("%d bytes of %s", len(data), mediaType))
+	}
+	return data, nil
+}
+
+// dryRunResponse answers the requests the app makes with what their
+// callers read, and any other with an empty success.
+func dryRunResponse(req *http.Request, id int64) []byte {
+	path := strings.TrimPrefix(req.URL.Path, "/open-apis/")
+	var data any
+	switch {
+	case strings.HasPrefix(path, "auth/"):
+		return []byte(`{"code":0,"msg":"ok","tenant_access_token":"dry-run","app_access_token":"dry-run","expire":7200}`)
+	case path == "im/v1/messages":
+		data = map[string]string{
+			"message_id": fmt.Sprintf("om_dry_run_%d", id),
+		}
+	case strings.HasPrefix(path, "im/v1/messages/") && strings.HasSuffix(path, "/reply"):
+		parent := strings.TrimSuffix(strings.TrimPrefix(path, "im/v1/messages/"), "/reply")
+		data = map[string]string{
+			"message_id": fmt.Sprintf("om_dry_run_%d", id),
+			"thread_id":  "omt_dry_run_" + parent,
+		}
+	case path == "im/v1/images":
+		data = map[string]string{
+			"image_key": fmt.Sprintf("img_dry_run_%d", id),
+		}
+	case strings.HasPrefix(path, "contact/v3/users/"):
+		data = map[string]any{
+			"user": map[string]string{
+				"open_id": strings.TrimPrefix(path, "contact/v3/users/"),
+				"name":    "Dry Run",
+				"email":   "dry-run@example.com",
+			},
+		}
+	default:
+		data = map[string]any{}
+	}
+	response, _ := json.Marshal(map[string]any{
+		"code": 0,
+		"msg":  "success",
+		"data": data,
+	})
+	return response
+}
+
+func (d *DryRun) write(request dryRunRequest) {
+	if d.output == nil {
+		d.logger.Info("lark dry-run request",
+			slog.String("method", request.Method),
+			slog.String("host", request.Host),
+			slog.String("path", request.Path),
+			slog.String("query", request.Query),
+			slog.String("body", string(request.Body)),
+		)
+		return
+	}
+
+	line, err := json.Marshal(request)
+	if err != nil {
+		d.logger.Warn("failed to encode dry-run request",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.output.Write(append(line, '\n')); err != nil {
+		d.logger.Warn("failed to write dry-run request",
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// Close closes the output file, if any.
+func (d *DryRun) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
@@ -0,0 +1,208 @@
+package lark
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// GroupKeyAction is the action name used by Slack templates to pass a stable
+// group identity, e.g. value: '{{ .GroupLabels.SortedPairs.Values | join "," }}'.
+// Without it the group is identified by its fingerprints, which change when
+// alerts join or leave the group.
+const GroupKeyAction = "group_key"
+
+// GroupLabelsAction is the action name used by Slack templates to pass the
+// labels shared by the alerts, e.g. value: '{{ .CommonLabels.SortedPairs }}'.
+// They narrow the alert lookups of card actions, which otherwise fetch every
+// active alert since Slack payloads carry no labels.
+const GroupLabelsAction = "group_labels"
+
+// labelPair matches the start of a name=value pair as rendered by the
+// SortedPairs of Alertmanager templates, "alertname=Foo, env=prod".
+var labelPair = regexp.MustCompile(`(?:^|, )([a-zA-Z_][a-zA-Z0-9_]*)=`)
+
+// alertGroup is the identity and membership of the alert group behind a
+// notification.
+type alertGroup struct {
+	Key    string
+	Status string
+	Alerts []*model.TrackedAlert
+	Labels map[string]string
+	// Receiver is the Alertmanager receiver of native notifications.
+	Receiver string
+}
+
+// groupKey hashes a raw group identity into a key of bounded length. The
+// prefix keeps it apart from the fingerprint keys of Slack notifications.
+func groupKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return "group:" + hex.EncodeToString(sum[:16])
+}
+
+// slackAlertGroup derives the group of a Slack attachment, which only
+// carries the fingerprints of its alerts in the callback ID. Its source
+// Alertmanager is matched on the title link.
+func (l *Lark) slackAlertGroup(alert model.WebhookAlert) alertGroup {
+	status := model.AlertStatusFiring
+	if alert.Color == "green" {
+		status = model.AlertStatusResolved
+	}
+
+	key := alertKey(alert.CallbackID)
+	var labels map[string]string
+	for _, action := range alert.Actions {
+		value := strings.TrimSpace(action.Value)
+		if value == "" {
+			continue
+		}
+		switch action.Name {
+		case GroupKeyAction:
+			key = groupKey(value)
+		case GroupLabelsAction:
+			labels = parseLabelPairs(value)
+		}
+	}
+
+	source := l.resolveAlertmanager(alertmanager.Source{ExternalURL: alert.TitleLink})
+	now := time.Now()
+	alerts := make([]*model.TrackedAlert, 0)
+	for _, fingerprint := range splitFingerprints(alert.CallbackID) {
+		alerts = append(alerts, &model.TrackedAlert{
+			Fingerprint:  fingerprint,
+			Status:       status,
+			UpdatedAt:    now,
+			Alertmanager: source,
+		})
+	}
+
+	return alertGroup{
+		Key:    key,
+		Status: status,
+		Alerts: alerts,
+		Labels: labels,
+	}
+}
+
+// parseLabelPairs parses the labels of a GroupLabelsAction, nil when there
+// are none.
+func parseLabelPairs(value string) map[string]string {
+	matches := labelPair.FindAllStringSubmatchIndex(value, -1)
+	if len(matches) == 0 || matches[0][0] != 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(matches))
+	for i, match := range matches {
+		end := len(value)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		labels[value[match[2]:match[3]]] = value[match[1]:end]
+	}
+	return labels
+}
+
+// alertmanagerAlertGroup derives the group of a native Alertmanager
+// notification. The group is identified by the configured labels when set,
+// and by the Alertmanager group key otherwise.
+func (l *Lark) alertmanagerAlertGroup(webhook model.AlertmanagerWebhook) alertGroup {
+	raw := webhook.GroupKey
+	if groupLabels := l.options.Load().GroupLabels; len(groupLabels) > 0 {
+		labels := make(map[string]string)
+		maps.Copy(labels, webhook.CommonLabels)
+		maps.Copy(labels, webhook.GroupLabels)
+
+		pairs := []string{webhook.Receiver}
+		for _, name := range slices.Sorted(slices.Values(groupLabels)) {
+			pairs = append(pairs, name+"="+labels[name])
+		}
+		raw = strings.Join(pairs, "\x00")
+	}
+
+	now := time.Now()
+	alerts := make([]*model.TrackedAlert, 0, len(webhook.Alerts))
+	for _, alert := range webhook.Alerts {
+		alerts = append(alerts, &model.TrackedAlert{
+			Fingerprint: alert.Fingerprint,
+			Status:      alert.Status,
+			Labels:      alert.Labels,
+			StartsAt:    alert.StartsAt,
+			UpdatedAt:   now,
+			Alertmanager: l.resolveAlertmanager(alertmanager.Source{
+				ExternalURL: webhook.ExternalURL,
+				Receiver:    webhook.Receiver,
+				Labels:      alert.Labels,
+			}),
+		})
+	}
+
+	return alertGroup{
+		Key:      groupKey(raw),
+		Status:   webhook.Status,
+		Alerts:   alerts,
+		Labels:   webhook.CommonLabels,
+		Receiver: webhook.Receiver,
+	}
+}
+
+// resolveAlertmanager returns the name of the Alertmanager the source came
+// from, or none without a registry.
+func (l *Lark) resolveAlertmanager(source alertmanager.Source) string {
+	if l.alertmanagers == nil {
+		return ""
+	}
+	return l.alertmanagers.Resolve(source)
+}
+
+// applyGroup updates the membership of the tracked group. Alerts that were
+// firing but are missing from a firing notification have left the group.
+func applyGroup(state *model.AlertState, group alertGroup) {
+	if state.Alerts == nil {
+		state.Alerts = make(map[string]*model.TrackedAlert)
+	}
+	if len(group.Labels) > 0 {
+		state.Labels = group.Labels
+	}
+	if group.Receiver != "" {
+		state.Receiver = group.Receiver
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, alert := range group.Alerts {
+		seen[alert.Fingerprint] = true
+		tracked, ok := state.Alerts[alert.Fingerprint]
+		if !ok {
+			state.Alerts[alert.Fingerprint] = alert
+			continue
+		}
+		tracked.Status = alert.Status
+		tracked.UpdatedAt = alert.UpdatedAt
+		if alert.Labels != nil {
+			tracked.Labels = alert.Labels
+		}
+		if !alert.StartsAt.IsZero() {
+			tracked.StartsAt = alert.StartsAt
+		}
+		if alert.Alertmanager != "" {
+			tracked.Alertmanager = alert.Alertmanager
+		}
+	}
+
+	for fingerprint, tracked := range state.Alerts {
+		if seen[fingerprint] {
+			continue
+		}
+		if group.Status == model.AlertStatusResolved || tracked.Status == model.AlertStatusFiring {
+			tracked.Status = model.AlertStatusResolved
+			tracked.UpdatedAt = now
+		}
+	}
+}
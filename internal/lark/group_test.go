@@ -0,0 +1,75 @@
+package lark
+
+import (
+	"maps"
+	"testing"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+func TestParseLabelPairs(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]string
+	}{
+		{
+			value: "alertname=HighLatency",
+			want:  map[string]string{"alertname": "HighLatency"},
+		},
+		{
+			value: "alertname=HighLatency, env=prod, path=/api/v1",
+			want:  map[string]string{"alertname": "HighLatency", "env": "prod", "path": "/api/v1"},
+		},
+		{
+			value: "alertname=Errors, message=a, b and c, team=payments",
+			want:  map[string]string{"alertname": "Errors", "message": "a, b and c", "team": "payments"},
+		},
+		{
+			value: "alertname=Empty, env=",
+			want:  map[string]string{"alertname": "Empty", "env": ""},
+		},
+		{
+			value: "no labels here",
+		},
+		{
+			value: "",
+		},
+	}
+	for _, tt := range tests {
+		if got := parseLabelPairs(tt.value); !maps.Equal(got, tt.want) {
+			t.Errorf("parseLabelPairs(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSlackAlertGroupFilter(t *testing.T) {
+	l := &Lark{}
+	alert := model.WebhookAlert{
+		CallbackID: "fp1,fp2",
+		Color:      "red",
+		Actions: []model.WebhookAlertAction{
+			{Name: GroupKeyAction, Value: "lark/HighLatency"},
+			{Name: GroupLabelsAction, Value: "alertname=HighLatency, env=prod"},
+		},
+	}
+
+	state := &model.AlertState{}
+	applyGroup(state, l.slackAlertGroup(alert))
+
+	filter := alertFilter(state)
+	want := map[string]string{"alertname": "HighLatency", "env": "prod"}
+	if !maps.Equal(filter.Labels, want) {
+		t.Errorf("filter labels = %v, want %v", filter.Labels, want)
+	}
+	if filter.Active == nil || !*filter.Active {
+		t.Errorf("filter is not limited to active alerts")
+	}
+
+	// Without the action the group has no labels to filter on.
+	alert.Actions = alert.Actions[:1]
+	state = &model.AlertState{}
+	applyGroup(state, l.slackAlertGroup(alert))
+	if filter := alertFilter(state); len(filter.Labels) != 0 {
+		t.Errorf("filter labels = %v, want none", filter.Labels)
+	}
+}
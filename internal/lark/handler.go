@@ -3,102 +3,241 @@ package lark
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
-	"log"
 	"log/slog"
 	"net/http"
-	"os"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
 	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
 	larkim "github.com/larksuite/oapi-sdk-go/v3/service/im/v1"
-	"github.com/prometheus/alertmanager/api/v2/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
 )
 
-func (l *Lark) NotifyAlerts(webhook model.Webhook) error {
+func (l *Lark) NotifyAlerts(ctx context.Context, webhook model.Webhook) error {
+	if err := l.checkChat(ctx, webhook.Channel); err != nil {
+		return err
+	}
 	for _, alert := range webhook.Alerts {
-		if err := l.notifyAlert(alert, webhook.Channel); err != nil {
+		group := l.slackAlertGroup(alert)
+		alert.GroupKey = group.Key
+		if err := l.notifyAlert(ctx, alert, group, webhook.Channel); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (l *Lark) notifyAlert(alert model.WebhookAlert, channel string) error {
-	content, err := l.cardBuilder.BuildJSON(&alert)
+func (l *Lark) notifyAlert(ctx context.Context, alert model.WebhookAlert, group alertGroup, channel string) error {
+	tenant := l.tenants.tenant(TenantFromContext(ctx)).Name
+	ctx, span := tracing.Start(ctx, "lark.notify", trace.WithAttributes(
+		attribute.String("alert_id", group.Key),
+		attribute.String("chat_id", channel),
+		attribute.String("tenant", tenant),
+		attribute.String("alert.status", group.Status),
+	))
+	logger := l.logger.With(
+		slog.String("alert_id", group.Key),
+		slog.String("chat_id", channel),
+		slog.String("tenant", tenant),
+	)
+	media := l.buildCardMedia(ctx, alert)
+	contents, err := l.buildMessages(ctx, alert, media)
 	if err != nil {
-		slog.Error(err.Error())
+		logger.ErrorContext(ctx, "failed to build alert card",
+			slog.String("error", err.Error()),
+		)
+		tracing.End(span, err)
 		return err
 	}
 
-	if err := l.sendAlert(alert, channel, content); err != nil {
-		slog.Error(err.Error())
+	postedID, err := l.sendAlert(ctx, group, channel, contents)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to send alert",
+			slog.String("error", err.Error()),
+		)
+		tracing.End(span, err)
 		return err
 	}
+	if postedID != "" {
+		l.attachGraph(ctx, alert, media, len(contents), postedID)
+	}
 
+	tracing.End(span, nil)
 	return nil
 }
 
-func (l *Lark) sendAlert(alert model.WebhookAlert, channel, content string) error {
+// buildMessages renders the card contents of the alert, with its images.
+func (l *Lark) buildMessages(ctx context.Context, alert model.WebhookAlert, media *cardMedia) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "lark.build_card")
+	contents, err := l.cardBuilder.Load().BuildMessages(&alert, media)
+	span.SetAttributes(attribute.Int("lark.card_messages", len(contents)))
+	tracing.End(span, err)
+	return contents, err
+}
+
+// sendAlert sends the card contents of an alert group, and returns the ID of
+// the card it posted when the group starts firing in the chat. The first content is
+// the card itself, the others are continuations of an oversized card and are
+// sent in the thread of the tracked message, so only the first message ID
+// is saved and later notifications of the group thread under it.
+//
+// The same alert group can be posted to several chats. Each chat's copy is
+// tracked separately, and a resolved notification resolves every copy that
+// is still firing, in its own chat.
+func (l *Lark) sendAlert(ctx context.Context, group alertGroup, channel string, contents []string) (string, error) {
+	key := group.Key
 	logger := l.logger.With(
-		slog.String("alert_id", alert.CallbackID),
+		slog.String("alert_id", key),
 		slog.String("chat_id", channel),
 	)
 
-	if alert.Color == "green" {
-		messageID, err := l.repository.GetMessageID(alert.CallbackID)
-		logger.With(
-			slog.String("message_id", messageID),
-		)
+	postedID := ""
+	if group.Status == model.AlertStatusResolved {
+		state, err := l.repository.GetAlertState(ctx, key)
 		if err != nil {
-			logger.Warn("failed to get message id from repository [fallback to create message]",
+			logger.WarnContext(ctx, "failed to get alert state from repository [fallback to create message]",
 				slog.String("error", err.Error()),
 			)
-			err, _ := l.sendAlertMessage(alert.CallbackID, channel, content)
-			return err
+			err, messageID := l.sendAlertMessage(ctx, key, channel, contents[0])
+			if err != nil {
+				return "", err
+			}
+			_, err = l.sendContinuationMessages(ctx, *messageID, key, channel, contents[1:])
+			return "", err
 		}
 
-		if err := l.sendResolvedMessage(messageID, content, alert.CallbackID, channel); err != nil {
-			return err
+		threadIDs := make(map[string]string)
+		message := chatMessage(state, channel)
+		switch {
+		case message == nil:
+			logger.WarnContext(ctx, "alert was not posted to this chat [fallback to create message]")
+			err, messageID := l.sendAlertMessage(ctx, key, channel, contents[0])
+			if err != nil {
+				return "", err
+			}
+			if _, err := l.sendContinuationMessages(ctx, *messageID, key, channel, contents[1:]); err != nil {
+				return "", err
+			}
+		case message.Status == model.AlertStatusResolved:
+			logger.DebugContext(ctx, "alert copy in this chat is already resolved, skipping")
+		default:
+			threadID, err := l.sendContinuationMessages(messageContext(ctx, message), message.MessageID, key, channel, contents)
+			if err != nil {
+				return "", err
+			}
+			threadIDs[channel] = threadID
 		}
-		logger.Debug("deleting message id from repository")
-		if err := l.repository.DeleteMessageID(messageID); err != nil {
-			logger.Warn("failed to delete reply message request",
+
+		for chatID, other := range state.Messages {
+			if chatID == channel || chatID == "" || other.Status == model.AlertStatusResolved {
+				continue
+			}
+			threadID, err := l.sendContinuationMessages(messageContext(ctx, other), other.MessageID, key, other.ChatID, contents)
+			if err != nil {
+				logger.WarnContext(ctx, "failed to resolve alert copy in other chat",
+					slog.String("other_chat_id", other.ChatID),
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+			threadIDs[chatID] = threadID
+		}
+
+		logger.DebugContext(ctx, "saving resolved alert state to repository")
+		if err := l.trackResolved(ctx, key, group, threadIDs); err != nil {
+			logger.WarnContext(ctx, "failed to save alert state to repository",
 				slog.String("error", err.Error()),
 			)
 		}
 	} else {
-		err, messageID := l.sendAlertMessage(alert.CallbackID, channel, content)
+		messageID, threadID, posted, err := l.sendFiringMessages(ctx, key, channel, contents)
 		if err != nil {
-			return err
+			return "", err
+		}
+		if posted {
+			postedID = messageID
 		}
 		logger = logger.With(
-			slog.String("message_id", *messageID),
+			slog.String("message_id", messageID),
 		)
-		logger.Debug("saving message id to repository")
-		if err := l.repository.SetMessageID(alert.CallbackID, *messageID); err != nil {
-			logger.Warn("failed to save message id to repository",
+		logger.DebugContext(ctx, "saving firing alert state to repository")
+		if err := l.trackFiring(ctx, key, group, channel, messageID, threadID); err != nil {
+			logger.WarnContext(ctx, "failed to save alert state to repository",
 				slog.String("error", err.Error()),
 			)
 		}
 	}
 
-	return nil
+	return postedID, nil
+}
+
+// sendFiringMessages posts a firing notification and returns the message and
+// thread it is tracked under, and whether the message is a new card. A group
+// that is still firing in the chat is updated in the thread of its card
+// instead of posting a new one.
+func (l *Lark) sendFiringMessages(ctx context.Context, key, channel string, contents []string) (string, string, bool, error) {
+	logger := l.logger.With(
+		slog.String("alert_id", key),
+		slog.String("chat_id", channel),
+	)
+
+	state, err := l.repository.GetAlertState(ctx, key)
+	if err != nil && !errors.Is(err, pkg.ErrNotFound) {
+		logger.WarnContext(ctx, "failed to get alert state from repository [fallback to create message]",
+			slog.String("error", err.Error()),
+		)
+	}
+	if err == nil && state.Status == model.AlertStatusFiring {
+		if message, ok := state.Messages[channel]; ok && message.Status == model.AlertStatusFiring {
+			threadID, err := l.sendContinuationMessages(messageContext(ctx, message), message.MessageID, key, channel, contents)
+			if err == nil {
+				if threadID == "" {
+					threadID = message.ThreadID
+				}
+				return message.MessageID, threadID, false, nil
+			}
+			logger.WarnContext(ctx, "failed to reply in alert thread [fallback to create message]",
+				slog.String("message_id", message.MessageID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	err, messageID := l.sendAlertMessage(ctx, key, channel, contents[0])
+	if err != nil {
+		return "", "", false, err
+	}
+	threadID, err := l.sendContinuationMessages(ctx, *messageID, key, channel, contents[1:])
+	if err != nil {
+		logger.WarnContext(ctx, "failed to send continuation messages",
+			slog.String("message_id", *messageID),
+			slog.String("error", err.Error()),
+		)
+	}
+	return *messageID, threadID, true, nil
 }
 
-func (l *Lark) sendAlertMessage(alertID, channel, content string) (error, *string) {
+func (l *Lark) sendAlertMessage(ctx context.Context, alertID, channel, content string) (error, *string) {
 	logger := l.logger.With(
 		slog.String("alert_id", alertID),
 		slog.String("chat_id", channel),
 	)
-	logger.Info("sending create alert message request")
+	logger.InfoContext(ctx, "sending create alert message request")
 
-	logger.Debug("creating new create message request")
+	logger.DebugContext(ctx, "creating new create message request")
 	req := larkim.NewCreateMessageReqBuilder().
 		ReceiveIdType("chat_id").
 		Body(larkim.NewCreateMessageReqBodyBuilder().
@@ -108,47 +247,54 @@ func (l *Lark) sendAlertMessage(alertID, channel, content string) (error, *strin
 			Build()).
 		Build()
 
-	logger.Debug("sending create message request")
-	resp, err := l.client.Im.Message.Create(context.Background(), req)
+	logger.DebugContext(ctx, "sending create message request")
+	ctx, request := startLarkRequest(ctx, larkEndpointMessageCreate)
+	resp, err := l.client(ctx).Im.Message.Create(ctx, req)
 	if err != nil {
-		logger.Error("failed to send create message request",
+		request.failed(err)
+		logger.ErrorContext(ctx, "failed to send create message request",
 			slog.String("error", err.Error()),
 		)
 		// TODO: create retry fallback mechanism
 		return err, nil
 	}
+	request.done(resp.Code, resp.Msg, resp.RequestId())
 	if !resp.Success() {
-		logger.Error("failed to send create message request",
-			slog.String("logId", resp.RequestId()),
+		logger.ErrorContext(ctx, "failed to send create message request",
+			slog.String("lark_log_id", resp.RequestId()),
 			slog.String("error_response", larkcore.Prettify(resp.CodeError)),
 		)
-		return err, nil
+		return fmt.Errorf("failed to send create message request: %s", larkcore.Prettify(resp.CodeError)), nil
 	}
 
 	return nil, resp.Data.MessageId
 }
 
-func (l *Lark) sendResolvedMessage(messageID, content, alertID, channel string) error {
+// sendContinuationMessages replies with every content in the thread of the
+// message and returns the thread ID.
+func (l *Lark) sendContinuationMessages(ctx context.Context, messageID, alertID, channel string, contents []string) (string, error) {
+	threadID := ""
+	for _, content := range contents {
+		replyThreadID, err := l.replyInThread(ctx, messageID, content, alertID, channel)
+		if err != nil {
+			return threadID, err
+		}
+		threadID = replyThreadID
+	}
+	return threadID, nil
+}
+
+// replyInThread replies with the content in the thread of the message and
+// returns the thread ID.
+func (l *Lark) replyInThread(ctx context.Context, messageID, content, alertID, channel string) (string, error) {
 	logger := l.logger.With(
 		slog.String("message_id", messageID),
 		slog.String("alert_id", alertID),
 		slog.String("chat_id", channel),
 	)
-	logger.Info("sending reply resolved message request")
-
-	messageID, err := l.repository.GetMessageID(alertID)
-	if err != nil {
-		logger.Warn("failed to get message id from repository [fallback to create message]",
-			slog.String("error", err.Error()),
-		)
-		err, _ := l.sendAlertMessage(alertID, channel, content)
-		return err
-	}
-	logger = l.logger.With(
-		slog.String("message_id", messageID),
-	)
+	logger.InfoContext(ctx, "replying in message thread")
 
-	logger.Debug("creating new reply message request")
+	logger.DebugContext(ctx, "creating new reply message request")
 	req := larkim.NewReplyMessageReqBuilder().
 		MessageId(messageID).
 		Body(larkim.NewReplyMessageReqBodyBuilder().
@@ -158,128 +304,313 @@ func (l *Lark) sendResolvedMessage(messageID, content, alertID, channel string)
 			Build()).
 		Build()
 
-	logger.Debug("sending reply message request")
-	resp, err := l.client.Im.Message.Reply(context.Background(), req)
+	logger.DebugContext(ctx, "sending reply message request")
+	ctx, request := startLarkRequest(ctx, larkEndpointMessageReply)
+	resp, err := l.client(ctx).Im.Message.Reply(ctx, req)
 	if err != nil {
-		logger.Error("failed to send reply message request",
+		request.failed(err)
+		logger.ErrorContext(ctx, "failed to send reply message request",
 			slog.String("error", err.Error()),
 		)
 		// TODO: create retry fallback mechanism
-		return err
+		return "", err
 	}
+	request.done(resp.Code, resp.Msg, resp.RequestId())
 	if !resp.Success() {
-		logger.Error("failed to send reply message request",
-			slog.String("logId", resp.RequestId()),
+		logger.ErrorContext(ctx, "failed to send reply message request",
+			slog.String("lark_log_id", resp.RequestId()),
 			slog.String("error_response", larkcore.Prettify(resp.CodeError)),
 		)
+		return "", fmt.Errorf("failed to send reply message request: %s", larkcore.Prettify(resp.CodeError))
+	}
+	if resp.Data.ThreadId == nil {
+		return "", nil
+	}
+
+	return *resp.Data.ThreadId, nil
+}
+
+// patchMessage replaces the card of a message posted by the app.
+func (l *Lark) patchMessage(ctx context.Context, messageID, content, alertID string) error {
+	logger := l.logger.With(
+		slog.String("message_id", messageID),
+		slog.String("alert_id", alertID),
+	)
+	logger.DebugContext(ctx, "sending patch message request")
+	req := larkim.NewPatchMessageReqBuilder().
+		MessageId(messageID).
+		Body(larkim.NewPatchMessageReqBodyBuilder().
+			Content(content).
+			Build()).
+		Build()
+
+	ctx, request := startLarkRequest(ctx, larkEndpointMessagePatch)
+	resp, err := l.client(ctx).Im.Message.Patch(ctx, req)
+	if err != nil {
+		request.failed(err)
 		return err
 	}
+	request.done(resp.Code, resp.Msg, resp.RequestId())
+	if !resp.Success() {
+		return fmt.Errorf("failed to send patch message request [logId: %s]: %s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
+	}
 
 	return nil
 }
 
 // silence
-func NewHandler(alertmanager alertmanager.Alertmanager) *Handler {
-	return &Handler{
-		alertmanager: alertmanager,
+func NewHandler(alertmanagers *alertmanager.Registry, mode string, repository pkg.Repository) *Handler {
+	h := &Handler{
+		alertmanagers: alertmanagers,
+		repository:    repository,
+	}
+	h.SetMode(mode)
+	return h
+}
+
+// SetMode replaces the silence mode, e.g. on a configuration reload.
+func (h *Handler) SetMode(mode string) {
+	if mode == "" {
+		mode = SilenceModeGroup
 	}
+	h.mode.Store(mode)
 }
 
 type EventSilence interface {
-	HandleCreateSilence(alertID string, email string, duration string) error
+	HandleCreateSilence(ctx context.Context, key string, alertID string, email string, duration string) (*SilenceResult, error)
+	HandleExtendSilence(ctx context.Context, key string, silenceID string, duration string) (*model.AlertSilence, error)
 }
 
 type Handler struct {
-	alertmanager alertmanager.Alertmanager
+	alertmanagers *alertmanager.Registry
+	mode          atomic.Value
+	repository    pkg.Repository
 }
 
-func (h *Handler) HandleCreateSilence(alertID string, email string, duration string) error {
-	alerts, err := h.alertmanager.GetAlertsByFingerprints([]string{alertID})
+// HandleCreateSilence silences every alert of the card. alertID is the
+// comma-separated list of fingerprints sent back by the card action, and
+// key the tracked group they are looked up with. The alerts are silenced
+// on the Alertmanager each of them came from. Alerts that are already
+// silenced get their silence extended, or reported when it lasts longer.
+func (h *Handler) HandleCreateSilence(ctx context.Context, key string, alertID string, email string, duration string) (*SilenceResult, error) {
+	fingerprints := splitFingerprints(alertID)
+	if len(fingerprints) == 0 {
+		return nil, fmt.Errorf("no fingerprints in alertID: %q", alertID)
+	}
+
+	logger := logging.FromContext(ctx)
+	unlock, err := h.lockCard(ctx, key)
 	if err != nil {
-		slog.Info("alertID is not found ", "alertID: ", alertID)
-		slog.Error("Failed to get alerts by fingerprints", "ERROR: ", err)
-		return err
+		return nil, err
 	}
-	//check alert is fetched or not
-	if alerts == nil || len(*alerts) == 0 {
-		slog.Info("No alerts found for the given fingerprint")
-		return fmt.Errorf("no alerts found for alertID: %s", alertID)
+	defer unlock()
+
+	//create silence
+	startsAt := time.Now()
+	endsAt, err := silenceEndsAt(startsAt, duration)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, alert := range *alerts {
-		if name, ok := alert.Labels["alertname"]; ok {
-			slog.Info("Alert Name ", "name: ", name)
-		} else {
-			slog.Error("Alert Name not found in labels")
+	comment := "create silence"
+
+	state := h.alertState(ctx, key)
+	result := &SilenceResult{}
+	for name, fingerprints := range h.routeFingerprints(state, fingerprints) {
+		am := h.alertmanagers.Get(name)
+		// Another replica may have silenced the alerts since they were
+		// cached, so they are fetched again under the lease.
+		filter := alertFilter(state)
+		filter.Fresh = true
+		alerts, err := am.FindAlertsByFingerprints(ctx, fingerprints, filter)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to get alerts by fingerprints",
+				slog.String("alertmanager", name),
+				slog.String("error", err.Error()),
+			)
+			return result.partial(err)
 		}
-	}
-	// create matchers
-	matchers := []*models.Matcher{}
-	for _, alert := range *alerts {
-		for key, value := range alert.Labels {
-			matchers = append(matchers, &models.Matcher{
-				Name:    pointerString(key),
-				Value:   pointerString(value),
-				IsRegex: pointerBool(false),
+		result.add(name, fingerprints, alerts)
+
+		alerts, existing := existingSilences(ctx, am, alerts)
+		for _, silence := range existing {
+			if err := result.extend(ctx, am, name, silence, endsAt); err != nil {
+				logger.ErrorContext(ctx, "failed to extend silence",
+					slog.String("alertmanager", name),
+					slog.String("silence_id", *silence.ID),
+					slog.String("error", err.Error()),
+				)
+				return result.partial(err)
+			}
+		}
+
+		for _, matchers := range silenceMatchers(h.mode.Load().(string), alerts) {
+			silenceID, err := am.Silence(ctx, comment, email, matchers, startsAt, endsAt)
+			if err != nil {
+				logger.ErrorContext(ctx, "failed to post silence",
+					slog.String("alertmanager", name),
+					slog.String("error", err.Error()),
+				)
+				return result.partial(err)
+			}
+			logger.InfoContext(ctx, "silence created",
+				slog.String("alertmanager", name),
+				slog.String("silence_id", silenceID),
+				slog.Time("ends_at", endsAt),
+			)
+			o11y.ObserveSilence(name, "created", endsAt.Sub(startsAt))
+			result.Silences = append(result.Silences, &model.AlertSilence{
+				ID:           silenceID,
+				Alertmanager: name,
+				CreatedBy:    email,
+				StartsAt:     startsAt,
+				EndsAt:       endsAt,
 			})
 		}
 	}
 
-	//create silence
-	startsAt := time.Now()
-	//check and set duration
+	//check alert is fetched or not
+	if len(result.Alerts) == 0 {
+		logger.InfoContext(ctx, "no alerts found for the given fingerprints")
+		return nil, fmt.Errorf("no alerts found for alertID: %s", alertID)
+	}
+	return result, nil
+}
+
+// HandleExtendSilence extends a silence tracked for the alert group by
+// duration, from its current end or from now when that is sooner.
+func (h *Handler) HandleExtendSilence(ctx context.Context, key string, silenceID string, duration string) (*model.AlertSilence, error) {
+	unlock, err := h.lockCard(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	state := h.alertState(ctx, key)
+	if state == nil {
+		return nil, fmt.Errorf("alert %s is not tracked", key)
+	}
+	index := slices.IndexFunc(state.Silences, func(silence *model.AlertSilence) bool {
+		return silence.ID == silenceID
+	})
+	if index < 0 {
+		return nil, fmt.Errorf("silence %s is not tracked for alert %s", silenceID, key)
+	}
+	tracked := state.Silences[index]
+
+	am := h.alertmanagers.Get(tracked.Alertmanager)
+	existing, err := am.GetSilence(ctx, silenceID)
+	if err != nil {
+		return nil, err
+	}
+	if !isActiveSilence(existing) {
+		return nil, fmt.Errorf("silence %s is no longer active", silenceID)
+	}
+
+	from := time.Time(*existing.EndsAt)
+	if now := time.Now(); from.Before(now) {
+		from = now
+	}
+	endsAt, err := silenceEndsAt(from, duration)
+	if err != nil {
+		return nil, err
+	}
+	extendedID, err := am.ExtendSilence(ctx, existing, endsAt)
+	if err != nil {
+		return nil, err
+	}
+	o11y.ObserveSilence(tracked.Alertmanager, "extended", endsAt.Sub(from))
+
+	extended := &model.AlertSilence{
+		ID:           extendedID,
+		Alertmanager: tracked.Alertmanager,
+		CreatedBy:    *existing.CreatedBy,
+		StartsAt:     time.Time(*existing.StartsAt),
+		EndsAt:       endsAt,
+	}
+	if extendedID != silenceID {
+		extended.Replaces = silenceID
+	}
+	return extended, nil
+}
+
+func silenceEndsAt(startsAt time.Time, duration string) (time.Time, error) {
 	var endsAt time.Time
 	switch duration {
 	case "", "default":
 		endsAt = startsAt.Add(6 * time.Hour)
-		slog.Info("Silence duration is not set, using default 6 hours")
 	case "30m":
 		endsAt = startsAt.Add(30 * time.Minute)
-		slog.Info("Silence duration set to 30 minutes")
 	case "1h":
 		endsAt = startsAt.Add(1 * time.Hour)
-		slog.Info("Silence duration set to 1 hour")
 	case "3h":
 		endsAt = startsAt.Add(3 * time.Hour)
-		slog.Info("Silence duration set to 3 hours")
 	case "6h":
 		endsAt = startsAt.Add(6 * time.Hour)
-		slog.Info("Silence duration set to 6 hours")
 	case "12h":
 		endsAt = startsAt.Add(12 * time.Hour)
-		slog.Info("Silence duration set to 12 hours")
 	case "1d":
 		endsAt = startsAt.Add(24 * time.Hour)
-		slog.Info("Silence duration set to 1 day")
 	case "3d":
 		endsAt = startsAt.Add((24 * 3) * time.Hour)
-		slog.Info("Silence duration set to 3 days")
 	case "1w":
 		endsAt = startsAt.Add((24 * 7) * time.Hour)
-		slog.Info("Silence duration set to 1 week")
 	case "3w":
 		endsAt = startsAt.Add((24 * 7 * 3) * time.Hour)
-		slog.Info("Silence duration set to 3 weeks")
 	case "1M":
 		endsAt = startsAt.Add((24 * 30) * time.Hour)
-		slog.Info("Silence duration set to 1 month")
 	case "1Y":
 		endsAt = startsAt.Add((24 * 365) * time.Hour)
-		slog.Info("Silence duration set to 1 year")
 	default:
-		slog.Error("Invalid silence duration specified ", "duration: ", duration)
-		return fmt.Errorf("invalid silence duration: %s", duration)
+		return time.Time{}, fmt.Errorf("invalid silence duration: %s", duration)
 	}
+	return endsAt, nil
+}
 
-	comment := "create silence"
+// alertState returns the tracked group, or nil when it is not tracked.
+func (h *Handler) alertState(ctx context.Context, key string) *model.AlertState {
+	if h.repository == nil {
+		return nil
+	}
 
-	silenceID, err := h.alertmanager.Silence(comment, email, matchers, startsAt, endsAt)
-	slog.Info("Creating Silence ID: ", "silenceID: ", silenceID, ", startsAt: ", startsAt, ", endsAt: ", endsAt)
+	state, err := h.repository.GetAlertState(ctx, key)
 	if err != nil {
-		slog.Error("Failed to post silence: ", "ERROR: ", err)
+		if !errors.Is(err, pkg.ErrNotFound) {
+			logging.FromContext(ctx).WarnContext(ctx, "failed to get alert state for alert lookup",
+				slog.String("error", err.Error()),
+			)
+		}
+		return nil
 	}
-	slog.Info("Successfully created silence ID: %s\n", "silenceID: ", silenceID)
-	return nil
+	return state
+}
+
+// routeFingerprints groups the fingerprints by the Alertmanager they came
+// from. Untracked alerts go to the default Alertmanager.
+func (h *Handler) routeFingerprints(state *model.AlertState, fingerprints []string) map[string][]string {
+	routes := make(map[string][]string)
+	for _, fingerprint := range fingerprints {
+		name := h.alertmanagers.Default()
+		if state != nil {
+			if alert, ok := state.Alerts[fingerprint]; ok && alert.Alertmanager != "" {
+				name = alert.Alertmanager
+			}
+		}
+		routes[name] = append(routes[name], fingerprint)
+	}
+	return routes
+}
+
+// alertFilter narrows the lookup to the active alerts with the labels and
+// receiver of the tracked group. Without a tracked group every active
+// alert is looked up.
+func alertFilter(state *model.AlertState) alertmanager.AlertFilter {
+	filter := alertmanager.AlertFilter{}
+	if state != nil {
+		filter = alertmanager.GroupFilter(state)
+	}
+	filter.Active = pointerBool(true)
+	return filter
 }
 
 func pointerString(s string) *string {
@@ -289,7 +620,7 @@ func pointerBool(s bool) *bool {
 	return &s
 }
 
-func (l *Lark) GetUserInfo(openID string) (*larkcontact.User, error) {
+func (l *Lark) GetUserInfo(ctx context.Context, openID string) (*larkcontact.User, error) {
 	//create new request to get user info
 	req := larkcontact.NewGetUserReqBuilder().
 		UserId(openID).
@@ -297,11 +628,23 @@ func (l *Lark) GetUserInfo(openID string) (*larkcontact.User, error) {
 		Build()
 
 	//send request
-	resp, err := l.client.Contact.V3.User.Get(context.Background(), req)
+	ctx, request := startLarkRequest(ctx, larkEndpointUserGet)
+	resp, err := l.client(ctx).Contact.V3.User.Get(ctx, req)
 	if err != nil {
-		slog.Error("API call failed to get user info", "ERROR: ", err)
+		request.failed(err)
+		l.logger.ErrorContext(ctx, "failed to get user info",
+			slog.String("error", err.Error()),
+		)
 		return nil, err
 	}
+	request.done(resp.Code, resp.Msg, resp.RequestId())
+	if !resp.Success() {
+		l.logger.ErrorContext(ctx, "failed to get user info",
+			slog.String("lark_log_id", resp.RequestId()),
+			slog.String("error_response", larkcore.Prettify(resp.CodeError)),
+		)
+		return nil, fmt.Errorf("failed to get user info: %s", larkcore.Prettify(resp.CodeError))
+	}
 	//return user info
 	return resp.Data.User, nil
 }
@@ -311,21 +654,19 @@ func (l *Lark) ResponseError(w http.ResponseWriter, errors map[string]string) er
 
 	errorJSON, err := json.Marshal(errors)
 	if err != nil {
-		slog.Error("Failed to marshall view submission resposne: %v", "ERROR: ", err)
+		l.logger.Error("failed to marshal view submission response",
+			slog.String("error", err.Error()),
+		)
 		return err
 	}
 	body := fmt.Sprintf(`{"response_action": "errors", "errors": %s}`, errorJSON)
 	w.Write([]byte(body))
-	log.Println(body)
 	return nil
 }
 
-func SendChallengeResponse(w http.ResponseWriter, r http.Request, veriftoken string, challenge string) {
-	if veriftoken != os.Getenv("VERIFICATION_TOKEN") {
-		slog.Error("Invalid verification token", "received", veriftoken)
-		http.Error(w, "Unauthorized: invalid verification token", http.StatusUnauthorized)
-		return
-	}
+// SendChallengeResponse answers the URL verification of a callback whose
+// verification token was checked.
+func SendChallengeResponse(w http.ResponseWriter, challenge string) {
 	// Respond with the challenge value
 	response := map[string]string{
 		"challenge": challenge,
@@ -336,28 +677,41 @@ func SendChallengeResponse(w http.ResponseWriter, r http.Request, veriftoken str
 }
 
 // response after create silence
-func (l *Lark) SendResponseCreatedSilence(message_id string, chat_id string, text string) error {
+func (l *Lark) SendResponseCreatedSilence(ctx context.Context, message_id string, chat_id string, text string) error {
+	// The text holds quotes and newlines of the silence summary.
+	content, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("failed to encode reply message: %w", err)
+	}
+
 	// Create a new reply message request
 	req := larkim.NewReplyMessageReqBuilder().
 		MessageId(message_id).
 		Body(larkim.NewReplyMessageReqBodyBuilder().
 			MsgType("text").
-			Content(fmt.Sprintf(`{"text": "%s"}`, text)).
+			Content(string(content)).
 			Build()).
 		Build()
 
 	// Send the reply message
-	resp, err := l.client.Im.Message.Reply(context.Background(), req)
+	ctx, request := startLarkRequest(ctx, larkEndpointMessageReply)
+	resp, err := l.client(ctx).Im.Message.Reply(ctx, req)
 	if err != nil {
-		slog.Error("Failed to send reply message", "error", err)
+		request.failed(err)
+		l.logger.ErrorContext(ctx, "failed to send reply message",
+			slog.String("message_id", message_id),
+			slog.String("error", err.Error()),
+		)
 		return err
 	}
+	request.done(resp.Code, resp.Msg, resp.RequestId())
 
 	// Check if the response was successful
 	if !resp.Success() {
-		slog.Error("Failed to send reply message",
-			"logId", resp.RequestId(),
-			"error_response", larkcore.Prettify(resp.CodeError),
+		l.logger.ErrorContext(ctx, "failed to send reply message",
+			slog.String("message_id", message_id),
+			slog.String("lark_log_id", resp.RequestId()),
+			slog.String("error_response", larkcore.Prettify(resp.CodeError)),
 		)
 		return fmt.Errorf("failed to send reply message: %s", larkcore.Prettify(resp.CodeError))
 	}
@@ -375,6 +729,8 @@ func WriteToast(w http.ResponseWriter, toastType, content string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		slog.Error("Failed to encode toast response ", "ERROR: ", err)
+		slog.Error("failed to encode toast response",
+			slog.String("error", err.Error()),
+		)
 	}
 }
@@ -0,0 +1,117 @@
+package lark
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// newTestLark returns a notifier whose Lark requests are written to the
+// returned buffer, one JSON line each, and answered as a dry run.
+func newTestLark(t *testing.T) (*Lark, *bytes.Buffer) {
+	t.Helper()
+	return newTestLarkWith(t, Options{}, nil, nil)
+}
+
+// newTestLarkWith is newTestLark with the given options and dependencies.
+func newTestLarkWith(t *testing.T, options Options, repository pkg.Repository, grapher pkg.Grapher) (*Lark, *bytes.Buffer) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	requests := &bytes.Buffer{}
+	dryRun := &DryRun{output: requests, logger: logger}
+	tenants, err := NewTenants([]Tenant{{Name: DefaultTenant}}, dryRun)
+	if err != nil {
+		t.Fatalf("NewTenants() error = %v", err)
+	}
+	return New(tenants, options, repository, grapher, nil, logger), requests
+}
+
+// sentRequests returns the dry-run requests sent to the path.
+func sentRequests(t *testing.T, requests *bytes.Buffer, path string) []dryRunRequest {
+	t.Helper()
+	var sent []dryRunRequest
+	scanner := bufio.NewScanner(bytes.NewReader(requests.Bytes()))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var request dryRunRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			t.Fatalf("invalid dry-run request %s: %v", scanner.Text(), err)
+		}
+		if request.Path == path {
+			sent = append(sent, request)
+		}
+	}
+	return sent
+}
+
+func TestSendResponseCreatedSilence(t *testing.T) {
+	result := &SilenceResult{
+		Alerts: []string{
+			describeAlert(map[string]string{"alertname": "HighLatency", "path": `/api/"v1"`}),
+			describeAlert(map[string]string{"alertname": "HighLatency", "path": `C:\tmp`}),
+		},
+		Existing: []string{"Already silenced by alice until 2024-01-02 03:04"},
+		Missing:  []string{"abc123"},
+	}
+	text := "Silence created by alice\n" + result.Summary()
+
+	l, requests := newTestLark(t)
+	if err := l.SendResponseCreatedSilence(context.Background(), "om_parent", "oc_chat", text); err != nil {
+		t.Fatalf("SendResponseCreatedSilence() error = %v", err)
+	}
+
+	sent := sentRequests(t, requests, "/open-apis/im/v1/messages/om_parent/reply")
+	if len(sent) != 1 {
+		t.Fatalf("sent %d replies, want 1", len(sent))
+	}
+	var body struct {
+		MsgType string `json:"msg_type"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(sent[0].Body, &body); err != nil {
+		t.Fatalf("invalid reply body %s: %v", sent[0].Body, err)
+	}
+	if body.MsgType != "text" {
+		t.Errorf("msg_type = %q, want text", body.MsgType)
+	}
+	var content map[string]string
+	if err := json.Unmarshal([]byte(body.Content), &content); err != nil {
+		t.Fatalf("reply content %s is not JSON: %v", body.Content, err)
+	}
+	if content["text"] != text {
+		t.Errorf("reply text = %q, want %q", content["text"], text)
+	}
+	if !strings.Contains(content["text"], `path="/api/\"v1\""`) {
+		t.Errorf("reply text %q lost the quoted label value", content["text"])
+	}
+}
+
+func TestSilenceResultEndsAt(t *testing.T) {
+	startsAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	result := &SilenceResult{}
+	if endsAt := result.EndsAt(); !endsAt.IsZero() {
+		t.Errorf("EndsAt() = %v without silences, want zero", endsAt)
+	}
+	for _, duration := range []string{"1h", "1d", "30m"} {
+		endsAt, err := silenceEndsAt(startsAt, duration)
+		if err != nil {
+			t.Fatalf("silenceEndsAt(%q) error = %v", duration, err)
+		}
+		result.Silences = append(result.Silences, &model.AlertSilence{StartsAt: startsAt, EndsAt: endsAt})
+	}
+
+	// The confirmation shows the end of the longest silence in the card
+	// timezone.
+	if got, want := FormatSilenceTime(result.EndsAt()), "2024-01-03 10:04:05 WIB"; got != want {
+		t.Errorf("FormatSilenceTime(EndsAt()) = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,318 @@
+package lark
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
+	larkim "github.com/larksuite/oapi-sdk-go/v3/service/im/v1"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+const (
+	// maxImageBytes is the Lark image upload limit.
+	maxImageBytes = 10 * 1024 * 1024
+
+	// DefaultImageTimeout bounds downloading and uploading the attachment
+	// images of a card.
+	DefaultImageTimeout = 5 * time.Second
+
+	// maxImageRedirects is how many redirects an image download follows.
+	maxImageRedirects = 3
+)
+
+// ImageOptions restrict the attachment images downloaded for the cards.
+// Their URLs come from the unauthenticated /notify body.
+type ImageOptions struct {
+	// AllowedHosts are the only hosts images are downloaded from, e.g.
+	// grafana.example.com or *.example.com for its subdomains. When empty
+	// any host is allowed as long as it resolves to a public address;
+	// listed hosts may resolve to private ones.
+	AllowedHosts []string
+	Timeout      time.Duration
+}
+
+// imageClient downloads attachment images over http(s) from the allowed
+// hosts, or from public addresses only when no host is listed.
+type imageClient struct {
+	client       *http.Client
+	allowedHosts []string
+	timeout      time.Duration
+}
+
+func newImageClient(options ImageOptions) *imageClient {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultImageTimeout
+	}
+	c := &imageClient{timeout: options.Timeout}
+	for _, host := range options.AllowedHosts {
+		c.allowedHosts = append(c.allowedHosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+
+	dialer := &net.Dialer{Timeout: options.Timeout}
+	if len(c.allowedHosts) == 0 {
+		// The address is checked once resolved, so a public name pointing
+		// to an internal address is refused too.
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("image address %s is not public", addrPort.Addr())
+			}
+			return nil
+		}
+	}
+	c.client = &http.Client{
+		Timeout: options.Timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   options.Timeout,
+			ResponseHeaderTimeout: options.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxImageRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxImageRedirects)
+			}
+			return c.checkURL(req.URL)
+		},
+	}
+	return c
+}
+
+// checkURL refuses URLs that are not http(s) or whose host is not allowed.
+func (c *imageClient) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("image scheme %q is not allowed", u.Scheme)
+	}
+	if len(c.allowedHosts) == 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range c.allowedHosts {
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("image host %q is not allowed", host)
+}
+
+// isPublicAddr tells whether the address is reachable from the internet,
+// i.e. neither loopback, private, link-local (e.g. cloud metadata),
+// shared (carrier-grade NAT) nor multicast.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() &&
+		!addr.IsPrivate() &&
+		!sharedAddrSpace.Contains(addr)
+}
+
+var sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// buildCardMedia downloads and uploads the attachment images of the card,
+// within the image timeout together so a slow host never holds back the
+// page. Images that fail are logged and left out, the card is always sent.
+func (l *Lark) buildCardMedia(ctx context.Context, alert model.WebhookAlert) *cardMedia {
+	ctx, cancel := context.WithTimeout(ctx, l.imageClient.Load().timeout)
+	defer cancel()
+
+	return &cardMedia{
+		ImageKey:           l.uploadImageURL(ctx, alert.GroupKey, alert.ImageURL),
+		ThumbImageKey:      l.uploadImageURL(ctx, alert.GroupKey, alert.ThumbURL),
+		FooterIconImageKey: l.uploadImageURL(ctx, alert.GroupKey, alert.FooterIcon),
+	}
+}
+
+// attachGraph renders the metric graph of the alert in the background and
+// adds it to the card posted as messageID, so a slow Prometheus never holds
+// back the page. Rendering and uploading the graph take at most the graph
+// timeout. The card is rebuilt with the media it was posted with, and left
+// alone when the graph would spill it over more messages.
+func (l *Lark) attachGraph(ctx context.Context, alert model.WebhookAlert, media *cardMedia, messages int, messageID string) {
+	if l.grapher == nil {
+		return
+	}
+	// The graph outlives the notification request.
+	ctx = context.WithoutCancel(ctx)
+	timeout := l.options.Load().GraphTimeout
+	cards := l.cardBuilder.Load()
+
+	l.graphs.Add(1)
+	go func() {
+		defer l.graphs.Done()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		logger := l.logger.With(
+			slog.String("alert_id", alert.GroupKey),
+			slog.String("message_id", messageID),
+		)
+
+		graphMedia := *media
+		graphMedia.GraphImageKey = l.renderGraph(ctx, alert, logger)
+		if graphMedia.GraphImageKey == "" {
+			return
+		}
+		contents, err := cards.BuildMessages(&alert, &graphMedia)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to build graph card [skipping graph]",
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+		if len(contents) != messages {
+			logger.WarnContext(ctx, "card is too large for the graph [skipping graph]")
+			return
+		}
+		if err := l.patchMessage(ctx, messageID, contents[0], alert.GroupKey); err != nil {
+			logger.WarnContext(ctx, "failed to add graph to card [skipping graph]",
+				slog.String("error", err.Error()),
+			)
+		}
+	}()
+}
+
+// Wait waits for the graphs still being added to posted cards.
+func (l *Lark) Wait() {
+	l.graphs.Wait()
+}
+
+// renderGraph renders and uploads the metric graph for the alert. It returns
+// an empty image key when there is nothing to graph or anything fails.
+func (l *Lark) renderGraph(ctx context.Context, alert model.WebhookAlert, logger *slog.Logger) string {
+	image, err := l.grapher.Render(ctx, alert)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to render graph [skipping graph]",
+			slog.String("error", err.Error()),
+		)
+		return ""
+	}
+	if image == nil {
+		return ""
+	}
+
+	imageKey, err := l.uploadImage(ctx, image)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to upload graph [skipping graph]",
+			slog.String("error", err.Error()),
+		)
+		return ""
+	}
+
+	return imageKey
+}
+
+// uploadImageURL downloads an attachment image and uploads it to Lark. Lark
+// image keys do not expire, so keys are cached by tenant and URL, except for
+// URLs with a query, which are usually rendered on request (e.g. a Grafana
+// panel over the last hour) and differ on every notification.
+func (l *Lark) uploadImageURL(ctx context.Context, alertID, imageURL string) string {
+	imageURL = strings.TrimSpace(imageURL)
+	if imageURL == "" {
+		return ""
+	}
+	// Image keys belong to the app that uploaded them.
+	cacheKey := imageCacheKey{tenant: l.tenants.tenant(TenantFromContext(ctx)).Name, url: imageURL}
+	cacheable := !strings.Contains(imageURL, "?")
+	if cacheable {
+		if imageKey, ok := l.imageKeys.get(cacheKey); ok {
+			return imageKey
+		}
+	}
+	logger := l.logger.With(
+		slog.String("alert_id", alertID),
+		slog.String("image_url", imageURL),
+	)
+
+	image, err := l.imageClient.Load().download(ctx, imageURL)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to download image [skipping image]",
+			slog.String("error", err.Error()),
+		)
+		return ""
+	}
+
+	imageKey, err := l.uploadImage(ctx, image)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to upload image [skipping image]",
+			slog.String("error", err.Error()),
+		)
+		return ""
+	}
+	if cacheable {
+		l.imageKeys.set(cacheKey, imageKey)
+	}
+
+	return imageKey
+}
+
+func (c *imageClient) download(ctx context.Context, imageURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" && !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("unexpected content type %q", contentType)
+	}
+
+	image, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(image) > maxImageBytes {
+		return nil, fmt.Errorf("image exceeds limit of %d bytes", maxImageBytes)
+	}
+
+	return image, nil
+}
+
+func (l *Lark) uploadImage(ctx context.Context, image []byte) (string, error) {
+	l.logger.DebugContext(ctx, "sending upload image request")
+	req := larkim.NewCreateImageReqBuilder().
+		Body(larkim.NewCreateImageReqBodyBuilder().
+			ImageType("message").
+			Image(bytes.NewReader(image)).
+			Build()).
+		Build()
+
+	ctx, request := startLarkRequest(ctx, larkEndpointImageCreate)
+	resp, err := l.client(ctx).Im.Image.Create(ctx, req)
+	if err != nil {
+		request.failed(err)
+		return "", err
+	}
+	request.done(resp.Code, resp.Msg, resp.RequestId())
+	if !resp.Success() {
+		return "", fmt.Errorf("failed to upload image [logId: %s]: %s", resp.RequestId(), larkcore.Prettify(resp.CodeError))
+	}
+
+	return *resp.Data.ImageKey, nil
+}
@@ -0,0 +1,346 @@
+package lark
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+func TestImageClientDownload(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	// server.URL is on 127.0.0.1, localhost is the same server under a
+	// host that is not allowed.
+	otherHost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name         string
+		allowedHosts []string
+		url          string
+		wantErr      string
+	}{
+		{
+			name:    "loopback address",
+			url:     server.URL + "/image.png",
+			wantErr: "is not public",
+		},
+		{
+			name:    "metadata address",
+			url:     "http://169.254.169.254/latest/meta-data/",
+			wantErr: "is not public",
+		},
+		{
+			name:         "allowed host",
+			allowedHosts: []string{"127.0.0.1"},
+			url:          server.URL + "/image.png",
+		},
+		{
+			name:         "host not allowed",
+			allowedHosts: []string{"grafana.example.com"},
+			url:          server.URL + "/image.png",
+			wantErr:      "is not allowed",
+		},
+		{
+			name:         "redirect to a host not allowed",
+			allowedHosts: []string{"127.0.0.1"},
+			url:          server.URL + "/redirect?to=" + otherHost + "/image.png",
+			wantErr:      `image host "localhost" is not allowed`,
+		},
+		{
+			name:         "redirect to another scheme",
+			allowedHosts: []string{"127.0.0.1"},
+			url:          server.URL + "/redirect?to=ftp://127.0.0.1/image.png",
+			wantErr:      `image scheme "ftp" is not allowed`,
+		},
+		{
+			name:         "redirect loop",
+			allowedHosts: []string{"127.0.0.1"},
+			url:          server.URL + "/loop",
+			wantErr:      "stopped after 3 redirects",
+		},
+		{
+			name:    "file scheme",
+			url:     "file:///etc/passwd",
+			wantErr: `image scheme "file" is not allowed`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newImageClient(ImageOptions{AllowedHosts: tt.allowedHosts})
+			image, err := client.download(context.Background(), tt.url)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("download() error = %v", err)
+				}
+				if string(image) != "png" {
+					t.Errorf("download() = %q, want png", image)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("download() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestImageClientCheckURL(t *testing.T) {
+	client := newImageClient(ImageOptions{AllowedHosts: []string{"grafana.example.com", "*.example.org"}})
+	tests := map[string]bool{
+		"https://grafana.example.com/render/d/abc.png": true,
+		"https://GRAFANA.example.com/x.png":            true,
+		"http://grafana.example.com:3000/x.png":        true,
+		"https://example.com/x.png":                    false,
+		"https://evil-grafana.example.com/x.png":       false,
+		"https://img.example.org/x.png":                true,
+		"https://a.b.example.org/x.png":                true,
+		"https://example.org/x.png":                    false,
+		"https://example.org.evil.com/x.png":           false,
+		"gopher://grafana.example.com/x.png":           false,
+	}
+	for rawURL, want := range tests {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("invalid URL %s: %v", rawURL, err)
+		}
+		if err := client.checkURL(u); (err == nil) != want {
+			t.Errorf("checkURL(%s) error = %v, want allowed %v", rawURL, err, want)
+		}
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::1":   true,
+		"::ffff:93.184.216.34": true,
+		"127.0.0.1":            false,
+		"::1":                  false,
+		"::ffff:127.0.0.1":     false,
+		"0.0.0.0":              false,
+		"::":                   false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"fd00::1":              false,
+		"169.254.169.254":      false,
+		"fd00:ec2::254":        false,
+		"fe80::1":              false,
+		"100.64.0.1":           false,
+		"100.100.100.200":      false,
+		"224.0.0.1":            false,
+		"ff02::1":              false,
+		"255.255.255.255":      false,
+	}
+	for address, want := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(address)); got != want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
+
+func TestImageCache(t *testing.T) {
+	key := func(url string) imageCacheKey {
+		return imageCacheKey{tenant: DefaultTenant, url: url}
+	}
+	cache := newImageCache(2, time.Hour)
+	cache.set(key("a"), "img_a")
+	cache.set(key("b"), "img_b")
+	// a is used, so b is the least recently used when c comes in.
+	if imageKey, ok := cache.get(key("a")); !ok || imageKey != "img_a" {
+		t.Errorf("get(a) = %q, %v, want img_a", imageKey, ok)
+	}
+	cache.set(key("c"), "img_c")
+	if _, ok := cache.get(key("b")); ok {
+		t.Error("get(b) found the least recently used image over the size")
+	}
+	for _, url := range []string{"a", "c"} {
+		if _, ok := cache.get(key(url)); !ok {
+			t.Errorf("get(%s) missed a recently used image", url)
+		}
+	}
+
+	expiring := newImageCache(2, -time.Second)
+	expiring.set(key("a"), "img_a")
+	if _, ok := expiring.get(key("a")); ok {
+		t.Error("get(a) found an expired image")
+	}
+	if len(expiring.entries) != 0 || expiring.order.Len() != 0 {
+		t.Errorf("expired image is still kept, %d entries", len(expiring.entries))
+	}
+}
+
+func TestUploadImageURLCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer server.Close()
+	l, requests := newTestLarkWith(t, Options{Images: ImageOptions{AllowedHosts: []string{"127.0.0.1"}}}, nil, nil)
+
+	tests := []struct {
+		url         string
+		wantUploads int
+	}{
+		{url: server.URL + "/logo.png", wantUploads: 1},
+		{url: server.URL + "/render/d-solo/checkout?panelId=2&from=now-1h", wantUploads: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			requests.Reset()
+			for range 2 {
+				if imageKey := l.uploadImageURL(context.Background(), "alert", tt.url); imageKey == "" {
+					t.Fatal("uploadImageURL() returned no image key")
+				}
+			}
+			if uploads := sentRequests(t, requests, "/open-apis/im/v1/images"); len(uploads) != tt.wantUploads {
+				t.Errorf("uploaded the image %d times, want %d", len(uploads), tt.wantUploads)
+			}
+		})
+	}
+}
+
+// blockingGrapher renders a graph once released, or fails when its context
+// ends first.
+type blockingGrapher struct {
+	release chan struct{}
+}
+
+func (g *blockingGrapher) Render(ctx context.Context, _ model.WebhookAlert) ([]byte, error) {
+	select {
+	case <-g.release:
+		return []byte("png"), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func newGraphTestLark(t *testing.T, timeout time.Duration) (*Lark, *blockingGrapher, *bytes.Buffer) {
+	t.Helper()
+	repo, err := repository.New(repository.Config{Backend: repository.BackendMemory}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	grapher := &blockingGrapher{release: make(chan struct{})}
+	l, requests := newTestLarkWith(t, Options{GraphTimeout: timeout}, repo, grapher)
+	return l, grapher, requests
+}
+
+var graphTestWebhook = model.Webhook{
+	Channel: "oc_chat",
+	Alerts: []model.WebhookAlert{
+		{Title: "HighLatency", Text: "p99 above 1s", Color: "red", CallbackID: "8f4c6a0b3e2d1f09,"},
+	},
+}
+
+func TestAttachGraph(t *testing.T) {
+	l, grapher, requests := newGraphTestLark(t, time.Minute)
+
+	if err := l.NotifyAlerts(context.Background(), graphTestWebhook); err != nil {
+		t.Fatalf("NotifyAlerts() error = %v", err)
+	}
+	// The card is posted while the graph is still rendering.
+	cards := sentRequests(t, requests, "/open-apis/im/v1/messages")
+	if len(cards) != 1 {
+		t.Fatalf("posted %d cards before the graph rendered, want 1", len(cards))
+	}
+
+	close(grapher.release)
+	l.Wait()
+
+	if uploads := sentRequests(t, requests, "/open-apis/im/v1/images"); len(uploads) != 1 {
+		t.Fatalf("uploaded %d images, want the graph", len(uploads))
+	}
+	state, err := l.repository.GetAlertState(context.Background(), l.slackAlertGroup(graphTestWebhook.Alerts[0]).Key)
+	if err != nil {
+		t.Fatalf("failed to get alert state: %v", err)
+	}
+	messageID := state.Messages["oc_chat"].MessageID
+	if replies := sentRequests(t, requests, "/open-apis/im/v1/messages/"+messageID+"/reply"); len(replies) != 0 {
+		t.Errorf("sent %d replies to the card, want the graph in the card itself", len(replies))
+	}
+	patches := sentRequests(t, requests, "/open-apis/im/v1/messages/"+messageID)
+	if len(patches) != 1 || patches[0].Method != http.MethodPatch {
+		t.Fatalf("sent %d requests to the card, want a patch with the graph", len(patches))
+	}
+	var body struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(patches[0].Body, &body); err != nil {
+		t.Fatalf("invalid patch body %s: %v", patches[0].Body, err)
+	}
+	if !strings.Contains(body.Content, `"img_key":"img_dry_run_`) || !strings.Contains(body.Content, "p99 above 1s") {
+		t.Errorf("patched card %s is not the card with the uploaded graph", body.Content)
+	}
+}
+
+func TestAttachGraphFirstCardOnly(t *testing.T) {
+	l, grapher, requests := newGraphTestLark(t, time.Minute)
+	close(grapher.release)
+
+	resolved := graphTestWebhook
+	resolved.Alerts = []model.WebhookAlert{graphTestWebhook.Alerts[0]}
+	resolved.Alerts[0].Color = "green"
+	for _, webhook := range []model.Webhook{graphTestWebhook, graphTestWebhook, resolved} {
+		if err := l.NotifyAlerts(context.Background(), webhook); err != nil {
+			t.Fatalf("NotifyAlerts() error = %v", err)
+		}
+		l.Wait()
+	}
+
+	if uploads := sentRequests(t, requests, "/open-apis/im/v1/images"); len(uploads) != 1 {
+		t.Errorf("uploaded %d images, want the graph of the first card only", len(uploads))
+	}
+	state, err := l.repository.GetAlertState(context.Background(), l.slackAlertGroup(graphTestWebhook.Alerts[0]).Key)
+	if err != nil {
+		t.Fatalf("failed to get alert state: %v", err)
+	}
+	messageID := state.Messages["oc_chat"].MessageID
+	if replies := sentRequests(t, requests, "/open-apis/im/v1/messages/"+messageID+"/reply"); len(replies) != 2 {
+		t.Errorf("sent %d replies, want the update and the resolved notification", len(replies))
+	}
+	for _, reply := range sentRequests(t, requests, "/open-apis/im/v1/messages/"+messageID+"/reply") {
+		if strings.Contains(string(reply.Body), "img_key") {
+			t.Errorf("reply %s carries the graph", reply.Body)
+		}
+	}
+}
+
+func TestAttachGraphTimeout(t *testing.T) {
+	l, _, requests := newGraphTestLark(t, 50*time.Millisecond)
+
+	if err := l.NotifyAlerts(context.Background(), graphTestWebhook); err != nil {
+		t.Fatalf("NotifyAlerts() error = %v", err)
+	}
+	l.Wait()
+
+	if cards := sentRequests(t, requests, "/open-apis/im/v1/messages"); len(cards) != 1 {
+		t.Errorf("posted %d cards, want 1", len(cards))
+	}
+	if uploads := sentRequests(t, requests, "/open-apis/im/v1/images"); len(uploads) != 0 {
+		t.Errorf("uploaded %d images after the graph timed out, want none", len(uploads))
+	}
+}
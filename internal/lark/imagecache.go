@@ -0,0 +1,87 @@
+package lark
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// imageCacheSize bounds how many uploaded image keys are kept.
+	imageCacheSize = 512
+
+	// imageCacheTTL is how long an uploaded image is reused for its URL,
+	// so an image changed behind the same URL shows up after a while.
+	imageCacheTTL = time.Hour
+)
+
+// imageCacheKey is an uploaded image, by tenant and URL.
+type imageCacheKey struct {
+	tenant string
+	url    string
+}
+
+type imageCacheEntry struct {
+	key       imageCacheKey
+	imageKey  string
+	expiresAt time.Time
+}
+
+// imageCache keeps the Lark image keys of recently uploaded images, least
+// recently used first out.
+type imageCache struct {
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+	order   *list.List
+	entries map[imageCacheKey]*list.Element
+}
+
+func newImageCache(size int, ttl time.Duration) *imageCache {
+	return &imageCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[imageCacheKey]*list.Element),
+	}
+}
+
+func (c *imageCache) get(key imageCacheKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*imageCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return entry.imageKey, true
+}
+
+func (c *imageCache) set(key imageCacheKey, imageKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &imageCacheEntry{
+		key:       key,
+		imageKey:  imageKey,
+		expiresAt: time.Now().Add(c.ttl),
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*imageCacheEntry).key)
+	}
+}
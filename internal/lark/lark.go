@@ -1,47 +1,145 @@
 package lark
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	lark "github.com/larksuite/oapi-sdk-go/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
 )
 
-var client *lark.Client
+// Lark API endpoints, as recorded in the request metrics.
+const (
+	larkEndpointMessageCreate = "im.message.create"
+	larkEndpointMessageReply  = "im.message.reply"
+	larkEndpointMessagePatch  = "im.message.patch"
+	larkEndpointImageCreate   = "im.image.create"
+	larkEndpointUserGet       = "contact.user.get"
+	larkEndpointTenantToken   = "auth.tenant_access_token"
+
+	// larkCodeError is recorded when no response was received.
+	larkCodeError = "error"
+)
 
 type Lark struct {
-	client *lark.Client
+	tenants *Tenants
 
-	cardBuilder *cardBuilder
-	repository  pkg.Repository
+	options       atomic.Pointer[Options]
+	cardBuilder   atomic.Pointer[cardBuilder]
+	imageClient   atomic.Pointer[imageClient]
+	repository    pkg.Repository
+	grapher       pkg.Grapher
+	alertmanagers *alertmanager.Registry
+	imageKeys     *imageCache
+	graphs        sync.WaitGroup
 
 	logger *slog.Logger
 }
 
 var _ pkg.Notifier = (*Lark)(nil)
 
+type Options struct {
+	Card CardOptions
+
+	// GroupLabels identify the group of a native Alertmanager notification.
+	// When empty the Alertmanager group key is used.
+	GroupLabels []string
+
+	Images ImageOptions
+
+	// GraphTimeout bounds rendering and uploading the metric graph, which
+	// is added to the card once it is posted.
+	GraphTimeout time.Duration
+}
+
+// New returns the notifier. Each notification is posted by the tenant of
+// its context, see WithTenant.
 func New(
-	appId string,
-	appSecret string,
+	tenants *Tenants,
+	options Options,
 
 	repository pkg.Repository,
+	grapher pkg.Grapher,
+	alertmanagers *alertmanager.Registry,
 
 	logger *slog.Logger,
 ) *Lark {
-	if client == nil {
-		client = lark.NewClient(
-			appId,
-			appSecret,
-			lark.WithEnableTokenCache(true),
-		)
+	l := &Lark{
+		tenants:       tenants,
+		repository:    repository,
+		grapher:       grapher,
+		alertmanagers: alertmanagers,
+		imageKeys:     newImageCache(imageCacheSize, imageCacheTTL),
+		logger:        logger,
+	}
+	l.SetOptions(options)
+	return l
+}
+
+// SetOptions replaces the options, e.g. on a configuration reload. Alerts
+// being notified keep the options they started with.
+func (l *Lark) SetOptions(options Options) {
+	l.options.Store(&options)
+	l.cardBuilder.Store(newCardBuilder(options.Card))
+	l.imageClient.Store(newImageClient(options.Images))
+}
+
+// larkRequest measures and traces a Lark API call.
+type larkRequest struct {
+	endpoint string
+	start    time.Time
+	span     trace.Span
+}
+
+func startLarkRequest(ctx context.Context, endpoint string) (context.Context, *larkRequest) {
+	ctx, span := tracing.Start(ctx, "lark."+endpoint, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, &larkRequest{
+		endpoint: endpoint,
+		start:    time.Now(),
+		span:     span,
 	}
+}
 
-	return &Lark{
-		client,
+// failed records a call that got no response.
+func (r *larkRequest) failed(err error) {
+	o11y.ObserveLarkRequest(r.endpoint, r.start, larkCodeError)
+	tracing.End(r.span, err)
+}
 
-		newCardBuilder(),
-		repository,
+// done records the response code, and the log ID Lark support asks for.
+func (r *larkRequest) done(code int, msg, logID string) {
+	o11y.ObserveLarkRequest(r.endpoint, r.start, strconv.Itoa(code))
+	r.span.SetAttributes(
+		attribute.Int("lark.code", code),
+		attribute.String("lark.log_id", logID),
+	)
+	var err error
+	if code != 0 {
+		err = fmt.Errorf("lark code %d: %s", code, msg)
+	}
+	tracing.End(r.span, err)
+}
+
+// client returns the Lark client of the tenant of ctx.
+func (l *Lark) client(ctx context.Context) *lark.Client {
+	return l.tenants.client(TenantFromContext(ctx))
+}
 
-		logger,
+// checkChat returns ErrChatNotAllowed when the tenant of ctx does not post
+// to the chat.
+func (l *Lark) checkChat(ctx context.Context, chatID string) error {
+	if tenant := l.tenants.tenant(TenantFromContext(ctx)); !tenant.AllowsChat(chatID) {
+		return fmt.Errorf("%w: %s does not post to %s", ErrChatNotAllowed, tenant.Name, chatID)
 	}
+	return nil
 }
@@ -0,0 +1,94 @@
+package lark
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+const (
+	// actionLeaseTTL outlasts a silence action, so a replica that dies
+	// holding the lease only blocks the card that long.
+	actionLeaseTTL = 2 * time.Minute
+	// actionLeaseWait is how long a click waits for the one before it.
+	actionLeaseWait = time.Minute
+	// actionLeasePoll is how often a waiting click retries.
+	actionLeasePoll = 250 * time.Millisecond
+)
+
+var (
+	errLeaseHeld  = errors.New("lease is held")
+	errNotTracked = errors.New("alert is not tracked")
+)
+
+// lockCard waits for the action lease of the tracked group, and returns the
+// function releasing it. Cards whose group is not tracked have nothing to
+// hold the lease in and are not serialized.
+func (h *Handler) lockCard(ctx context.Context, key string) (func(), error) {
+	if h.repository == nil {
+		return func() {}, nil
+	}
+
+	owner := newLeaseOwner()
+	deadline := time.Now().Add(actionLeaseWait)
+	for {
+		_, err := h.repository.UpdateAlertState(ctx, key, func(state *model.AlertState) error {
+			// An empty state is created for a key that is not tracked.
+			if state.Status == "" {
+				return errNotTracked
+			}
+			now := time.Now()
+			if lease := state.ActionLease; lease != nil && lease.Owner != owner && now.Before(lease.ExpiresAt) {
+				return errLeaseHeld
+			}
+			state.ActionLease = &model.Lease{Owner: owner, ExpiresAt: now.Add(actionLeaseTTL)}
+			return nil
+		})
+		switch {
+		case err == nil:
+			return func() { h.unlockCard(ctx, key, owner) }, nil
+		case errors.Is(err, errNotTracked):
+			return func() {}, nil
+		case !errors.Is(err, errLeaseHeld):
+			return nil, fmt.Errorf("failed to lock card: %w", err)
+		case time.Now().After(deadline):
+			return nil, fmt.Errorf("another action on the card is still running")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(actionLeasePoll):
+		}
+	}
+}
+
+// unlockCard releases the lease, unless it expired and was taken since.
+func (h *Handler) unlockCard(ctx context.Context, key, owner string) {
+	_, err := h.repository.UpdateAlertState(context.WithoutCancel(ctx), key, func(state *model.AlertState) error {
+		if state.ActionLease == nil || state.ActionLease.Owner != owner {
+			return errLeaseHeld
+		}
+		state.ActionLease = nil
+		return nil
+	})
+	if err != nil && !errors.Is(err, errLeaseHeld) {
+		logging.FromContext(ctx).WarnContext(ctx, "failed to unlock card, it unlocks when the lease expires",
+			slog.String("alert_id", key),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+func newLeaseOwner() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,120 @@
+package lark
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+func newLeaseTestHandler(t *testing.T) (*Handler, pkg.Repository) {
+	t.Helper()
+	repo, err := repository.New(repository.Config{Backend: repository.BackendMemory}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	_, err = repo.UpdateAlertState(context.Background(), "group", func(state *model.AlertState) error {
+		state.Status = model.AlertStatusFiring
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update alert state: %v", err)
+	}
+	return NewHandler(nil, SilenceModeGroup, repo), repo
+}
+
+func TestLockCard(t *testing.T) {
+	// Two handlers on one repository stand for two replicas.
+	first, repo := newLeaseTestHandler(t)
+	second := NewHandler(nil, SilenceModeGroup, repo)
+
+	unlock, err := first.lockCard(context.Background(), "group")
+	if err != nil {
+		t.Fatalf("lockCard() error = %v", err)
+	}
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := second.lockCard(context.Background(), "group")
+		if err != nil {
+			t.Errorf("second lockCard() error = %v", err)
+		}
+		locked <- unlock
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("second click got the lease while the first held it")
+	case <-time.After(3 * actionLeasePoll):
+	}
+
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(10 * actionLeasePoll):
+		t.Fatal("second click did not get the lease once released")
+	}
+
+	state, err := repo.GetAlertState(context.Background(), "group")
+	if err != nil {
+		t.Fatalf("failed to get alert state: %v", err)
+	}
+	if state.ActionLease != nil {
+		t.Errorf("lease %+v left after both clicks", state.ActionLease)
+	}
+}
+
+func TestLockCardExpiredLease(t *testing.T) {
+	h, repo := newLeaseTestHandler(t)
+	_, err := repo.UpdateAlertState(context.Background(), "group", func(state *model.AlertState) error {
+		state.ActionLease = &model.Lease{Owner: "dead replica", ExpiresAt: time.Now().Add(-time.Second)}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update alert state: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), actionLeasePoll)
+	defer cancel()
+	unlock, err := h.lockCard(ctx, "group")
+	if err != nil {
+		t.Fatalf("lockCard() error = %v, want the expired lease taken over", err)
+	}
+	unlock()
+}
+
+func TestLockCardCancelled(t *testing.T) {
+	h, _ := newLeaseTestHandler(t)
+	unlock, err := h.lockCard(context.Background(), "group")
+	if err != nil {
+		t.Fatalf("lockCard() error = %v", err)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), actionLeasePoll)
+	defer cancel()
+	if _, err := h.lockCard(ctx, "group"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lockCard() error = %v, want the deadline", err)
+	}
+}
+
+func TestLockCardUntracked(t *testing.T) {
+	h, repo := newLeaseTestHandler(t)
+
+	unlock, err := h.lockCard(context.Background(), "untracked")
+	if err != nil {
+		t.Fatalf("lockCard() error = %v", err)
+	}
+	unlock()
+
+	if _, err := repo.GetAlertState(context.Background(), "untracked"); !errors.Is(err, pkg.ErrNotFound) {
+		t.Errorf("expected no state for the untracked card, got %v", err)
+	}
+}
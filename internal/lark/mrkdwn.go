@@ -0,0 +1,244 @@
+package lark
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Slack mrkdwn (https://api.slack.com/reference/surfaces/formatting) is
+// close to, but not the same as, Lark markdown. The templates behind
+// /notify are written for Slack, so attachments are translated before they
+// end up in a lark_md element.
+
+var (
+	mrkdwnCodeBlock   = regexp.MustCompile("(?s)```(.*?)```")
+	mrkdwnInlineCode  = regexp.MustCompile("`[^`\n]+`")
+	mrkdwnEntity      = regexp.MustCompile(`<([^<>\n]+)>`)
+	mrkdwnEmoji       = regexp.MustCompile(`:([a-z0-9_+\-]+):`)
+	mrkdwnBullet      = regexp.MustCompile(`(?m)^(\s*)[•◦▪‣]\s*`)
+	mrkdwnPlaceholder = regexp.MustCompile("\x00(\\d+)\x00")
+
+	mrkdwnUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+// mrkdwnEmojis maps the Slack shortcodes commonly used in alert templates
+// to their unicode characters. Unknown shortcodes are left untouched.
+var mrkdwnEmojis = map[string]string{
+	"fire":                       "🔥",
+	"rotating_light":             "🚨",
+	"warning":                    "⚠️",
+	"white_check_mark":           "✅",
+	"heavy_check_mark":           "✔️",
+	"check":                      "✔️",
+	"x":                          "❌",
+	"heavy_multiplication_x":     "✖️",
+	"red_circle":                 "🔴",
+	"large_orange_circle":        "🟠",
+	"large_yellow_circle":        "🟡",
+	"large_green_circle":         "🟢",
+	"large_blue_circle":          "🔵",
+	"black_circle":               "⚫",
+	"white_circle":               "⚪",
+	"exclamation":                "❗",
+	"heavy_exclamation_mark":     "❗",
+	"question":                   "❓",
+	"bell":                       "🔔",
+	"no_bell":                    "🔕",
+	"mute":                       "🔇",
+	"information_source":         "ℹ️",
+	"bulb":                       "💡",
+	"boom":                       "💥",
+	"skull":                      "💀",
+	"bug":                        "🐛",
+	"construction":               "🚧",
+	"hourglass":                  "⌛",
+	"hourglass_flowing_sand":     "⏳",
+	"stopwatch":                  "⏱️",
+	"alarm_clock":                "⏰",
+	"chart_with_upwards_trend":   "📈",
+	"chart_with_downwards_trend": "📉",
+	"bar_chart":                  "📊",
+	"memo":                       "📝",
+	"link":                       "🔗",
+	"mag":                        "🔍",
+	"wrench":                     "🔧",
+	"hammer_and_wrench":          "🛠️",
+	"gear":                       "⚙️",
+	"rocket":                     "🚀",
+	"tada":                       "🎉",
+	"eyes":                       "👀",
+	"thumbsup":                   "👍",
+	"+1":                         "👍",
+	"thumbsdown":                 "👎",
+	"-1":                         "👎",
+	"sos":                        "🆘",
+	"zzz":                        "💤",
+	"arrow_up":                   "⬆️",
+	"arrow_down":                 "⬇️",
+	"arrow_right":                "➡️",
+	"small_red_triangle":         "🔺",
+	"small_red_triangle_down":    "🔻",
+	"ok":                         "🆗",
+	"new":                        "🆕",
+}
+
+// convertMrkdwn translates Slack mrkdwn into Lark markdown.
+func convertMrkdwn(text string) string {
+	return translateMrkdwn(text, false)
+}
+
+// stripMrkdwn renders Slack mrkdwn as plain text, for places such as the
+// card header which do not support markdown.
+func stripMrkdwn(text string) string {
+	return translateMrkdwn(text, true)
+}
+
+func translateMrkdwn(text string, plain bool) string {
+	// Code is copied verbatim, so it is swapped out for placeholders before
+	// any other rule gets to touch it.
+	var protected []string
+	protect := func(s string) string {
+		protected = append(protected, s)
+		return fmt.Sprintf("\x00%d\x00", len(protected)-1)
+	}
+
+	text = mrkdwnCodeBlock.ReplaceAllStringFunc(text, func(block string) string {
+		code := strings.Trim(mrkdwnCodeBlock.FindStringSubmatch(block)[1], "\n")
+		if plain {
+			return protect(mrkdwnUnescaper.Replace(code))
+		}
+		return protect("\n```\n" + mrkdwnUnescaper.Replace(code) + "\n```\n")
+	})
+	text = mrkdwnInlineCode.ReplaceAllStringFunc(text, func(code string) string {
+		if plain {
+			return protect(mrkdwnUnescaper.Replace(strings.Trim(code, "`")))
+		}
+		return protect(mrkdwnUnescaper.Replace(code))
+	})
+
+	// Links and mentions contain characters that look like emphasis, so
+	// they are protected as well once translated.
+	text = mrkdwnEntity.ReplaceAllStringFunc(text, func(entity string) string {
+		return protect(convertMrkdwnEntity(strings.Trim(entity, "<>"), plain))
+	})
+
+	text = convertMrkdwnEmphasis(text, '*', "**", plain)
+	text = convertMrkdwnEmphasis(text, '_', "*", plain)
+	text = convertMrkdwnEmphasis(text, '~', "~~", plain)
+
+	text = mrkdwnEmoji.ReplaceAllStringFunc(text, func(shortcode string) string {
+		if emoji, ok := mrkdwnEmojis[strings.Trim(shortcode, ":")]; ok {
+			return emoji
+		}
+		return shortcode
+	})
+	text = mrkdwnBullet.ReplaceAllString(text, "$1- ")
+	text = mrkdwnUnescaper.Replace(text)
+
+	// A code span inside a link label leaves placeholders nested one level
+	// deep, so restoring runs twice.
+	for range 2 {
+		text = mrkdwnPlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+			i, err := strconv.Atoi(strings.Trim(placeholder, "\x00"))
+			if err != nil || i >= len(protected) {
+				return placeholder
+			}
+			return protected[i]
+		})
+	}
+
+	return strings.Trim(text, "\n")
+}
+
+// convertMrkdwnEntity translates the content of a <...> entity: links,
+// user and channel mentions and special mentions.
+func convertMrkdwnEntity(entity string, plain bool) string {
+	target, label, _ := strings.Cut(entity, "|")
+	// Lark does not format link text, so labels are always plain.
+	label = stripMrkdwn(label)
+
+	switch {
+	case target == "!channel" || target == "!here" || target == "!everyone":
+		if plain {
+			return "@all"
+		}
+		return "<at id=all></at>"
+	case strings.HasPrefix(target, "!"):
+		if label != "" {
+			return label
+		}
+		return strings.TrimPrefix(target, "!")
+	case strings.HasPrefix(target, "@"):
+		if label != "" {
+			return "@" + label
+		}
+		return target
+	case strings.HasPrefix(target, "#"):
+		if label != "" {
+			return "#" + label
+		}
+		return target
+	}
+
+	target = mrkdwnUnescaper.Replace(target)
+	if plain {
+		if label != "" {
+			return label
+		}
+		return strings.TrimPrefix(target, "mailto:")
+	}
+	if label == "" {
+		label = strings.TrimPrefix(target, "mailto:")
+	}
+	return fmt.Sprintf("[%s](%s)", label, target)
+}
+
+// convertMrkdwnEmphasis replaces marker-delimited spans, e.g. *bold*, with
+// the Lark equivalent. Like Slack, a span must start at a word boundary,
+// must not start or end with whitespace and cannot cross lines.
+func convertMrkdwnEmphasis(text string, marker byte, replacement string, plain bool) string {
+	if plain {
+		replacement = ""
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != marker || !isMrkdwnBoundary(text, i-1, marker) || i+1 >= len(text) || isSpace(text[i+1]) {
+			b.WriteByte(text[i])
+			continue
+		}
+
+		end := -1
+		for j := i + 1; j < len(text) && text[j] != '\n'; j++ {
+			if text[j] == marker && j > i+1 && !isSpace(text[j-1]) && isMrkdwnBoundary(text, j+1, marker) {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			b.WriteByte(text[i])
+			continue
+		}
+
+		b.WriteString(replacement)
+		b.WriteString(text[i+1 : end])
+		b.WriteString(replacement)
+		i = end
+	}
+
+	return b.String()
+}
+
+func isMrkdwnBoundary(text string, i int, marker byte) bool {
+	if i < 0 || i >= len(text) {
+		return true
+	}
+	c := text[i]
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == marker)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
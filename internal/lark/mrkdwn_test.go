@@ -0,0 +1,210 @@
+package lark
+
+import "testing"
+
+func TestConvertMrkdwn(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "link with label",
+			text: "<https://grafana.example.com/d/abc?var=a&amp;b=c|Dashboard>",
+			want: "[Dashboard](https://grafana.example.com/d/abc?var=a&b=c)",
+		},
+		{
+			name: "bare link",
+			text: "see <https://example.com>",
+			want: "see [https://example.com](https://example.com)",
+		},
+		{
+			name: "mailto link",
+			text: "<mailto:oncall@example.com>",
+			want: "[oncall@example.com](mailto:oncall@example.com)",
+		},
+		{
+			name: "link label is plain",
+			text: "<https://example.com|*Runbook* _step_>",
+			want: "[Runbook step](https://example.com)",
+		},
+		{
+			name: "link with emphasis characters",
+			text: "<https://example.com/a_b_c/*x*>",
+			want: "[https://example.com/a_b_c/*x*](https://example.com/a_b_c/*x*)",
+		},
+		{
+			name: "user mention",
+			text: "ping <@U024BE7LH>",
+			want: "ping @U024BE7LH",
+		},
+		{
+			name: "user mention with label",
+			text: "ping <@U024BE7LH|alice>",
+			want: "ping @alice",
+		},
+		{
+			name: "channel mention",
+			text: "see <#C024BE7LR>",
+			want: "see #C024BE7LR",
+		},
+		{
+			name: "channel mention with label",
+			text: "see <#C024BE7LR|ops_alerts>",
+			want: "see #ops_alerts",
+		},
+		{
+			name: "special mention",
+			text: "<!here> database down",
+			want: "<at id=all></at> database down",
+		},
+		{
+			name: "bold",
+			text: "*FIRING* alert",
+			want: "**FIRING** alert",
+		},
+		{
+			name: "italic",
+			text: "_since 5m_",
+			want: "*since 5m*",
+		},
+		{
+			name: "strikethrough",
+			text: "~resolved~",
+			want: "~~resolved~~",
+		},
+		{
+			name: "nested emphasis",
+			text: "*bold _italic_ text*",
+			want: "**bold *italic* text**",
+		},
+		{
+			name: "intra-word underscores",
+			text: "metric node_cpu_seconds_total",
+			want: "metric node_cpu_seconds_total",
+		},
+		{
+			name: "intra-word asterisks",
+			text: "2*3*4",
+			want: "2*3*4",
+		},
+		{
+			name: "unclosed marker",
+			text: "*not bold",
+			want: "*not bold",
+		},
+		{
+			name: "marker followed by space",
+			text: "a * b * c",
+			want: "a * b * c",
+		},
+		{
+			name: "emphasis does not cross lines",
+			text: "*one\ntwo*",
+			want: "*one\ntwo*",
+		},
+		{
+			name: "inline code is verbatim",
+			text: "run `rate(x_total[5m]) * 2` now",
+			want: "run `rate(x_total[5m]) * 2` now",
+		},
+		{
+			name: "inline code is unescaped",
+			text: "`a &lt; b`",
+			want: "`a < b`",
+		},
+		{
+			name: "code block is verbatim",
+			text: "```\n*not bold* _not italic_ :fire:\n<https://example.com>\n```",
+			want: "```\n*not bold* _not italic_ :fire:\n<https://example.com>\n```",
+		},
+		{
+			name: "code block between text",
+			text: "before```x_y_z```after",
+			want: "before\n```\nx_y_z\n```\nafter",
+		},
+		{
+			name: "code span in link label",
+			text: "<https://example.com|run `x_y`>",
+			want: "[run `x_y`](https://example.com)",
+		},
+		{
+			name: "escaped angle brackets",
+			text: "latency &gt; 5s &amp;&amp; errors &lt; 1%",
+			want: "latency > 5s && errors < 1%",
+		},
+		{
+			name: "escaped brackets are not links",
+			text: "&lt;https://example.com&gt;",
+			want: "<https://example.com>",
+		},
+		{
+			name: "emoji",
+			text: ":fire: :rotating_light: :+1:",
+			want: "🔥 🚨 👍",
+		},
+		{
+			name: "unknown emoji",
+			text: ":party_parrot: at 12:30:00",
+			want: ":party_parrot: at 12:30:00",
+		},
+		{
+			name: "bullets",
+			text: "• one\n  ◦ two",
+			want: "- one\n  - two",
+		},
+		{
+			name: "placeholder-like text",
+			text: "\x000\x00 *x*",
+			want: "\x000\x00 **x**",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convertMrkdwn(tt.text); got != tt.want {
+				t.Errorf("convertMrkdwn(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripMrkdwn(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "emphasis",
+			text: "*[FIRING:2]* _HighLatency_ ~old~",
+			want: "[FIRING:2] HighLatency old",
+		},
+		{
+			name: "link",
+			text: "<https://example.com|Dashboard> <https://example.com/x>",
+			want: "Dashboard https://example.com/x",
+		},
+		{
+			name: "mentions",
+			text: "<!channel> <@U024BE7LH|alice> <#C024BE7LR>",
+			want: "@all @alice #C024BE7LR",
+		},
+		{
+			name: "code",
+			text: "`up == 0` ```a_b```",
+			want: "up == 0 a_b",
+		},
+		{
+			name: "escapes and emoji",
+			text: ":fire: p99 &gt; 5s",
+			want: "🔥 p99 > 5s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripMrkdwn(tt.text); got != tt.want {
+				t.Errorf("stripMrkdwn(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
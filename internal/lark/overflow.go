@@ -0,0 +1,317 @@
+package lark
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+const (
+	// DefaultCardMaxBytes keeps cards below the 30KB Lark limits on the
+	// message content, leaving room for the rest of the request body.
+	DefaultCardMaxBytes = 28 * 1024
+
+	// CardOverflowTruncate drops the alerts that do not fit and links to
+	// the full list.
+	CardOverflowTruncate = "truncate"
+	// CardOverflowSplit sends the alerts that do not fit as continuation
+	// cards in the thread of the first card.
+	CardOverflowSplit = "split"
+
+	// cardTitleReserve is kept free for the "(2/3)" title suffix, which is
+	// only known once every part has been laid out.
+	cardTitleReserve = 32
+)
+
+type CardOptions struct {
+	MaxBytes int
+	Overflow string
+}
+
+// BuildMessages renders the alert as one or more card message contents,
+// each within the Lark size limits. The first content is the main card, the
+// others are continuations to be sent in its thread.
+func (l *cardBuilder) BuildMessages(alert *model.WebhookAlert, media *cardMedia) ([]string, error) {
+	content, err := l.BuildJSON(alert, media)
+	if err != nil {
+		return nil, err
+	}
+	if cardSize(content) <= l.options.MaxBytes {
+		return []string{content}, nil
+	}
+
+	blocks, unit := splitAlertText(alert)
+	if l.options.Overflow == CardOverflowSplit {
+		return l.buildSplitMessages(alert, media, blocks, unit)
+	}
+	return l.buildTruncatedMessage(alert, media, blocks, unit)
+}
+
+func (l *cardBuilder) buildTruncatedMessage(alert *model.WebhookAlert, media *cardMedia, blocks []string, unit string) ([]string, error) {
+	build := func(kept int) (string, error) {
+		truncated := *alert
+		truncated.Text = strings.Join(blocks[:kept], blockSeparator(unit))
+		note := moreNote(len(blocks)-kept, unit)
+		if alert.TitleLink != "" {
+			note += fmt.Sprintf(", [view all](%s)", alert.TitleLink)
+		}
+		return l.marshal(l.build(&truncated, media, note))
+	}
+
+	// The card grows with every kept block, so the largest number of blocks
+	// that fits is found by bisection.
+	low, high := -1, len(blocks)-1
+	var fitting string
+	for low < high {
+		kept := (low + high + 1) / 2
+		content, err := build(kept)
+		if err != nil {
+			return nil, err
+		}
+		if cardSize(content) <= l.options.MaxBytes {
+			low, fitting = kept, content
+		} else {
+			high = kept - 1
+		}
+	}
+	if low < 0 {
+		return nil, fmt.Errorf("card exceeds limit of %d bytes without any alert text", l.options.MaxBytes)
+	}
+
+	return []string{fitting}, nil
+}
+
+// cardPart is the text of one of the cards an alert is split into.
+type cardPart struct {
+	text string
+	// note tells what was cut from a block too big for a card of its own.
+	note string
+}
+
+func (l *cardBuilder) buildSplitMessages(alert *model.WebhookAlert, media *cardMedia, blocks []string, unit string) ([]string, error) {
+	limit := l.options.MaxBytes - cardTitleReserve
+
+	// The first part carries the actions and media of the card, the
+	// continuations only the title and the text.
+	parts := make([]cardPart, 0)
+	fits := func(part cardPart) (bool, error) {
+		content, err := l.marshal(l.buildPart(alert, media, part, len(parts), 0))
+		return cardSize(content) <= limit, err
+	}
+
+	current := cardPart{}
+	for _, block := range blocks {
+		candidate := cardPart{text: block}
+		if current.text != "" {
+			candidate.text = current.text + blockSeparator(unit) + block
+		}
+		ok, err := fits(candidate)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			current = candidate
+			continue
+		}
+
+		if current.text != "" {
+			parts = append(parts, current)
+			current = cardPart{}
+			if ok, err = fits(cardPart{text: block}); err != nil {
+				return nil, err
+			}
+			if ok {
+				current = cardPart{text: block}
+				continue
+			}
+		}
+		// The note of a cut block ends its card.
+		cut, err := l.cutBlock(alert, block, fits)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, cut)
+	}
+	if current.text != "" || len(parts) == 0 {
+		parts = append(parts, current)
+	}
+
+	contents := make([]string, 0, len(parts))
+	for i, part := range parts {
+		content, err := l.marshal(l.buildPart(alert, media, part, i, len(parts)))
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, content)
+	}
+
+	return contents, nil
+}
+
+// cutBlock keeps as many lines as fit of a block too big for a card of its
+// own, noting how many were left out as truncate mode does. A single line
+// that does not fit is cut short.
+func (l *cardBuilder) cutBlock(alert *model.WebhookAlert, block string, fits func(part cardPart) (bool, error)) (cardPart, error) {
+	cut := func(text string, dropped int) cardPart {
+		note := "… truncated"
+		if dropped > 0 {
+			note = moreNote(dropped, "lines")
+		}
+		if alert.TitleLink != "" {
+			note += fmt.Sprintf(", [view all](%s)", alert.TitleLink)
+		}
+		return cardPart{text: closeCodeBlock(text), note: note}
+	}
+
+	lines := strings.Split(block, "\n")
+	for kept := len(lines) - 1; kept > 0; kept-- {
+		part := cut(strings.Join(lines[:kept], "\n"), len(lines)-kept)
+		ok, err := fits(part)
+		if err != nil {
+			return cardPart{}, err
+		}
+		if ok {
+			return part, nil
+		}
+	}
+	for line := lines[0]; line != ""; {
+		line = truncateText(line, len(line)*3/4)
+		part := cut(line+"…", len(lines)-1)
+		ok, err := fits(part)
+		if err != nil {
+			return cardPart{}, err
+		}
+		if ok {
+			return part, nil
+		}
+	}
+	return cardPart{}, fmt.Errorf("card exceeds limit of %d bytes without any alert text", l.options.MaxBytes)
+}
+
+// buildPart renders the index-th of total parts. The first is the full
+// card, and carries the "(1/2)" suffix only once total is known.
+func (l *cardBuilder) buildPart(alert *model.WebhookAlert, media *cardMedia, part cardPart, index, total int) *model.LarkCard {
+	text := *alert
+	text.Text = part.text
+	if index > 0 {
+		return l.buildContinuation(&text, part.note, index+1, total)
+	}
+	card := l.build(&text, media, part.note)
+	if total > 1 {
+		card.Header.Title.Content += fmt.Sprintf(" (1/%d)", total)
+	}
+	return card
+}
+
+func (l *cardBuilder) buildContinuation(alert *model.WebhookAlert, note string, part, total int) *model.LarkCard {
+	header := l.buildCardHeader(alert)
+	header.Title.Content += fmt.Sprintf(" (%d/%d)", part, total)
+
+	elements := []*model.LarkCardElement{
+		l.buildCardMarkdown(l.formatText(alert)),
+	}
+	if note != "" {
+		elements = append(elements, l.buildCardNote(note))
+	}
+	return &model.LarkCard{
+		Header:   header,
+		Elements: elements,
+	}
+}
+
+// splitAlertText splits the text of a grouped alert into blocks that can be
+// dropped or moved to another card. Templates that separate alerts with a
+// blank line are split per alert, anything else per line. Code blocks are
+// never split, so that each card renders them whole.
+func splitAlertText(alert *model.WebhookAlert) ([]string, string) {
+	text := strings.Trim(alert.Text, "\n")
+
+	paragraphs := make([]string, 0)
+	for _, paragraph := range splitOutsideCode(text, "\n\n") {
+		if strings.TrimSpace(paragraph) != "" {
+			paragraphs = append(paragraphs, strings.Trim(paragraph, "\n"))
+		}
+	}
+	if len(paragraphs) > 1 && len(paragraphs) == len(splitFingerprints(alert.CallbackID)) {
+		return paragraphs, "alerts"
+	}
+
+	return splitOutsideCode(text, "\n"), "lines"
+}
+
+// splitOutsideCode splits the text on sep, except within ``` code blocks.
+func splitOutsideCode(text, sep string) []string {
+	blocks := make([]string, 0)
+	inCode := false
+	for _, piece := range strings.Split(text, sep) {
+		if inCode {
+			blocks[len(blocks)-1] += sep + piece
+		} else {
+			blocks = append(blocks, piece)
+		}
+		if strings.Count(piece, "```")%2 == 1 {
+			inCode = !inCode
+		}
+	}
+	return blocks
+}
+
+// closeCodeBlock closes the ``` code block a cut left open.
+func closeCodeBlock(text string) string {
+	if strings.Count(text, "```")%2 == 1 {
+		return text + "\n```"
+	}
+	return text
+}
+
+// moreNote tells how many alerts or lines were left out, e.g. "… 1 more
+// alert".
+func moreNote(count int, unit string) string {
+	if count == 1 {
+		unit = strings.TrimSuffix(unit, "s")
+	}
+	return fmt.Sprintf("… %d more %s", count, unit)
+}
+
+func blockSeparator(unit string) string {
+	if unit == "alerts" {
+		return "\n\n"
+	}
+	return "\n"
+}
+
+// splitFingerprints parses the comma-separated fingerprint list produced by
+// the callbackid template.
+func splitFingerprints(callbackID string) []string {
+	fingerprints := make([]string, 0)
+	for _, fingerprint := range strings.Split(callbackID, ",") {
+		if fingerprint = strings.TrimSpace(fingerprint); fingerprint != "" {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	return fingerprints
+}
+
+// truncateText cuts the text to at most n bytes without splitting a rune.
+func truncateText(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
+
+// cardSize is the size of the content once it is embedded, escaped, in the
+// request body.
+func cardSize(content string) int {
+	escaped, err := json.Marshal(content)
+	if err != nil {
+		return len(content)
+	}
+	return len(escaped)
+}
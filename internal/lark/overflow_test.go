@@ -0,0 +1,223 @@
+package lark
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+func TestBuildTruncatedMessageNote(t *testing.T) {
+	block := func(i int) string {
+		// Each block is longer than the note, so dropping one shrinks the
+		// card.
+		return fmt.Sprintf("Checkout returns errors on checkout-%d: %s", i, strings.Repeat("5xx ratio is above 5%, ", 8))
+	}
+	alerts := func(n int) *model.WebhookAlert {
+		paragraphs := make([]string, 0, n)
+		fingerprints := make([]string, 0, n)
+		for i := range n {
+			paragraphs = append(paragraphs, block(i))
+			fingerprints = append(fingerprints, fmt.Sprintf("%016x", i))
+		}
+		return &model.WebhookAlert{
+			Title:      "[FIRING] HighErrorRate",
+			Text:       strings.Join(paragraphs, "\n\n"),
+			CallbackID: strings.Join(fingerprints, ","),
+		}
+	}
+	lines := func(n int) *model.WebhookAlert {
+		text := make([]string, 0, n)
+		for i := range n {
+			text = append(text, block(i))
+		}
+		return &model.WebhookAlert{
+			Title: "[FIRING] HighErrorRate",
+			Text:  strings.Join(text, "\n"),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		alert   *model.WebhookAlert
+		dropped int
+		want    string
+	}{
+		{"one alert", alerts(5), 1, "… 1 more alert"},
+		{"several alerts", alerts(5), 3, "… 3 more alerts"},
+		{"one line", lines(5), 1, "… 1 more line"},
+		{"several lines", lines(5), 2, "… 2 more lines"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The limit is the size of the card keeping all but the
+			// dropped blocks, so exactly those are left out.
+			blocks, unit := splitAlertText(tt.alert)
+			kept := *tt.alert
+			kept.Text = strings.Join(blocks[:len(blocks)-tt.dropped], blockSeparator(unit))
+			builder := newCardBuilder(CardOptions{})
+			fitting, err := builder.marshal(builder.build(&kept, nil, tt.want))
+			if err != nil {
+				t.Fatalf("marshal() error = %v", err)
+			}
+
+			builder = newCardBuilder(CardOptions{MaxBytes: cardSize(fitting), Overflow: CardOverflowTruncate})
+			contents, err := builder.BuildMessages(tt.alert, nil)
+			if err != nil {
+				t.Fatalf("BuildMessages() error = %v", err)
+			}
+			if len(contents) != 1 || contents[0] != fitting {
+				t.Errorf("BuildMessages() = %q, want %q", contents, fitting)
+			}
+		})
+	}
+}
+
+// splitPart is what a test reads back from a card of a split alert.
+type splitPart struct {
+	title, text, note string
+}
+
+func parseSplitPart(t *testing.T, content string) splitPart {
+	t.Helper()
+	var card model.LarkCard
+	if err := json.Unmarshal([]byte(content), &card); err != nil {
+		t.Fatalf("invalid card %s: %v", content, err)
+	}
+	part := splitPart{title: card.Header.Title.Content}
+	for _, element := range card.Elements {
+		switch {
+		case element.Tag == "div" && element.Text != nil && part.text == "":
+			part.text = element.Text.Content
+		case element.Tag == "note" && len(element.Elements) == 1 && part.note == "":
+			part.note = element.Elements[0].Content
+		}
+	}
+	return part
+}
+
+func TestBuildSplitMessages(t *testing.T) {
+	line := func(i int) string {
+		return fmt.Sprintf("Checkout returns errors on checkout-%d: %s", i, strings.Repeat("5xx ratio is above 5%, ", 4))
+	}
+	paragraph := func(i, lines int) string {
+		text := make([]string, 0, lines)
+		for j := range lines {
+			text = append(text, fmt.Sprintf("%s line %d", line(i), j))
+		}
+		return strings.Join(text, "\n")
+	}
+	alerts := func(paragraphs ...string) *model.WebhookAlert {
+		fingerprints := make([]string, 0, len(paragraphs))
+		for i := range paragraphs {
+			fingerprints = append(fingerprints, fmt.Sprintf("%016x", i))
+		}
+		return &model.WebhookAlert{
+			Title:      "[FIRING] HighErrorRate",
+			TitleLink:  "https://alertmanager.example.com/#/alerts",
+			Text:       strings.Join(paragraphs, "\n\n"),
+			CallbackID: strings.Join(fingerprints, ","),
+		}
+	}
+	lines := func(text ...string) *model.WebhookAlert {
+		return &model.WebhookAlert{
+			Title:     "[FIRING] HighErrorRate",
+			TitleLink: "https://alertmanager.example.com/#/alerts",
+			Text:      strings.Join(text, "\n"),
+		}
+	}
+	code := []string{"Logs:", "```"}
+	for i := range 20 {
+		code = append(code, fmt.Sprintf("%s *not bold* %d", line(i), i))
+	}
+	code = append(code, "```", line(100), line(101))
+
+	tests := []struct {
+		name      string
+		alert     *model.WebhookAlert
+		maxBytes  int
+		wantParts int
+		// wantNotes are the notes of the parts, empty when nothing is cut.
+		wantNotes []string
+		// wantTexts are found in order across the parts.
+		wantTexts []string
+	}{
+		{
+			name:      "alerts",
+			alert:     alerts(paragraph(0, 2), paragraph(1, 2), paragraph(2, 2), paragraph(3, 2), paragraph(4, 2), paragraph(5, 2)),
+			maxBytes:  2400,
+			wantParts: 2,
+			wantNotes: []string{"", ""},
+			wantTexts: []string{"checkout-0:", "checkout-1:", "checkout-2:", "checkout-3:", "checkout-4:", "checkout-5:"},
+		},
+		{
+			name:      "alert too large for a card",
+			alert:     alerts(paragraph(0, 1), paragraph(1, 30)),
+			maxBytes:  2400,
+			wantParts: 2,
+			wantNotes: []string{"", "… 16 more lines, [view all](https://alertmanager.example.com/#/alerts)"},
+			wantTexts: []string{"checkout-0:", "checkout-1: 5xx ratio is above 5%, 5xx ratio is above 5%, 5xx ratio is above 5%, 5xx ratio is above 5%,  line 13"},
+		},
+		{
+			name:      "line too large for a card",
+			alert:     lines(line(0), strings.Repeat("x", 3000)),
+			maxBytes:  2400,
+			wantParts: 2,
+			wantNotes: []string{"", "… truncated, [view all](https://alertmanager.example.com/#/alerts)"},
+			wantTexts: []string{"checkout-0:", "xxx…"},
+		},
+		{
+			name:      "code block",
+			alert:     lines(code...),
+			maxBytes:  2400,
+			wantParts: 3,
+			wantNotes: []string{"", "… 8 more lines, [view all](https://alertmanager.example.com/#/alerts)", ""},
+			wantTexts: []string{"Logs:", "checkout-0: ", "*not bold* 0", "checkout-100:", "checkout-101:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := newCardBuilder(CardOptions{MaxBytes: tt.maxBytes, Overflow: CardOverflowSplit})
+			contents, err := builder.BuildMessages(tt.alert, nil)
+			if err != nil {
+				t.Fatalf("BuildMessages() error = %v", err)
+			}
+			if len(contents) != tt.wantParts {
+				t.Fatalf("BuildMessages() = %d parts, want %d: %q", len(contents), tt.wantParts, contents)
+			}
+
+			var texts, notes []string
+			for i, content := range contents {
+				if size := cardSize(content); size > tt.maxBytes {
+					t.Errorf("part %d is %d bytes, over the %d bytes limit", i+1, size, tt.maxBytes)
+				}
+				part := parseSplitPart(t, content)
+				if want := fmt.Sprintf("[FIRING] HighErrorRate (%d/%d)", i+1, len(contents)); part.title != want {
+					t.Errorf("part %d title = %q, want %q", i+1, part.title, want)
+				}
+				if strings.Count(part.text, "```")%2 != 0 {
+					t.Errorf("part %d leaves a code block open: %q", i+1, part.text)
+				}
+				if strings.Contains(part.text, "**not bold**") {
+					t.Errorf("part %d renders code as markdown: %q", i+1, part.text)
+				}
+				texts = append(texts, part.text)
+				notes = append(notes, part.note)
+			}
+			if !slices.Equal(notes, tt.wantNotes) {
+				t.Errorf("notes = %q, want %q", notes, tt.wantNotes)
+			}
+			all := strings.Join(texts, "\n")
+			for _, want := range tt.wantTexts {
+				index := strings.Index(all, want)
+				if index < 0 {
+					t.Fatalf("parts %q lack %q in order", texts, want)
+				}
+				all = all[index+len(want):]
+			}
+		})
+	}
+}
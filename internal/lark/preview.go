@@ -0,0 +1,152 @@
+package lark
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// headerTemplates are the header colors Lark knows, others are shown in
+// the default color.
+var headerTemplates = []string{
+	"blue", "wathet", "turquoise", "green", "yellow", "orange", "red",
+	"carmine", "violet", "purple", "indigo", "grey", "default",
+}
+
+// missingValue is what Go templates print for a missing map key.
+const missingValue = "<no value>"
+
+// IsAlertmanagerPayload tells native Alertmanager payloads, which carry a
+// version and group key, from Slack payloads made by the lark.* templates,
+// which carry neither.
+func IsAlertmanagerPayload(body []byte) (bool, error) {
+	var probe struct {
+		Version  string `json:"version"`
+		GroupKey string `json:"groupKey"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return false, err
+	}
+	return probe.Version != "" || probe.GroupKey != "", nil
+}
+
+// Preview renders the cards of a notification body with the current card
+// options.
+func (l *Lark) Preview(body []byte) (*model.CardPreview, error) {
+	return PreviewPayload(l.options.Load().Card, body)
+}
+
+// PreviewPayload renders the cards of a notification body exactly as they
+// are posted, except that images are not uploaded, and warns about what
+// the templates likely got wrong.
+func PreviewPayload(options CardOptions, body []byte) (*model.CardPreview, error) {
+	native, err := IsAlertmanagerPayload(body)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &model.CardPreview{
+		Cards:    make([][]json.RawMessage, 0),
+		Warnings: make([]string, 0),
+	}
+	alerts := make([]model.WebhookAlert, 0)
+	if native {
+		var webhook model.AlertmanagerWebhook
+		if err := json.Unmarshal(body, &webhook); err != nil {
+			return nil, err
+		}
+		preview.Warnings = append(preview.Warnings, unknownFields(body, &model.AlertmanagerWebhook{})...)
+		if len(webhook.Alerts) == 0 {
+			preview.Warnings = append(preview.Warnings, "the payload has no alerts")
+		}
+		alerts = append(alerts, webhookAlertFromAlertmanager(webhook))
+	} else {
+		var webhook model.Webhook
+		if err := json.Unmarshal(body, &webhook); err != nil {
+			return nil, err
+		}
+		preview.Warnings = append(preview.Warnings, unknownFields(body, &model.Webhook{})...)
+		if len(webhook.Alerts) == 0 {
+			preview.Warnings = append(preview.Warnings, "the payload has no attachments, nothing is posted")
+		}
+		alerts = append(alerts, webhook.Alerts...)
+	}
+
+	builder := newCardBuilder(options)
+	for i, alert := range alerts {
+		contents, err := builder.BuildMessages(&alert, nil)
+		if err != nil {
+			return nil, fmt.Errorf("card %d: %w", i+1, err)
+		}
+		messages := make([]json.RawMessage, 0, len(contents))
+		for _, content := range contents {
+			messages = append(messages, json.RawMessage(content))
+		}
+		preview.Cards = append(preview.Cards, messages)
+
+		for _, warning := range builder.warnings(&alert, len(contents)) {
+			preview.Warnings = append(preview.Warnings, fmt.Sprintf("card %d: %s", i+1, warning))
+		}
+	}
+	return preview, nil
+}
+
+// unknownFields reports the first field of the body the payload type does
+// not have, usually a typo in the template.
+func unknownFields(body []byte, payload any) []string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload); err != nil {
+		return []string{fmt.Sprintf("%s, it is ignored", strings.TrimPrefix(err.Error(), "json: "))}
+	}
+	return nil
+}
+
+func (l *cardBuilder) warnings(alert *model.WebhookAlert, messages int) []string {
+	warnings := make([]string, 0)
+	if strings.TrimSpace(alert.Title) == "" {
+		warnings = append(warnings, "the title is empty")
+	}
+	if len(splitFingerprints(alert.CallbackID)) == 0 {
+		warnings = append(warnings, "the callback_id has no fingerprints, the alert cannot be silenced or tracked")
+	}
+	if alert.Color != "" && !slices.Contains(headerTemplates, alert.Color) {
+		warnings = append(warnings, fmt.Sprintf("color %q is not a Lark header template, the default color is shown", alert.Color))
+	}
+
+	texts := map[string]string{
+		"title": alert.Title,
+		"text":  alert.Text,
+	}
+	for _, field := range alert.Fields {
+		texts[fmt.Sprintf("field %q", field.Title)] = field.Value
+	}
+	for _, name := range slices.Sorted(maps.Keys(texts)) {
+		if strings.Contains(texts[name], missingValue) {
+			warnings = append(warnings, fmt.Sprintf("the %s contains %s, a template value is missing", name, missingValue))
+		}
+	}
+
+	if content, err := l.BuildJSON(alert, nil); err == nil && cardSize(content) > l.options.MaxBytes {
+		if l.options.Overflow == CardOverflowSplit {
+			warnings = append(warnings, fmt.Sprintf("the card is %d bytes, over the %d bytes limit, and is split into %d messages", cardSize(content), l.options.MaxBytes, messages))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("the card is %d bytes, over the %d bytes limit, and is truncated", cardSize(content), l.options.MaxBytes))
+		}
+	}
+	for _, image := range []struct{ name, url string }{
+		{"image_url", alert.ImageURL},
+		{"thumb_url", alert.ThumbURL},
+		{"footer_icon", alert.FooterIcon},
+	} {
+		if image.url != "" {
+			warnings = append(warnings, fmt.Sprintf("%s is uploaded when posted, the preview shows no image", image.name))
+		}
+	}
+	return warnings
+}
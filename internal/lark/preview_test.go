@@ -0,0 +1,336 @@
+package lark
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// The types below mirror the data and functions Alertmanager renders its
+// notification templates with, enough to run the docker example templates.
+
+type amPair struct{ Name, Value string }
+
+type amPairs []amPair
+
+func (ps amPairs) Values() []string {
+	values := make([]string, 0, len(ps))
+	for _, p := range ps {
+		values = append(values, p.Value)
+	}
+	return values
+}
+
+func (ps amPairs) String() string {
+	pairs := make([]string, 0, len(ps))
+	for _, p := range ps {
+		pairs = append(pairs, p.Name+"="+p.Value)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+type amKV map[string]string
+
+// SortedPairs sorts by name, with alertname first.
+func (kv amKV) SortedPairs() amPairs {
+	names := make([]string, 0, len(kv))
+	for name := range kv {
+		if name != "alertname" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := kv["alertname"]; ok {
+		names = append([]string{"alertname"}, names...)
+	}
+	pairs := make(amPairs, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, amPair{name, kv[name]})
+	}
+	return pairs
+}
+
+type amAlert struct {
+	Status      string
+	Labels      amKV
+	Annotations amKV
+	Fingerprint string
+}
+
+type amAlerts []amAlert
+
+func (as amAlerts) Firing() []amAlert {
+	firing := make([]amAlert, 0, len(as))
+	for _, a := range as {
+		if a.Status == "firing" {
+			firing = append(firing, a)
+		}
+	}
+	return firing
+}
+
+type amData struct {
+	Receiver          string
+	Status            string
+	Alerts            amAlerts
+	GroupLabels       amKV
+	CommonLabels      amKV
+	CommonAnnotations amKV
+	ExternalURL       string
+}
+
+var amFuncs = template.FuncMap{
+	"toUpper": strings.ToUpper,
+	"toLower": strings.ToLower,
+	"join": func(sep string, s []string) string {
+		return strings.Join(s, sep)
+	},
+	"reReplaceAll": func(pattern, repl, text string) string {
+		return regexp.MustCompile(pattern).ReplaceAllString(text, repl)
+	},
+}
+
+type amSlackConfig struct {
+	Channel string `yaml:"channel"`
+	Color   string `yaml:"color"`
+	Title   string `yaml:"title"`
+	Text    string `yaml:"text"`
+	Actions []struct {
+		Type  string `yaml:"type"`
+		Text  string `yaml:"text"`
+		URL   string `yaml:"url"`
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"actions"`
+}
+
+// renderSlackPayload renders the Slack payload Alertmanager posts to
+// /notify for the data, with the slack_configs of docker/alertmanager.yml
+// and the templates of docker/alertmanager.tmpl. Fields left to the
+// Alertmanager default templates are left out, except callback_id, which
+// the example templates define.
+func renderSlackPayload(t *testing.T, data amData) []byte {
+	t.Helper()
+	templates, err := template.New("").Funcs(amFuncs).ParseFiles("../../docker/alertmanager.tmpl")
+	if err != nil {
+		t.Fatalf("failed to parse alertmanager.tmpl: %v", err)
+	}
+	configFile, err := os.ReadFile("../../docker/alertmanager.yml")
+	if err != nil {
+		t.Fatalf("failed to read alertmanager.yml: %v", err)
+	}
+	var config struct {
+		Receivers []struct {
+			SlackConfigs []amSlackConfig `yaml:"slack_configs"`
+		} `yaml:"receivers"`
+	}
+	if err := yaml.Unmarshal(configFile, &config); err != nil {
+		t.Fatalf("failed to parse alertmanager.yml: %v", err)
+	}
+	slack := config.Receivers[0].SlackConfigs[0]
+
+	render := func(text string) string {
+		t.Helper()
+		tmpl, err := templates.Clone()
+		if err != nil {
+			t.Fatalf("failed to clone templates: %v", err)
+		}
+		if _, err := tmpl.New("field").Parse(text); err != nil {
+			t.Fatalf("failed to parse %q: %v", text, err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&out, "field", data); err != nil {
+			t.Fatalf("failed to render %q: %v", text, err)
+		}
+		return out.String()
+	}
+
+	type action struct {
+		Type  string `json:"type,omitempty"`
+		Text  string `json:"text,omitempty"`
+		URL   string `json:"url,omitempty"`
+		Name  string `json:"name,omitempty"`
+		Value string `json:"value,omitempty"`
+	}
+	actions := make([]action, 0, len(slack.Actions))
+	for _, a := range slack.Actions {
+		actions = append(actions, action{
+			Type:  render(a.Type),
+			Text:  render(a.Text),
+			URL:   render(a.URL),
+			Name:  render(a.Name),
+			Value: render(a.Value),
+		})
+	}
+	payload, err := json.Marshal(map[string]any{
+		"channel": slack.Channel,
+		"attachments": []map[string]any{{
+			"title":       render(slack.Title),
+			"text":        render(slack.Text),
+			"fallback":    "",
+			"callback_id": render(`{{ template "slack.default.callbackid" . }}`),
+			"footer":      "",
+			"color":       render(slack.Color),
+			"mrkdwn_in":   []string{"fallback", "pretext", "text"},
+			"actions":     actions,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode payload: %v", err)
+	}
+	return payload
+}
+
+func exampleAlertData(status string) amData {
+	alert := func(fingerprint, pod string) amAlert {
+		return amAlert{
+			Status: status,
+			Labels: amKV{
+				"alertname":    "HighErrorRate",
+				"severity":     "critical",
+				"env":          "production",
+				"cluster_name": "payments-p-01",
+				"release":      "checkout",
+				"namespace":    "payments",
+				"pod":          pod,
+			},
+			Annotations: amKV{
+				"summary":     "Checkout returns errors on " + pod,
+				"description": "5xx ratio is above 5% for 10m",
+				"runbook_url": "https://runbooks.example.com/high-error-rate",
+				"dashboard":   "https://lens.example.com/d/checkout",
+			},
+			Fingerprint: fingerprint,
+		}
+	}
+	return amData{
+		Receiver:    "lark",
+		Status:      status,
+		Alerts:      amAlerts{alert("8f4c6a0b3e2d1f09", "checkout-7d9f-abcde"), alert("1a2b3c4d5e6f7081", "checkout-7d9f-fghij")},
+		GroupLabels: amKV{"alertname": "HighErrorRate"},
+		CommonLabels: amKV{
+			"alertname":    "HighErrorRate",
+			"severity":     "critical",
+			"env":          "production",
+			"cluster_name": "payments-p-01",
+			"release":      "checkout",
+			"namespace":    "payments",
+		},
+		ExternalURL: "http://alertmanager:9093",
+	}
+}
+
+func TestPreviewExampleTemplates(t *testing.T) {
+	warning := exampleAlertData("firing")
+	for i := range warning.Alerts {
+		warning.Alerts[i].Labels["severity"] = "warning"
+	}
+	warning.CommonLabels["severity"] = "warning"
+
+	// A large group renders past the card limit.
+	large := exampleAlertData("firing")
+	for len(large.Alerts) < 40 {
+		large.Alerts = append(large.Alerts, large.Alerts...)
+	}
+
+	tests := []struct {
+		name         string
+		data         amData
+		options      CardOptions
+		wantTitle    string
+		wantColor    string
+		wantWarnings []string
+	}{
+		{
+			name:         "firing",
+			data:         exampleAlertData("firing"),
+			wantTitle:    "[FIRING:2] HighErrorRate",
+			wantColor:    "red",
+			wantWarnings: []string{},
+		},
+		{
+			name:         "warning",
+			data:         warning,
+			wantTitle:    "[FIRING:2] HighErrorRate",
+			wantColor:    "yellow",
+			wantWarnings: []string{},
+		},
+		{
+			name:         "resolved",
+			data:         exampleAlertData("resolved"),
+			wantTitle:    "[RESOLVED] HighErrorRate",
+			wantColor:    "green",
+			wantWarnings: []string{},
+		},
+		{
+			name:      "over the card limit",
+			data:      large,
+			options:   CardOptions{MaxBytes: 8 * 1024},
+			wantTitle: "[FIRING:64] HighErrorRate",
+			wantColor: "red",
+			wantWarnings: []string{
+				"card 1: the card is 16365 bytes, over the 8192 bytes limit, and is truncated",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := renderSlackPayload(t, tt.data)
+			preview, err := PreviewPayload(tt.options, payload)
+			if err != nil {
+				t.Fatalf("PreviewPayload() error = %v", err)
+			}
+			if len(preview.Cards) != 1 || len(preview.Cards[0]) != 1 {
+				t.Fatalf("preview has %d cards, want 1 in one message", len(preview.Cards))
+			}
+			var card model.LarkCard
+			if err := json.Unmarshal(preview.Cards[0][0], &card); err != nil {
+				t.Fatalf("invalid card %s: %v", preview.Cards[0][0], err)
+			}
+
+			if card.Header.Title.Content != tt.wantTitle || card.Header.Color != tt.wantColor {
+				t.Errorf("header = %q in %q, want %q in %q", card.Header.Title.Content, card.Header.Color, tt.wantTitle, tt.wantColor)
+			}
+			text := card.Elements[0].Text.Content
+			if !strings.HasPrefix(text, "Checkout returns errors on checkout-7d9f-abcde\n5xx ratio is above 5% for 10m\nseverity: ") {
+				t.Errorf("text = %q, want the summary and description of the first alert", text)
+			}
+
+			var urls, alertIDs []string
+			for _, action := range card.Elements[len(card.Elements)-1].Actions {
+				if action.MultiURL != nil {
+					urls = append(urls, action.Text.Content+" "+action.MultiURL.URL)
+				}
+				if value, ok := action.Value.(map[string]any); ok {
+					alertIDs = append(alertIDs, value["alert_id"].(string))
+				}
+			}
+			wantURLs := []string{
+				"Runbook https://runbooks.example.com/high-error-rate",
+				"Query https://lark-app-test.io/explore",
+				"Dashboard https://katulampa.example.com/d/checkout",
+				"Debug https://lark-app-test.io/d/xxxx/one-observability-dashboard?var-service=checkout&var-cluster_name=payments-p-01&var-env=production",
+			}
+			if !slices.Equal(urls, wantURLs) {
+				t.Errorf("buttons = %q, want %q", urls, wantURLs)
+			}
+			if len(alertIDs) != 2 || !strings.HasPrefix(alertIDs[0], "8f4c6a0b3e2d1f09,1a2b3c4d5e6f7081,") {
+				t.Errorf("silence actions carry %q, want the fingerprints of the alerts", alertIDs)
+			}
+
+			if !slices.Equal(preview.Warnings, tt.wantWarnings) {
+				t.Errorf("warnings = %q, want %q", preview.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package lark
+
+import (
+	"context"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// SendResolvedInferred posts a resolved note, for a group whose resolved
+// notification was missed, in the thread of every copy that was firing in
+// the given state.
+func (l *Lark) SendResolvedInferred(ctx context.Context, state *model.AlertState) error {
+	cards := l.cardBuilder.Load()
+	content, err := cards.marshal(&model.LarkCard{
+		Header: &model.LarkCardHeader{
+			Title: &model.LarkCardText{Tag: "plain_text", Content: "Resolved"},
+			Color: "green",
+		},
+		Elements: []*model.LarkCardElement{
+			cards.buildCardMarkdown("The alerts are no longer active in Alertmanager."),
+			{
+				Tag: "note",
+				Elements: []*model.LarkCardElement{
+					{Tag: "lark_md", Content: "Resolution inferred, the resolved notification was not received."},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	l.replyCopies(ctx, state, content)
+	return nil
+}
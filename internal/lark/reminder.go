@@ -0,0 +1,135 @@
+package lark
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// Actions of the buttons on silence expiry reminders.
+const (
+	SilenceActionExtend    = "extend_silence"
+	SilenceActionLetExpire = "let_expire"
+)
+
+// reminderExtensions are the durations offered to extend an expiring
+// silence.
+var reminderExtensions = []struct{ text, duration string }{
+	{"Extend 1h", "1h"},
+	{"Extend 1d", "1d"},
+}
+
+// SendSilenceReminder posts a reminder that the silence is about to
+// expire in the thread of every firing copy of the alert group.
+func (l *Lark) SendSilenceReminder(ctx context.Context, key string, silence *model.AlertSilence) error {
+	cards := l.cardBuilder.Load()
+	content, err := cards.marshal(cards.buildSilenceReminder(key, silence))
+	if err != nil {
+		return err
+	}
+	return l.replyFiringCopies(ctx, key, content)
+}
+
+// SendSilenceExpired posts a note that the silence expired in the thread of
+// every firing copy of the alert group.
+func (l *Lark) SendSilenceExpired(ctx context.Context, key string, silence *model.AlertSilence) error {
+	cards := l.cardBuilder.Load()
+	content, err := cards.marshal(&model.LarkCard{
+		Header: &model.LarkCardHeader{
+			Title: &model.LarkCardText{Tag: "plain_text", Content: "Silence expired"},
+			Color: "red",
+		},
+		Elements: []*model.LarkCardElement{
+			cards.buildCardMarkdown(fmt.Sprintf("The silence by **%s** expired at %s, the alerts notify again.",
+				silenceAuthor(silence), FormatSilenceTime(silence.EndsAt))),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return l.replyFiringCopies(ctx, key, content)
+}
+
+func (l *cardBuilder) buildSilenceReminder(key string, silence *model.AlertSilence) *model.LarkCard {
+	actions := make([]*model.LarkCardElementAction, 0, len(reminderExtensions)+1)
+	for _, extension := range reminderExtensions {
+		actions = append(actions, &model.LarkCardElementAction{
+			Tag:  "button",
+			Type: "primary",
+			Text: &model.LarkCardText{Tag: "plain_text", Content: extension.text},
+			Value: map[string]string{
+				"action":     SilenceActionExtend,
+				"group_key":  key,
+				"silence_id": silence.ID,
+				"duration":   extension.duration,
+			},
+		})
+	}
+	actions = append(actions, &model.LarkCardElementAction{
+		Tag:  "button",
+		Type: "default",
+		Text: &model.LarkCardText{Tag: "plain_text", Content: "Let expire"},
+		Value: map[string]string{
+			"action":     SilenceActionLetExpire,
+			"group_key":  key,
+			"silence_id": silence.ID,
+		},
+	})
+
+	return &model.LarkCard{
+		Header: &model.LarkCardHeader{
+			Title: &model.LarkCardText{Tag: "plain_text", Content: "Silence expiring soon"},
+			Color: "yellow",
+		},
+		Elements: []*model.LarkCardElement{
+			l.buildCardMarkdown(fmt.Sprintf("The silence by **%s** ends at %s, in %s.",
+				silenceAuthor(silence),
+				FormatSilenceTime(silence.EndsAt),
+				time.Until(silence.EndsAt).Round(time.Minute))),
+			{
+				Tag:     "action",
+				Actions: actions,
+			},
+		},
+	}
+}
+
+func silenceAuthor(silence *model.AlertSilence) string {
+	if silence.CreatedBy == "" {
+		return "unknown"
+	}
+	return silence.CreatedBy
+}
+
+// replyFiringCopies replies with the content in the thread of every copy of
+// the alert group that is still firing.
+func (l *Lark) replyFiringCopies(ctx context.Context, key, content string) error {
+	state, err := l.repository.GetAlertState(ctx, key)
+	if err != nil {
+		return err
+	}
+	l.replyCopies(ctx, state, content)
+	return nil
+}
+
+// replyCopies replies with the content in the thread of every firing copy
+// of the given state.
+func (l *Lark) replyCopies(ctx context.Context, state *model.AlertState, content string) {
+	key := state.Key
+	for _, message := range state.Messages {
+		if message.Status != model.AlertStatusFiring {
+			continue
+		}
+		if _, err := l.sendContinuationMessages(messageContext(ctx, message), message.MessageID, key, message.ChatID, []string{content}); err != nil {
+			l.logger.WarnContext(ctx, "failed to reply in alert thread",
+				slog.String("alert_id", key),
+				slog.String("chat_id", message.ChatID),
+				slog.String("message_id", message.MessageID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package lark
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// silenceTimeFormat is how silence times are shown in chats.
+const silenceTimeFormat = "2006-01-02 15:04:05 MST"
+
+// FormatSilenceTime formats a silence time for chats, in the card timezone.
+func FormatSilenceTime(t time.Time) string {
+	return t.In(cardTimezone).Format(silenceTimeFormat)
+}
+
+const (
+	// SilenceModeGroup creates one silence matching the labels common to
+	// every alert of the card.
+	SilenceModeGroup = "group"
+	// SilenceModeAlert creates one silence per alert matching all of its
+	// labels.
+	SilenceModeAlert = "alert"
+)
+
+// SilenceResult is what a silence action covered.
+type SilenceResult struct {
+	Silences []*model.AlertSilence
+	// Alerts describes every silenced alert.
+	Alerts []string
+	// Missing are the fingerprints of the card that are no longer active
+	// in Alertmanager and were not silenced.
+	Missing []string
+	// Existing describes the silences the alerts already had.
+	Existing []string
+}
+
+// add records the alerts found on the named Alertmanager for the
+// fingerprints routed to it.
+func (r *SilenceResult) add(name string, fingerprints []string, alerts models.GettableAlerts) {
+	found := make(map[string]bool, len(alerts))
+	for _, alert := range alerts {
+		if alert.Fingerprint != nil {
+			found[*alert.Fingerprint] = true
+		}
+		description := describeAlert(alert.Labels)
+		if name != "" {
+			description += " on " + name
+		}
+		r.Alerts = append(r.Alerts, description)
+	}
+	for _, fingerprint := range fingerprints {
+		if !found[fingerprint] {
+			r.Missing = append(r.Missing, fingerprint)
+		}
+	}
+}
+
+// partial returns the result along with err when some silences were
+// created before it, and only err otherwise.
+func (r *SilenceResult) partial(err error) (*SilenceResult, error) {
+	if len(r.Silences) == 0 {
+		return nil, err
+	}
+	return r, fmt.Errorf("silenced %d of the alerts: %w", len(r.Silences), err)
+}
+
+// extend extends the existing silence to endsAt when it ends earlier, and
+// reports it otherwise.
+func (r *SilenceResult) extend(ctx context.Context, am alertmanager.Alertmanager, name string, silence *models.GettableSilence, endsAt time.Time) error {
+	createdBy := *silence.CreatedBy
+	currentEndsAt := time.Time(*silence.EndsAt)
+	if !endsAt.After(currentEndsAt) {
+		r.Existing = append(r.Existing, fmt.Sprintf("Already silenced by %s until %s",
+			createdBy, FormatSilenceTime(currentEndsAt)))
+		return nil
+	}
+
+	silenceID, err := am.ExtendSilence(ctx, silence, endsAt)
+	if err != nil {
+		return err
+	}
+	o11y.ObserveSilence(name, "extended", endsAt.Sub(currentEndsAt))
+	extended := &model.AlertSilence{
+		ID:           silenceID,
+		Alertmanager: name,
+		CreatedBy:    createdBy,
+		StartsAt:     time.Time(*silence.StartsAt),
+		EndsAt:       endsAt,
+	}
+	if silenceID != *silence.ID {
+		extended.Replaces = *silence.ID
+	}
+	r.Silences = append(r.Silences, extended)
+	r.Existing = append(r.Existing, fmt.Sprintf("Extended the existing silence by %s, which ended at %s, instead of creating a new one",
+		createdBy, FormatSilenceTime(currentEndsAt)))
+	return nil
+}
+
+// EndsAt returns when the last of the silences created or extended ends,
+// zero when there is none.
+func (r *SilenceResult) EndsAt() time.Time {
+	var endsAt time.Time
+	for _, silence := range r.Silences {
+		if silence.EndsAt.After(endsAt) {
+			endsAt = silence.EndsAt
+		}
+	}
+	return endsAt
+}
+
+// Summary lists the silenced alerts, the silences they already had, and
+// the alerts that could not be silenced, for the confirmation message.
+func (r *SilenceResult) Summary() string {
+	lines := []string{fmt.Sprintf("Covers %d alert(s):", len(r.Alerts))}
+	for _, alert := range r.Alerts {
+		lines = append(lines, "- "+alert)
+	}
+	lines = append(lines, r.Existing...)
+	if len(r.Missing) > 0 {
+		lines = append(lines, fmt.Sprintf("%d alert(s) are no longer active and were not silenced: %s",
+			len(r.Missing), strings.Join(r.Missing, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// existingSilences splits the alerts into those without an active
+// silence and the silences of the others, each silence once.
+func existingSilences(ctx context.Context, am alertmanager.Alertmanager, alerts models.GettableAlerts) (models.GettableAlerts, []*models.GettableSilence) {
+	unsilenced := models.GettableAlerts{}
+	fetched := make(map[string]*models.GettableSilence)
+	silences := make(map[string]*models.GettableSilence)
+	for _, alert := range alerts {
+		var latest *models.GettableSilence
+		if alert.Status != nil {
+			for _, silenceID := range alert.Status.SilencedBy {
+				silence, ok := fetched[silenceID]
+				if !ok {
+					var err error
+					if silence, err = am.GetSilence(ctx, silenceID); err != nil {
+						logging.FromContext(ctx).WarnContext(ctx, "failed to get silence of alert",
+							slog.String("silence_id", silenceID),
+							slog.String("error", err.Error()),
+						)
+						continue
+					}
+					fetched[silenceID] = silence
+				}
+				if !isActiveSilence(silence) {
+					continue
+				}
+				if latest == nil || time.Time(*silence.EndsAt).After(time.Time(*latest.EndsAt)) {
+					latest = silence
+				}
+			}
+		}
+		if latest == nil {
+			unsilenced = append(unsilenced, alert)
+			continue
+		}
+		silences[*latest.ID] = latest
+	}
+	return unsilenced, slices.Collect(maps.Values(silences))
+}
+
+func isActiveSilence(silence *models.GettableSilence) bool {
+	return silence != nil && silence.ID != nil && silence.EndsAt != nil &&
+		silence.StartsAt != nil && silence.CreatedBy != nil &&
+		silence.Status != nil && silence.Status.State != nil &&
+		*silence.Status.State == models.SilenceStatusStateActive
+}
+
+// silenceMatchers returns the matchers of each silence to create. A group
+// silence falls back to one silence per alert when the alerts have no
+// label in common.
+func silenceMatchers(mode string, alerts models.GettableAlerts) [][]*models.Matcher {
+	if mode == SilenceModeGroup {
+		if common := commonLabels(alerts); len(common) > 0 {
+			return [][]*models.Matcher{labelMatchers(common)}
+		}
+	}
+
+	matchers := make([][]*models.Matcher, 0, len(alerts))
+	for _, alert := range alerts {
+		matchers = append(matchers, labelMatchers(alert.Labels))
+	}
+	return matchers
+}
+
+// commonLabels returns the labels shared, with the same value, by every
+// alert.
+func commonLabels(alerts models.GettableAlerts) map[string]string {
+	if len(alerts) == 0 {
+		return nil
+	}
+	common := maps.Clone(map[string]string(alerts[0].Labels))
+	for _, alert := range alerts[1:] {
+		for name, value := range common {
+			if alert.Labels[name] != value {
+				delete(common, name)
+			}
+		}
+	}
+	return common
+}
+
+func labelMatchers(labels map[string]string) []*models.Matcher {
+	matchers := make([]*models.Matcher, 0, len(labels))
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		matchers = append(matchers, &models.Matcher{
+			Name:    pointerString(name),
+			Value:   pointerString(labels[name]),
+			IsRegex: pointerBool(false),
+			IsEqual: pointerBool(true),
+		})
+	}
+	return matchers
+}
+
+// describeAlert renders the alert as alertname{label="value", ...}.
+func describeAlert(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		if name == "alertname" {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return labels["alertname"] + "{" + strings.Join(pairs, ", ") + "}"
+}
@@ -0,0 +1,163 @@
+package lark
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// alertKey is the key an alert is tracked under: its fingerprints without
+// the trailing comma left by the callbackid template, which is also the
+// alert_id sent back by card actions.
+func alertKey(callbackID string) string {
+	return strings.Join(splitFingerprints(callbackID), ",")
+}
+
+// messageContext returns ctx for replying to the message, as the tenant
+// that posted it. Messages posted before there were tenants have none and
+// get the default one.
+func messageContext(ctx context.Context, message *model.AlertMessage) context.Context {
+	return WithTenant(ctx, message.Tenant)
+}
+
+// chatMessage returns the copy of the alert posted to the chat. Copies
+// migrated from older versions have no chat and match any chat.
+func chatMessage(state *model.AlertState, chatID string) *model.AlertMessage {
+	if message, ok := state.Messages[chatID]; ok {
+		return message
+	}
+	return state.Messages[""]
+}
+
+func (l *Lark) trackFiring(ctx context.Context, key string, group alertGroup, channel, messageID, threadID string) error {
+	now := time.Now()
+	_, err := l.repository.UpdateAlertState(ctx, key, func(state *model.AlertState) error {
+		// A group firing again after it resolved starts a new lifecycle.
+		if state.Status != model.AlertStatusFiring {
+			state.FirstFiredAt = now
+			state.NotificationCount = 0
+			state.Silences = nil
+			state.AckedBy = ""
+			state.ResolvedAt = time.Time{}
+			state.Messages = nil
+			state.Alerts = nil
+		}
+		applyGroup(state, group)
+		if state.Messages == nil {
+			state.Messages = make(map[string]*model.AlertMessage)
+		}
+		delete(state.Messages, "")
+
+		// A copy updated in its thread stays with the tenant that posted it.
+		tenant := l.tenants.tenant(TenantFromContext(ctx)).Name
+		if previous, ok := state.Messages[channel]; ok && previous.MessageID == messageID {
+			tenant = previous.Tenant
+		}
+
+		state.Status = model.AlertStatusFiring
+		state.LastFiredAt = now
+		state.NotificationCount++
+		state.Messages[channel] = &model.AlertMessage{
+			ChatID:    channel,
+			MessageID: messageID,
+			ThreadID:  threadID,
+			Status:    model.AlertStatusFiring,
+			SentAt:    now,
+			Tenant:    tenant,
+		}
+		return nil
+	})
+	return err
+}
+
+// trackResolved marks the copies in the given chats, by chat ID with their
+// thread ID, as resolved. The group resolves once every copy has.
+func (l *Lark) trackResolved(ctx context.Context, key string, group alertGroup, threadIDs map[string]string) error {
+	now := time.Now()
+	_, err := l.repository.UpdateAlertState(ctx, key, func(state *model.AlertState) error {
+		applyGroup(state, group)
+		for chatID, threadID := range threadIDs {
+			message := chatMessage(state, chatID)
+			if message == nil {
+				continue
+			}
+			message.Status = model.AlertStatusResolved
+			if threadID != "" {
+				message.ThreadID = threadID
+			}
+		}
+
+		for _, message := range state.Messages {
+			if message.Status != model.AlertStatusResolved {
+				return nil
+			}
+		}
+		state.Status = model.AlertStatusResolved
+		state.ResolvedAt = now
+		return nil
+	})
+	return err
+}
+
+// RecordSilence records the silences created for a tracked alert and posts
+// text in the thread of every copy of the alert, except the message the
+// silence was created from. alertID is the group key of the card, or its
+// alert_id for cards posted before group keys.
+func (l *Lark) RecordSilence(ctx context.Context, alertID string, silences []*model.AlertSilence, createdBy, sourceMessageID, text string) error {
+	if len(silences) == 0 {
+		return nil
+	}
+
+	key := alertKey(alertID)
+	if _, err := l.repository.GetAlertState(ctx, key); err != nil {
+		if errors.Is(err, pkg.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	state, err := l.repository.UpdateAlertState(ctx, key, func(state *model.AlertState) error {
+		state.Silences = mergeSilences(state.Silences, silences)
+		state.AckedBy = createdBy
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, message := range state.Messages {
+		if message.MessageID == sourceMessageID || message.Status == model.AlertStatusResolved {
+			continue
+		}
+		if err := l.SendResponseCreatedSilence(messageContext(ctx, message), message.MessageID, message.ChatID, text); err != nil {
+			l.logger.WarnContext(ctx, "failed to send silence response to chat",
+				slog.String("alert_id", key),
+				slog.String("chat_id", message.ChatID),
+				slog.String("message_id", message.MessageID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	return nil
+}
+
+// mergeSilences adds the silences to the tracked ones, replacing those
+// they were extended from.
+func mergeSilences(tracked, silences []*model.AlertSilence) []*model.AlertSilence {
+	merged := make([]*model.AlertSilence, 0, len(tracked)+len(silences))
+	for _, silence := range tracked {
+		replaced := slices.ContainsFunc(silences, func(other *model.AlertSilence) bool {
+			return other.ID == silence.ID || other.Replaces == silence.ID
+		})
+		if !replaced {
+			merged = append(merged, silence)
+		}
+	}
+	return append(merged, silences...)
+}
@@ -0,0 +1,249 @@
+package lark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	lark "github.com/larksuite/oapi-sdk-go/v3"
+	larkcore "github.com/larksuite/oapi-sdk-go/v3/core"
+	larkevent "github.com/larksuite/oapi-sdk-go/v3/event"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+)
+
+// Domains of the Open API, any other domain is its base URL.
+const (
+	DomainFeishu    = "feishu"
+	DomainLarksuite = "larksuite"
+)
+
+// DefaultTenant is the name of the tenant configured without tenants.
+const DefaultTenant = "default"
+
+// ErrChatNotAllowed is returned for a notification to a chat its tenant
+// does not post to.
+var ErrChatNotAllowed = errors.New("chat is not allowed for the tenant")
+
+// Tenant is a Lark app, the callbacks it receives and the chats it posts
+// to.
+type Tenant struct {
+	Name      string
+	AppID     string
+	AppSecret string
+	// Domain is DomainFeishu, the default, DomainLarksuite or the base
+	// URL of the Open API.
+	Domain string
+
+	// VerificationToken and EncryptKey are those of the app's callbacks.
+	VerificationToken string
+	EncryptKey        string
+
+	// Chats are the chats the tenant posts to, any chat when empty.
+	Chats []string
+}
+
+// AllowsChat tells whether the tenant posts to the chat.
+func (t Tenant) AllowsChat(chatID string) bool {
+	return len(t.Chats) == 0 || slices.Contains(t.Chats, chatID)
+}
+
+// Decrypt decrypts the encrypt field of a callback sent to the tenant.
+func (t Tenant) Decrypt(encrypted string) ([]byte, error) {
+	if t.EncryptKey == "" {
+		return nil, fmt.Errorf("tenant %s has no encrypt key", t.Name)
+	}
+	body, err := larkevent.EventDecrypt(encrypted, t.EncryptKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt callback of tenant %s: %w", t.Name, err)
+	}
+	// A wrong key yields garbage rather than an error.
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("failed to decrypt callback of tenant %s: wrong encrypt key", t.Name)
+	}
+	return body, nil
+}
+
+func (t Tenant) baseURL() string {
+	switch t.Domain {
+	case "", DomainFeishu:
+		return lark.FeishuBaseUrl
+	case DomainLarksuite:
+		return lark.LarkBaseUrl
+	default:
+		return strings.TrimSuffix(t.Domain, "/")
+	}
+}
+
+// Tenants holds a Lark client per tenant. The first tenant is the default
+// for notifications and callbacks that name none.
+type Tenants struct {
+	tenants []Tenant
+	clients map[string]*lark.Client
+}
+
+var _ pkg.HealthChecker = (*Tenants)(nil)
+
+// NewTenants creates the client of every tenant. httpClient sends their
+// requests, nil for the default client.
+func NewTenants(tenants []Tenant, httpClient larkcore.HttpClient) (*Tenants, error) {
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("at least one lark tenant is required")
+	}
+
+	t := &Tenants{
+		tenants: slices.Clone(tenants),
+		clients: make(map[string]*lark.Client, len(tenants)),
+	}
+	_, dryRun := httpClient.(*DryRun)
+	appIDs := make(map[string]bool, len(tenants))
+	for i := range t.tenants {
+		tenant := &t.tenants[i]
+		if tenant.Name == "" {
+			return nil, fmt.Errorf("lark tenant name is required")
+		}
+		if _, ok := t.clients[tenant.Name]; ok {
+			return nil, fmt.Errorf("lark tenant %s is defined more than once", tenant.Name)
+		}
+		if tenant.AppID != "" && appIDs[tenant.AppID] {
+			return nil, fmt.Errorf("lark tenant %s: app %s belongs to another tenant", tenant.Name, tenant.AppID)
+		}
+		appIDs[tenant.AppID] = true
+		if dryRun && tenant.AppID == "" {
+			// The SDK wants credentials, which a dry run does not need.
+			tenant.AppID, tenant.AppSecret = dryRunAppID, dryRunAppID
+		}
+
+		options := []lark.ClientOptionFunc{
+			lark.WithEnableTokenCache(true),
+			lark.WithOpenBaseUrl(tenant.baseURL()),
+		}
+		if httpClient != nil {
+			options = append(options, lark.WithHttpClient(httpClient))
+		}
+		t.clients[tenant.Name] = lark.NewClient(
+			tenant.AppID,
+			tenant.AppSecret,
+			options...,
+		)
+	}
+	return t, nil
+}
+
+// Default is the name of the default tenant.
+func (t *Tenants) Default() string {
+	return t.tenants[0].Name
+}
+
+// Names lists the tenants, the default one first.
+func (t *Tenants) Names() []string {
+	names := make([]string, 0, len(t.tenants))
+	for _, tenant := range t.tenants {
+		names = append(names, tenant.Name)
+	}
+	return names
+}
+
+// Get returns the named tenant.
+func (t *Tenants) Get(name string) (Tenant, bool) {
+	return t.find(func(tenant Tenant) bool { return tenant.Name == name })
+}
+
+// ByAppID returns the tenant of the Lark app.
+func (t *Tenants) ByAppID(appID string) (Tenant, bool) {
+	return t.find(func(tenant Tenant) bool { return appID != "" && tenant.AppID == appID })
+}
+
+// ByVerificationToken returns the tenant whose callbacks carry the token.
+func (t *Tenants) ByVerificationToken(token string) (Tenant, bool) {
+	return t.find(func(tenant Tenant) bool { return token != "" && tenant.VerificationToken == token })
+}
+
+// ForChat returns the first tenant listing the chat, or the default one.
+func (t *Tenants) ForChat(chatID string) Tenant {
+	if tenant, ok := t.find(func(tenant Tenant) bool { return slices.Contains(tenant.Chats, chatID) }); ok {
+		return tenant
+	}
+	return t.tenants[0]
+}
+
+// Decrypt decrypts the encrypt field of a callback that names no tenant,
+// with the encrypt key of each tenant in turn.
+func (t *Tenants) Decrypt(encrypted string) ([]byte, Tenant, error) {
+	for _, tenant := range t.tenants {
+		if tenant.EncryptKey == "" {
+			continue
+		}
+		if body, err := tenant.Decrypt(encrypted); err == nil {
+			return body, tenant, nil
+		}
+	}
+	return nil, Tenant{}, fmt.Errorf("no tenant encrypt key decrypts the callback")
+}
+
+func (t *Tenants) find(match func(Tenant) bool) (Tenant, bool) {
+	for _, tenant := range t.tenants {
+		if match(tenant) {
+			return tenant, true
+		}
+	}
+	return Tenant{}, false
+}
+
+// tenant returns the named tenant. Unknown names, e.g. recorded before a
+// tenant was removed or left empty before there were tenants, get the
+// default one.
+func (t *Tenants) tenant(name string) Tenant {
+	if tenant, ok := t.Get(name); ok {
+		return tenant
+	}
+	return t.tenants[0]
+}
+
+// client returns the client of the named tenant, as tenant does.
+func (t *Tenants) client(name string) *lark.Client {
+	return t.clients[t.tenant(name).Name]
+}
+
+// CheckHealth fetches a tenant access token of every tenant, which fails
+// when Lark is unreachable or the app credentials are rejected. The token
+// cache is bypassed so a revoked secret is noticed.
+func (t *Tenants) CheckHealth(ctx context.Context) error {
+	var errs []error
+	for _, tenant := range t.tenants {
+		start := time.Now()
+		resp, err := t.clients[tenant.Name].GetTenantAccessTokenBySelfBuiltApp(ctx, &larkcore.SelfBuiltTenantAccessTokenReq{
+			AppID:     tenant.AppID,
+			AppSecret: tenant.AppSecret,
+		})
+		if err != nil {
+			o11y.ObserveLarkRequest(larkEndpointTenantToken, start, larkCodeError)
+			errs = append(errs, fmt.Errorf("tenant %s: failed to get tenant access token: %w", tenant.Name, err))
+			continue
+		}
+		o11y.ObserveLarkRequest(larkEndpointTenantToken, start, strconv.Itoa(resp.Code))
+		if !resp.Success() {
+			errs = append(errs, fmt.Errorf("tenant %s: failed to get tenant access token: %d %s", tenant.Name, resp.Code, resp.Msg))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx for the requests of the named tenant.
+func WithTenant(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, name)
+}
+
+// TenantFromContext returns the tenant of ctx, empty for the default one.
+func TenantFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
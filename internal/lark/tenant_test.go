@@ -0,0 +1,162 @@
+package lark
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// encryptCallback encrypts the body as Lark does with the encrypt key of
+// an app.
+func encryptCallback(t *testing.T, key, body string) string {
+	t.Helper()
+	secret := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(secret[:])
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	padding := aes.BlockSize - len(body)%aes.BlockSize
+	plain := append([]byte(body), make([]byte, padding)...)
+	for i := len(body); i < len(plain); i++ {
+		plain[i] = byte(padding)
+	}
+	// A fixed IV keeps the result of a wrong key the same on every run.
+	out := make([]byte, aes.BlockSize+len(plain))
+	copy(out, "0123456789abcdef")
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], plain)
+	return base64.StdEncoding.EncodeToString(out)
+}
+
+func newTestTenants(t *testing.T) *Tenants {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tenants, err := NewTenants([]Tenant{
+		{Name: "payments", AppID: "cli_payments", VerificationToken: "token-payments", EncryptKey: "key-payments"},
+		{Name: "logistics", AppID: "cli_logistics", VerificationToken: "token-logistics", EncryptKey: "key-logistics", Chats: []string{"oc_logistics", "oc_shared"}},
+		{Name: "ops", AppID: "cli_ops", Chats: []string{"oc_ops", "oc_shared"}},
+	}, &DryRun{output: io.Discard, logger: logger})
+	if err != nil {
+		t.Fatalf("NewTenants() error = %v", err)
+	}
+	return tenants
+}
+
+func TestTenantsLookup(t *testing.T) {
+	tenants := newTestTenants(t)
+
+	tests := []struct {
+		name   string
+		lookup func() (Tenant, bool)
+		want   string
+	}{
+		{"name", func() (Tenant, bool) { return tenants.Get("logistics") }, "logistics"},
+		{"unknown name", func() (Tenant, bool) { return tenants.Get("billing") }, ""},
+		{"app id", func() (Tenant, bool) { return tenants.ByAppID("cli_ops") }, "ops"},
+		{"unknown app id", func() (Tenant, bool) { return tenants.ByAppID("cli_billing") }, ""},
+		{"empty app id", func() (Tenant, bool) { return tenants.ByAppID("") }, ""},
+		{"verification token", func() (Tenant, bool) { return tenants.ByVerificationToken("token-logistics") }, "logistics"},
+		// ops has no token, which must not match callbacks without one.
+		{"empty verification token", func() (Tenant, bool) { return tenants.ByVerificationToken("") }, ""},
+		{"chat", func() (Tenant, bool) { return tenants.ForChat("oc_ops"), true }, "ops"},
+		{"chat of several tenants", func() (Tenant, bool) { return tenants.ForChat("oc_shared"), true }, "logistics"},
+		{"chat of no tenant", func() (Tenant, bool) { return tenants.ForChat("oc_other"), true }, "payments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant, ok := tt.lookup()
+			if tenant.Name != tt.want || ok != (tt.want != "") {
+				t.Errorf("got %q (%v), want %q", tenant.Name, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestTenantsDecrypt(t *testing.T) {
+	tenants := newTestTenants(t)
+	body := `{"header":{"app_id":"cli_logistics","token":"token-logistics"}}`
+
+	tests := []struct {
+		name       string
+		encrypted  string
+		wantTenant string
+		wantErr    bool
+	}{
+		{"key of the first tenant", encryptCallback(t, "key-payments", body), "payments", false},
+		{"key of a later tenant", encryptCallback(t, "key-logistics", body), "logistics", false},
+		{"key of no tenant", encryptCallback(t, "key-billing", body), "", true},
+		{"not base64", "not base64!", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decrypted, tenant, err := tenants.Decrypt(tt.encrypted)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decrypt() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tenant.Name != tt.wantTenant {
+				t.Errorf("Decrypt() tenant = %q, want %q", tenant.Name, tt.wantTenant)
+			}
+			if !tt.wantErr && string(decrypted) != body {
+				t.Errorf("Decrypt() = %s, want %s", decrypted, body)
+			}
+		})
+	}
+
+	ops, _ := tenants.Get("ops")
+	if _, err := ops.Decrypt(encryptCallback(t, "key-payments", body)); err == nil {
+		t.Error("Decrypt() of a tenant without encrypt key error = nil, want an error")
+	}
+	payments, _ := tenants.Get("payments")
+	if _, err := payments.Decrypt(encryptCallback(t, "key-logistics", body)); err == nil {
+		t.Error("Decrypt() with the key of another tenant error = nil, want an error")
+	}
+}
+
+func TestCheckChat(t *testing.T) {
+	l := &Lark{tenants: newTestTenants(t)}
+
+	tests := []struct {
+		name    string
+		tenant  string
+		chat    string
+		allowed bool
+	}{
+		{"tenant without chats", "payments", "oc_anything", true},
+		{"listed chat", "logistics", "oc_logistics", true},
+		{"chat of another tenant", "logistics", "oc_ops", false},
+		{"default tenant", "", "oc_anything", true},
+		// Unknown tenants, e.g. removed since, post as the default one.
+		{"unknown tenant", "billing", "oc_anything", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := l.checkChat(WithTenant(context.Background(), tt.tenant), tt.chat)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Fatalf("checkChat() error = %v, want allowed %v", err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrChatNotAllowed) {
+				t.Errorf("checkChat() error = %v, want ErrChatNotAllowed", err)
+			}
+		})
+	}
+}
+
+func TestNotifyAlertmanagerChatNotAllowed(t *testing.T) {
+	l, requests := newTestLark(t)
+	l.tenants = newTestTenants(t)
+
+	err := l.NotifyAlertmanager(WithTenant(context.Background(), "ops"), model.AlertmanagerWebhook{Status: "firing"}, "oc_payments")
+	if !errors.Is(err, ErrChatNotAllowed) {
+		t.Fatalf("NotifyAlertmanager() error = %v, want ErrChatNotAllowed", err)
+	}
+	if requests.Len() != 0 {
+		t.Errorf("sent requests %s, want none", requests)
+	}
+}
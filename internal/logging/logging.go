@@ -0,0 +1,98 @@
+// Package logging builds the app logger: leveled, as text or JSON, with the
+// trace of each record's context and with sensitive values redacted.
+//
+// Log lines about the same thing use the same field names: alert_id,
+// chat_id, message_id, tenant (the Lark app), operator (the email of the
+// user acting on a card), lark_log_id (the log ID of a Lark response) and
+// error.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	DefaultLevel  = "info"
+	DefaultFormat = FormatText
+)
+
+type Config struct {
+	Level  string
+	Format string
+	// RedactFields are the keys, besides the built-in sensitive ones,
+	// whose values are redacted.
+	RedactFields []string
+	// Secrets are redacted wherever they appear, e.g. inside an error.
+	Secrets []string
+}
+
+// New returns the logger, and the level it logs at, which can be changed
+// while it runs.
+func New(config Config, output io.Writer) (*slog.Logger, *slog.LevelVar, error) {
+	level := &slog.LevelVar{}
+	if err := SetLevel(level, config.Level); err != nil {
+		return nil, nil, err
+	}
+
+	options := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: newRedactor(config.RedactFields, config.Secrets).replace,
+	}
+	var handler slog.Handler
+	switch config.Format {
+	case "", FormatText:
+		handler = slog.NewTextHandler(output, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(output, options)
+	default:
+		return nil, nil, fmt.Errorf("unknown log format %q", config.Format)
+	}
+	return slog.New(tracing.NewLogHandler(handler)), level, nil
+}
+
+// ParseLevel parses debug, info, warn or error, in any case.
+func ParseLevel(value string) (slog.Level, error) {
+	if value == "" {
+		value = DefaultLevel
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", value)
+	}
+	return level, nil
+}
+
+// SetLevel changes level to value, e.g. on a configuration reload.
+func SetLevel(level *slog.LevelVar, value string) error {
+	parsed, err := ParseLevel(value)
+	if err != nil {
+		return err
+	}
+	level.Set(parsed)
+	return nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying logger, for the code handling
+// the same request to log with its fields.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// Redacted replaces the value of a sensitive field.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are redacted in any key containing them, e.g. app_secret
+// or verification_token.
+var sensitiveKeys = []string{
+	"token",
+	"secret",
+	"password",
+	"authorization",
+	"cookie",
+	"api_key",
+	"apikey",
+}
+
+// minSecretLength keeps short secrets, e.g. from a test setup, from
+// redacting every occurrence of a common word.
+const minSecretLength = 6
+
+type redactor struct {
+	fields  map[string]bool
+	secrets *strings.Replacer
+}
+
+func newRedactor(fields, secrets []string) *redactor {
+	r := &redactor{
+		fields: make(map[string]bool, len(fields)),
+	}
+	for _, field := range fields {
+		r.fields[strings.ToLower(strings.TrimSpace(field))] = true
+	}
+
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength {
+			pairs = append(pairs, secret, Redacted)
+		}
+	}
+	if len(pairs) > 0 {
+		r.secrets = strings.NewReplacer(pairs...)
+	}
+	return r
+}
+
+// replace is the ReplaceAttr of the handler. It is also called with the
+// message, so secrets in a message are redacted too.
+func (r *redactor) replace(groups []string, attr slog.Attr) slog.Attr {
+	if r.sensitive(attr.Key) {
+		return slog.String(attr.Key, Redacted)
+	}
+	if r.secrets == nil {
+		return attr
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		attr.Value = slog.StringValue(r.secrets.Replace(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			attr.Value = slog.StringValue(r.secrets.Replace(err.Error()))
+		}
+	}
+	return attr
+}
+
+func (r *redactor) sensitive(key string) bool {
+	key = strings.ToLower(key)
+	if r.fields[key] {
+		return true
+	}
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
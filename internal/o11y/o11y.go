@@ -2,6 +2,7 @@ package o11y
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -57,3 +58,174 @@ func increaseEventCounter(eventName string, success bool) {
 	totalEventCounter.WithLabelValues(eventName, strconv.FormatBool(success)).Inc()
 	totalEventCounter.WithLabelValues(eventName, strconv.FormatBool(!success)).Add(0)
 }
+
+var (
+	larkRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "lark_request_duration_seconds",
+			Help:      "Duration of Lark API requests",
+		},
+		[]string{"endpoint"},
+	)
+	larkRequestCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "lark_requests_total",
+			Help:      "Total Lark API requests by response code, error when no response was received",
+		},
+		[]string{"endpoint", "code"},
+	)
+	alertmanagerRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "alertmanager_request_duration_seconds",
+			Help:      "Duration of Alertmanager API requests, per peer attempt",
+		},
+		[]string{"operation"},
+	)
+	alertmanagerRequestCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "alertmanager_requests_total",
+			Help:      "Total Alertmanager API requests, per peer attempt",
+		},
+		[]string{"operation", "success"},
+	)
+	callbackActionCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "callback_actions_total",
+			Help:      "Total card actions by type and outcome",
+		},
+		[]string{"action", "outcome"},
+	)
+	callbacksInFlight = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "callbacks_in_flight",
+			Help:      "Card actions being processed after their response",
+		},
+	)
+	silenceCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "silences_total",
+			Help:      "Total silences created or extended from Lark",
+		},
+		[]string{"alertmanager", "type"},
+	)
+	silenceDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "silence_duration_seconds",
+			Help:      "Duration of the silences created from Lark, or the time added to the silences extended",
+			Buckets: []float64{
+				(30 * time.Minute).Seconds(),
+				time.Hour.Seconds(),
+				(3 * time.Hour).Seconds(),
+				(6 * time.Hour).Seconds(),
+				(12 * time.Hour).Seconds(),
+				(24 * time.Hour).Seconds(),
+				(3 * 24 * time.Hour).Seconds(),
+				(7 * 24 * time.Hour).Seconds(),
+				(30 * 24 * time.Hour).Seconds(),
+			},
+		},
+		[]string{"type"},
+	)
+	repositoryDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "repository_operation_duration_seconds",
+			Help:      "Duration of alert state operations",
+		},
+		[]string{"backend", "operation"},
+	)
+	repositoryCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "repository_operations_total",
+			Help:      "Total alert state operations",
+		},
+		[]string{"backend", "operation", "success"},
+	)
+	retryCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "retries_total",
+			Help:      "Total retries, e.g. alert state updates conflicting with another replica or Alertmanager failovers",
+		},
+		[]string{"component"},
+	)
+	notifyDelay = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "katulampa",
+			Subsystem: "larkapp",
+			Name:      "notify_delay_seconds",
+			Help:      "Delay between an alert firing or resolving and it being posted to Lark",
+			Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		},
+		[]string{"status"},
+	)
+)
+
+// ObserveLarkRequest records a Lark API request started at start. code is
+// the Lark code of the response, or "error" when none was received.
+func ObserveLarkRequest(endpoint string, start time.Time, code string) {
+	larkRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	larkRequestCounter.WithLabelValues(endpoint, code).Inc()
+}
+
+// ObserveAlertmanagerRequest records one attempt of an Alertmanager API
+// request started at start.
+func ObserveAlertmanagerRequest(operation string, start time.Time, success bool) {
+	alertmanagerRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	alertmanagerRequestCounter.WithLabelValues(operation, strconv.FormatBool(success)).Inc()
+}
+
+func IncreaseCallbackActionCounter(action, outcome string) {
+	callbackActionCounter.WithLabelValues(action, outcome).Inc()
+}
+
+// TrackCallback counts a card action in flight until the returned function
+// is called.
+func TrackCallback() func() {
+	callbacksInFlight.Inc()
+	return callbacksInFlight.Dec
+}
+
+// ObserveSilence records a silence created or extended, with type "created"
+// or "extended", and its duration or the time added to it.
+func ObserveSilence(alertmanager, silenceType string, duration time.Duration) {
+	silenceCounter.WithLabelValues(alertmanager, silenceType).Inc()
+	silenceDuration.WithLabelValues(silenceType).Observe(duration.Seconds())
+}
+
+// ObserveRepositoryOperation records an alert state operation started at
+// start.
+func ObserveRepositoryOperation(backend, operation string, start time.Time, err error) {
+	repositoryDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+	repositoryCounter.WithLabelValues(backend, operation, strconv.FormatBool(err == nil)).Inc()
+}
+
+func IncreaseRetryCounter(component string) {
+	retryCounter.WithLabelValues(component).Inc()
+}
+
+// ObserveNotifyDelay records how long after firing or resolving, at since,
+// an alert was posted.
+func ObserveNotifyDelay(status string, since time.Time) {
+	notifyDelay.WithLabelValues(status).Observe(time.Since(since).Seconds())
+}
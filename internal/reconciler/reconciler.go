@@ -0,0 +1,232 @@
+// Package reconciler resolves tracked alert groups whose resolved
+// notification was missed, and cleans up old alert states.
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+const (
+	DefaultInterval  = 5 * time.Minute
+	DefaultMinAge    = 10 * time.Minute
+	DefaultRetention = 72 * time.Hour
+)
+
+// errNotClaimed discards a state update another replica, or a new
+// notification, already made.
+var errNotClaimed = errors.New("already claimed")
+
+type Config struct {
+	// Interval between two reconciliations.
+	Interval time.Duration
+	// MinAge is how long after its last notification a group is left
+	// alone, so alerts that were just sent are not reconciled.
+	MinAge time.Duration
+	// Retention is how long resolved groups are kept.
+	Retention time.Duration
+}
+
+type Reconciler struct {
+	config        Config
+	repository    pkg.Repository
+	notifier      pkg.Notifier
+	alertmanagers *alertmanager.Registry
+
+	logger *slog.Logger
+}
+
+func New(
+	config Config,
+
+	repository pkg.Repository,
+	notifier pkg.Notifier,
+	alertmanagers *alertmanager.Registry,
+
+	logger *slog.Logger,
+) *Reconciler {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.MinAge <= 0 {
+		config.MinAge = DefaultMinAge
+	}
+	if config.Retention <= 0 {
+		config.Retention = DefaultRetention
+	}
+
+	return &Reconciler{
+		config:        config,
+		repository:    repository,
+		notifier:      notifier,
+		alertmanagers: alertmanagers,
+		logger:        logger,
+	}
+}
+
+// Run reconciles every interval until ctx is done.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reconcile(ctx)
+		}
+	}
+}
+
+func (r *Reconciler) reconcile(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "reconciler.reconcile")
+	defer span.End()
+
+	states, err := r.repository.ListAlertStates(ctx)
+	if err != nil {
+		r.logger.WarnContext(ctx, "failed to list alert states",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	now := time.Now()
+	for _, state := range states {
+		switch {
+		case state.Status == model.AlertStatusResolved && now.Sub(state.ResolvedAt) > r.config.Retention:
+			r.cleanup(ctx, state)
+		case state.Status == model.AlertStatusFiring && now.Sub(state.LastFiredAt) > r.config.MinAge:
+			r.reconcileFiring(ctx, state)
+		}
+	}
+}
+
+// cleanup deletes the resolved state, unless the group fired again since
+// it was listed, e.g. on another replica.
+func (r *Reconciler) cleanup(ctx context.Context, state *model.AlertState) {
+	r.logger.DebugContext(ctx, "deleting resolved alert state past retention",
+		slog.String("alert_id", state.Key),
+	)
+	_, err := r.repository.DeleteAlertStateIf(ctx, state.Key, func(current *model.AlertState) bool {
+		return current.Status == model.AlertStatusResolved && current.ResolvedAt.Equal(state.ResolvedAt)
+	})
+	if err != nil {
+		r.logger.WarnContext(ctx, "failed to delete alert state",
+			slog.String("alert_id", state.Key),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// reconcileFiring marks the tracked alerts that are no longer active in
+// Alertmanager resolved, and resolves the group in Lark once none is left.
+func (r *Reconciler) reconcileFiring(ctx context.Context, state *model.AlertState) {
+	logger := r.logger.With(
+		slog.String("alert_id", state.Key),
+	)
+
+	vanished, remaining, err := r.vanishedAlerts(ctx, state)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to look up alerts, skipping reconciliation",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	if len(vanished) == 0 {
+		return
+	}
+
+	now := time.Now()
+	_, err = r.repository.UpdateAlertState(ctx, state.Key, func(current *model.AlertState) error {
+		// A notification arrived since the state was listed.
+		if current.Status != model.AlertStatusFiring || !current.LastFiredAt.Equal(state.LastFiredAt) {
+			return errNotClaimed
+		}
+		for _, fingerprint := range vanished {
+			if alert, ok := current.Alerts[fingerprint]; ok {
+				alert.Status = model.AlertStatusResolved
+				alert.UpdatedAt = now
+			}
+		}
+		if remaining > 0 {
+			return nil
+		}
+		current.Status = model.AlertStatusResolved
+		current.ResolvedAt = now
+		for _, message := range current.Messages {
+			message.Status = model.AlertStatusResolved
+		}
+		return nil
+	})
+	if errors.Is(err, errNotClaimed) {
+		return
+	}
+	if err != nil {
+		logger.WarnContext(ctx, "failed to save reconciled alert state",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	if remaining > 0 {
+		return
+	}
+
+	logger.InfoContext(ctx, "resolving alert group whose resolved notification was missed")
+	if err := r.notifier.SendResolvedInferred(ctx, state); err != nil {
+		logger.WarnContext(ctx, "failed to post inferred resolution",
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// vanishedAlerts returns the firing alerts of the group that Alertmanager
+// no longer has, and how many firing alerts it still has.
+func (r *Reconciler) vanishedAlerts(ctx context.Context, state *model.AlertState) ([]string, int, error) {
+	routes := make(map[string][]string)
+	for fingerprint, alert := range state.Alerts {
+		if alert.Status != model.AlertStatusFiring {
+			continue
+		}
+		name := alert.Alertmanager
+		if name == "" {
+			name = r.alertmanagers.Default()
+		}
+		routes[name] = append(routes[name], fingerprint)
+	}
+	// States tracked before group keys only know their fingerprints.
+	if len(state.Alerts) == 0 && !strings.HasPrefix(state.Key, "group:") {
+		routes[r.alertmanagers.Default()] = strings.Split(state.Key, ",")
+	}
+
+	vanished := make([]string, 0)
+	remaining := 0
+	for name, fingerprints := range routes {
+		alerts, err := r.alertmanagers.Get(name).FindAlertsByFingerprints(ctx, fingerprints, alertmanager.GroupFilter(state))
+		if err != nil {
+			return nil, 0, err
+		}
+		found := make(map[string]bool, len(alerts))
+		for _, alert := range alerts {
+			if alert.Fingerprint != nil {
+				found[*alert.Fingerprint] = true
+			}
+		}
+		for _, fingerprint := range fingerprints {
+			if found[fingerprint] {
+				remaining++
+			} else {
+				vanished = append(vanished, fingerprint)
+			}
+		}
+	}
+	return vanished, remaining, nil
+}
@@ -0,0 +1,138 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// racingRepository lets a notification land right after the states were
+// listed, as another replica would.
+type racingRepository struct {
+	pkg.Repository
+	afterList func()
+}
+
+func (r *racingRepository) ListAlertStates(ctx context.Context) ([]*model.AlertState, error) {
+	states, err := r.Repository.ListAlertStates(ctx)
+	r.afterList()
+	return states, err
+}
+
+func TestCleanup(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	resolvedAt := time.Now().Add(-2 * DefaultRetention)
+
+	tests := []struct {
+		name        string
+		afterList   func(t *testing.T, repo pkg.Repository)
+		wantDeleted bool
+	}{
+		{
+			name:        "resolved past retention",
+			afterList:   func(t *testing.T, repo pkg.Repository) {},
+			wantDeleted: true,
+		},
+		{
+			name: "fired again after listing",
+			afterList: func(t *testing.T, repo pkg.Repository) {
+				_, err := repo.UpdateAlertState(context.Background(), "group", func(state *model.AlertState) error {
+					state.Status = model.AlertStatusFiring
+					state.LastFiredAt = time.Now()
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("failed to update alert state: %v", err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := repository.New(repository.Config{Backend: repository.BackendMemory}, logger)
+			if err != nil {
+				t.Fatalf("failed to create repository: %v", err)
+			}
+			_, err = repo.UpdateAlertState(context.Background(), "group", func(state *model.AlertState) error {
+				state.Status = model.AlertStatusResolved
+				state.ResolvedAt = resolvedAt
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("failed to update alert state: %v", err)
+			}
+
+			r := New(Config{}, &racingRepository{
+				Repository: repo,
+				afterList:  func() { tt.afterList(t, repo) },
+			}, nil, nil, logger)
+			r.reconcile(context.Background())
+
+			_, err = repo.GetAlertState(context.Background(), "group")
+			if deleted := errors.Is(err, pkg.ErrNotFound); deleted != tt.wantDeleted {
+				t.Errorf("state deleted = %v (%v), want %v", deleted, err, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestReconcileFiring(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `[{"fingerprint":"fp1","labels":{"alertname":"HighErrorRate"},"annotations":{},"receivers":[{"name":"lark"}],"startsAt":"2024-01-01T00:00:00Z","endsAt":"2024-01-01T01:00:00Z","updatedAt":"2024-01-01T00:00:00Z","status":{"state":"active","silencedBy":[],"inhibitedBy":[]}}]`)
+	}))
+	defer server.Close()
+	alertmanagers, err := alertmanager.NewRegistry([]alertmanager.Endpoint{
+		{Name: "default", Client: alertmanager.Config{Peers: []string{server.URL}}},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	repo, err := repository.New(repository.Config{Backend: repository.BackendMemory}, logger)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+	firedAt := time.Now().Add(-2 * DefaultMinAge)
+	state, err := repo.UpdateAlertState(context.Background(), "group", func(state *model.AlertState) error {
+		state.Status = model.AlertStatusFiring
+		state.LastFiredAt = firedAt
+		state.Receiver = "lark"
+		state.Alerts = map[string]*model.TrackedAlert{
+			"fp1": {Status: model.AlertStatusFiring, Labels: map[string]string{"alertname": "HighErrorRate", "pod": "a"}},
+			"fp2": {Status: model.AlertStatusFiring, Labels: map[string]string{"alertname": "HighErrorRate", "pod": "b"}},
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update alert state: %v", err)
+	}
+
+	New(Config{}, repo, nil, alertmanagers, logger).reconcileFiring(context.Background(), state)
+
+	// Only the alerts of the group are asked for.
+	if filter := query["filter"]; !slices.Equal(filter, []string{`alertname="HighErrorRate"`}) || query.Get("receiver") != "^lark$" {
+		t.Errorf("alerts looked up with filter %q and receiver %q, want the labels and receiver of the group", filter, query.Get("receiver"))
+	}
+	state, err = repo.GetAlertState(context.Background(), "group")
+	if err != nil {
+		t.Fatalf("failed to get alert state: %v", err)
+	}
+	if state.Status != model.AlertStatusFiring || state.Alerts["fp1"].Status != model.AlertStatusFiring || state.Alerts["fp2"].Status != model.AlertStatusResolved {
+		t.Errorf("state is %s with fp1 %s and fp2 %s, want firing with fp2 resolved", state.Status, state.Alerts["fp1"].Status, state.Alerts["fp2"].Status)
+	}
+}
@@ -0,0 +1,377 @@
+// Package reminder watches the silences created from Lark and reminds the
+// alert threads before they expire.
+package reminder
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/prometheus/alertmanager/api/v2/models"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+const (
+	DefaultInterval = time.Minute
+	DefaultLead     = 15 * time.Minute
+)
+
+// errNotClaimed discards a state update another replica already made.
+var errNotClaimed = errors.New("already claimed")
+
+type Config struct {
+	// Interval between two checks of the tracked silences.
+	Interval time.Duration
+	// Lead is how long before expiry the reminder is posted.
+	Lead time.Duration
+	// AllSilences also tracks silences made outside Lark that silence the
+	// alerts of a firing group.
+	AllSilences bool
+}
+
+type Reminder struct {
+	config        Config
+	repository    pkg.Repository
+	notifier      pkg.Notifier
+	alertmanagers *alertmanager.Registry
+
+	logger *slog.Logger
+}
+
+func New(
+	config Config,
+
+	repository pkg.Repository,
+	notifier pkg.Notifier,
+	alertmanagers *alertmanager.Registry,
+
+	logger *slog.Logger,
+) *Reminder {
+	if config.Interval <= 0 {
+		config.Interval = DefaultInterval
+	}
+	if config.Lead <= 0 {
+		config.Lead = DefaultLead
+	}
+
+	return &Reminder{
+		config:        config,
+		repository:    repository,
+		notifier:      notifier,
+		alertmanagers: alertmanagers,
+		logger:        logger,
+	}
+}
+
+// Run checks the tracked silences every interval until ctx is done.
+func (r *Reminder) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reminder) check(ctx context.Context) {
+	ctx, span := tracing.Start(ctx, "reminder.check")
+	defer span.End()
+
+	states, err := r.repository.ListAlertStates(ctx)
+	if err != nil {
+		r.logger.WarnContext(ctx, "failed to list alert states",
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	lists := &silenceLists{reminder: r}
+	for _, state := range states {
+		if r.config.AllSilences && state.Status == model.AlertStatusFiring {
+			r.discoverSilences(ctx, lists, state)
+		}
+		for _, silence := range state.Silences {
+			r.checkSilence(ctx, lists, state.Key, silence)
+		}
+	}
+}
+
+// silenceLists lists the silences of each Alertmanager once per check,
+// instead of getting every tracked silence on its own.
+type silenceLists struct {
+	reminder *Reminder
+	silences map[string]map[string]*models.GettableSilence
+	errs     map[string]error
+}
+
+// get returns the silences of the Alertmanager by ID.
+func (l *silenceLists) get(ctx context.Context, name string, am alertmanager.Alertmanager) (map[string]*models.GettableSilence, error) {
+	if silences, ok := l.silences[name]; ok {
+		return silences, nil
+	}
+	if err, ok := l.errs[name]; ok {
+		return nil, err
+	}
+
+	list, err := am.ListSilences(ctx)
+	if err != nil {
+		l.reminder.logger.WarnContext(ctx, "failed to list silences",
+			slog.String("alertmanager", name),
+			slog.String("error", err.Error()),
+		)
+		if l.errs == nil {
+			l.errs = make(map[string]error)
+		}
+		l.errs[name] = err
+		return nil, err
+	}
+	silences := make(map[string]*models.GettableSilence, len(list))
+	for _, silence := range list {
+		if silence.ID != nil {
+			silences[*silence.ID] = silence
+		}
+	}
+	if l.silences == nil {
+		l.silences = make(map[string]map[string]*models.GettableSilence)
+	}
+	l.silences[name] = silences
+	return silences, nil
+}
+
+// checkSilence posts the reminder once the silence is within the lead of
+// its end, and the note once it expired. Each is claimed in the state
+// first, so only one replica posts it. Silences that no longer exist, or
+// whose Alertmanager was removed, are untracked.
+func (r *Reminder) checkSilence(ctx context.Context, lists *silenceLists, key string, tracked *model.AlertSilence) {
+	logger := r.logger.With(
+		slog.String("alert_id", key),
+		slog.String("silence_id", tracked.ID),
+	)
+
+	name := tracked.Alertmanager
+	if name == "" {
+		name = r.alertmanagers.Default()
+	}
+	am, ok := r.alertmanagers.Lookup(name)
+	if !ok {
+		logger.InfoContext(ctx, "untracking silence of an unknown alertmanager",
+			slog.String("alertmanager", name),
+		)
+		r.untrack(ctx, key, tracked.ID)
+		return
+	}
+	silences, err := lists.get(ctx, name, am)
+	if err != nil {
+		return
+	}
+	current, ok := silences[tracked.ID]
+	if !ok {
+		// The peer that answered may not have the silence gossiped yet,
+		// so its absence is confirmed by ID.
+		current, err = am.GetSilence(ctx, tracked.ID)
+		if alertmanager.IsSilenceNotFound(err) {
+			logger.InfoContext(ctx, "untracking silence that no longer exists")
+			r.untrack(ctx, key, tracked.ID)
+			return
+		}
+		if err != nil {
+			logger.WarnContext(ctx, "failed to get silence",
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+	}
+	if current.Status == nil || current.Status.State == nil || current.EndsAt == nil {
+		return
+	}
+	endsAt := time.Time(*current.EndsAt)
+
+	switch *current.Status.State {
+	case models.SilenceStatusStateExpired:
+		silence, err := r.claim(ctx, key, tracked.ID, func(state *model.AlertState, index int) bool {
+			state.Silences = slices.Delete(state.Silences, index, index+1)
+			return true
+		})
+		if err != nil || silence == nil {
+			return
+		}
+		silence.EndsAt = endsAt
+		if err := r.notifier.SendSilenceExpired(ctx, key, silence); err != nil {
+			logger.WarnContext(ctx, "failed to post silence expiry",
+				slog.String("error", err.Error()),
+			)
+		}
+	case models.SilenceStatusStateActive:
+		if time.Until(endsAt) > r.config.Lead {
+			return
+		}
+		silence, err := r.claim(ctx, key, tracked.ID, func(state *model.AlertState, index int) bool {
+			silence := state.Silences[index]
+			if silence.RemindedFor.Equal(endsAt) {
+				return false
+			}
+			silence.RemindedFor = endsAt
+			silence.EndsAt = endsAt
+			return true
+		})
+		if err != nil || silence == nil {
+			return
+		}
+		if err := r.notifier.SendSilenceReminder(ctx, key, silence); err != nil {
+			logger.WarnContext(ctx, "failed to post silence reminder",
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+// untrack stops tracking the silence without posting about it.
+func (r *Reminder) untrack(ctx context.Context, key, silenceID string) {
+	r.claim(ctx, key, silenceID, func(state *model.AlertState, index int) bool {
+		state.Silences = slices.Delete(state.Silences, index, index+1)
+		return true
+	})
+}
+
+// claim applies update to the tracked silence and returns it, or nil when
+// update declined or the silence is no longer tracked.
+func (r *Reminder) claim(ctx context.Context, key, silenceID string, update func(state *model.AlertState, index int) bool) (*model.AlertSilence, error) {
+	var claimed *model.AlertSilence
+	_, err := r.repository.UpdateAlertState(ctx, key, func(state *model.AlertState) error {
+		index := slices.IndexFunc(state.Silences, func(silence *model.AlertSilence) bool {
+			return silence.ID == silenceID
+		})
+		if index < 0 {
+			return errNotClaimed
+		}
+		claimed = state.Silences[index]
+		if !update(state, index) {
+			return errNotClaimed
+		}
+		return nil
+	})
+	if errors.Is(err, errNotClaimed) {
+		return nil, nil
+	}
+	if err != nil {
+		r.logger.WarnContext(ctx, "failed to update alert state",
+			slog.String("alert_id", key),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// discoverSilences tracks the active silences of the group's firing alerts
+// that were not made from Lark.
+func (r *Reminder) discoverSilences(ctx context.Context, lists *silenceLists, state *model.AlertState) {
+	routes := make(map[string][]string)
+	for fingerprint, alert := range state.Alerts {
+		if alert.Status != model.AlertStatusFiring {
+			continue
+		}
+		name := alert.Alertmanager
+		if name == "" {
+			name = r.alertmanagers.Default()
+		}
+		routes[name] = append(routes[name], fingerprint)
+	}
+
+	tracked := make(map[string]bool, len(state.Silences))
+	for _, silence := range state.Silences {
+		tracked[silence.ID] = true
+	}
+
+	discovered := make([]*model.AlertSilence, 0)
+	for name, fingerprints := range routes {
+		am, ok := r.alertmanagers.Lookup(name)
+		if !ok {
+			continue
+		}
+		filter := alertmanager.GroupFilter(state)
+		active := true
+		filter.Active = &active
+		alerts, err := am.FindAlertsByFingerprints(ctx, fingerprints, filter)
+		if err != nil {
+			r.logger.WarnContext(ctx, "failed to look up alerts",
+				slog.String("alert_id", state.Key),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		silences, err := lists.get(ctx, name, am)
+		if err != nil {
+			continue
+		}
+		for _, alert := range alerts {
+			if alert.Status == nil {
+				continue
+			}
+			for _, silenceID := range alert.Status.SilencedBy {
+				if tracked[silenceID] {
+					continue
+				}
+				tracked[silenceID] = true
+
+				silence, ok := silences[silenceID]
+				if !ok || !isActive(silence) {
+					continue
+				}
+				discovered = append(discovered, &model.AlertSilence{
+					ID:           silenceID,
+					Alertmanager: name,
+					CreatedBy:    *silence.CreatedBy,
+					StartsAt:     time.Time(*silence.StartsAt),
+					EndsAt:       time.Time(*silence.EndsAt),
+				})
+			}
+		}
+	}
+	if len(discovered) == 0 {
+		return
+	}
+
+	updated, err := r.repository.UpdateAlertState(ctx, state.Key, func(current *model.AlertState) error {
+		// The state expired since it was listed.
+		if current.Status == "" {
+			return errNotClaimed
+		}
+		for _, silence := range discovered {
+			if !slices.ContainsFunc(current.Silences, func(other *model.AlertSilence) bool {
+				return other.ID == silence.ID
+			}) {
+				current.Silences = append(current.Silences, silence)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errNotClaimed) {
+		return
+	}
+	if err != nil {
+		r.logger.WarnContext(ctx, "failed to track discovered silences",
+			slog.String("alert_id", state.Key),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	state.Silences = updated.Silences
+}
+
+func isActive(silence *models.GettableSilence) bool {
+	return silence.Status != nil && silence.Status.State != nil &&
+		*silence.Status.State == models.SilenceStatusStateActive &&
+		silence.CreatedBy != nil && silence.StartsAt != nil && silence.EndsAt != nil
+}
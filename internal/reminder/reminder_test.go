@@ -0,0 +1,188 @@
+package reminder
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+const (
+	activeID   = "a0000000-0000-0000-0000-000000000001"
+	expiredID  = "a0000000-0000-0000-0000-000000000002"
+	laterID    = "a0000000-0000-0000-0000-000000000003"
+	goneID     = "a0000000-0000-0000-0000-000000000004"
+	laggingID  = "a0000000-0000-0000-0000-000000000005"
+	removedID  = "a0000000-0000-0000-0000-000000000006"
+	externalID = "a0000000-0000-0000-0000-000000000007"
+)
+
+// recordingNotifier records the silences it is asked to post about.
+type recordingNotifier struct {
+	pkg.Notifier
+
+	mu        sync.Mutex
+	reminders []string
+	expired   []string
+}
+
+func (n *recordingNotifier) SendSilenceReminder(ctx context.Context, key string, silence *model.AlertSilence) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.reminders = append(n.reminders, key+"/"+silence.ID)
+	return nil
+}
+
+func (n *recordingNotifier) SendSilenceExpired(ctx context.Context, key string, silence *model.AlertSilence) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.expired = append(n.expired, key+"/"+silence.ID)
+	return nil
+}
+
+// testAlertmanager answers the silence and alert requests of the reminder,
+// counting them by path.
+type testAlertmanager struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func newTestAlertmanager(t *testing.T) *httptest.Server {
+	now := time.Now()
+	silence := func(id, state string, endsAt time.Time) map[string]any {
+		return map[string]any{
+			"id":        id,
+			"status":    map[string]any{"state": state},
+			"updatedAt": now.Add(-time.Hour).Format(time.RFC3339),
+			"comment":   "maintenance",
+			"createdBy": "alice",
+			"startsAt":  now.Add(-time.Hour).Format(time.RFC3339),
+			"endsAt":    endsAt.Format(time.RFC3339),
+			"matchers":  []map[string]any{{"name": "alertname", "value": "HighErrorRate", "isRegex": false}},
+		}
+	}
+	listed := []map[string]any{
+		silence(activeID, "active", now.Add(5*time.Minute)),
+		silence(expiredID, "expired", now.Add(-time.Minute)),
+		silence(laterID, "active", now.Add(2*time.Hour)),
+		silence(externalID, "active", now.Add(time.Hour)),
+	}
+	// The silence the listing peer has not received yet.
+	lagging := silence(laggingID, "active", now.Add(5*time.Minute))
+
+	am := &testAlertmanager{requests: make(map[string]int)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		am.mu.Lock()
+		am.requests[r.URL.Path]++
+		am.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/api/v2/silences":
+			json.NewEncoder(w).Encode(listed)
+		case r.URL.Path == "/api/v2/silence/"+laggingID:
+			json.NewEncoder(w).Encode(lagging)
+		case strings.HasPrefix(r.URL.Path, "/api/v2/silence/"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/api/v2/alerts":
+			io.WriteString(w, `[{"fingerprint":"fp1","labels":{"alertname":"HighErrorRate"},"annotations":{},"receivers":[{"name":"lark"}],"startsAt":"2024-01-01T00:00:00Z","endsAt":"2024-01-01T01:00:00Z","updatedAt":"2024-01-01T00:00:00Z","status":{"state":"suppressed","silencedBy":["`+externalID+`"],"inhibitedBy":[]}}]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		am.mu.Lock()
+		defer am.mu.Unlock()
+		if am.requests["/api/v2/silences"] != 1 {
+			t.Errorf("silences listed %d times, want once per check", am.requests["/api/v2/silences"])
+		}
+		for path, count := range am.requests {
+			if strings.HasPrefix(path, "/api/v2/silence/") && path != "/api/v2/silence/"+goneID && path != "/api/v2/silence/"+laggingID {
+				t.Errorf("silence %s got %d times, want it taken from the list", path, count)
+			}
+		}
+	})
+	return server
+}
+
+func TestCheck(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := newTestAlertmanager(t)
+	alertmanagers, err := alertmanager.NewRegistry([]alertmanager.Endpoint{
+		{Name: "default", Client: alertmanager.Config{Peers: []string{server.URL}}},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	repo, err := repository.New(repository.Config{Backend: repository.BackendMemory}, logger)
+	if err != nil {
+		t.Fatalf("failed to create repository: %v", err)
+	}
+
+	states := map[string][]*model.AlertSilence{
+		"group:1": {
+			{ID: activeID, Alertmanager: "default"},
+			{ID: expiredID},
+		},
+		"group:2": {
+			{ID: laterID, Alertmanager: "default"},
+			{ID: goneID, Alertmanager: "default"},
+			{ID: laggingID, Alertmanager: "default"},
+			{ID: removedID, Alertmanager: "removed"},
+		},
+	}
+	for key, silences := range states {
+		_, err := repo.UpdateAlertState(context.Background(), key, func(state *model.AlertState) error {
+			state.Status = model.AlertStatusFiring
+			state.Silences = silences
+			state.Alerts = map[string]*model.TrackedAlert{
+				"fp1": {Status: model.AlertStatusFiring, Alertmanager: "default"},
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to update alert state: %v", err)
+		}
+	}
+
+	notifier := &recordingNotifier{}
+	New(Config{AllSilences: true}, repo, notifier, alertmanagers, logger).check(context.Background())
+
+	slices.Sort(notifier.reminders)
+	if want := []string{"group:1/" + activeID, "group:2/" + laggingID}; !slices.Equal(notifier.reminders, want) {
+		t.Errorf("reminders = %q, want %q", notifier.reminders, want)
+	}
+	if want := []string{"group:1/" + expiredID}; !slices.Equal(notifier.expired, want) {
+		t.Errorf("expiry notes = %q, want %q", notifier.expired, want)
+	}
+
+	wantTracked := map[string][]string{
+		"group:1": {activeID, externalID},
+		"group:2": {laterID, laggingID, externalID},
+	}
+	for key, want := range wantTracked {
+		state, err := repo.GetAlertState(context.Background(), key)
+		if err != nil {
+			t.Fatalf("failed to get alert state %s: %v", key, err)
+		}
+		var tracked []string
+		for _, silence := range state.Silences {
+			tracked = append(tracked, silence.ID)
+		}
+		if !slices.Equal(tracked, want) {
+			t.Errorf("%s tracks %q, want %q", key, tracked, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// newFile keeps alert states in memory and writes them to a single JSON file
+// on every change, so a single binary keeps its state across restarts
+// without operating Redis. Writes go to a temporary file which is renamed
+// over the previous one, so a crash never leaves a half written file.
+func newFile(
+	path string,
+	ttl time.Duration,
+
+	logger *slog.Logger,
+) (*Memory, error) {
+	memory := newMemory(ttl, logger)
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		logger.Info("alert state file does not exist yet, starting empty",
+			slog.String("path", path),
+		)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read alert state file: %w", err)
+	default:
+		if err := json.Unmarshal(data, &memory.entries); err != nil {
+			return nil, fmt.Errorf("failed to decode alert state file: %w", err)
+		}
+		now := time.Now()
+		for key, entry := range memory.entries {
+			if now.After(entry.ExpiresAt) {
+				delete(memory.entries, key)
+			}
+		}
+		logger.Info("loaded alert states from file",
+			slog.String("path", path),
+			slog.Int("count", len(memory.entries)),
+		)
+	}
+
+	memory.persist = func(entries map[string]memoryEntry) error {
+		return writeFileAtomic(path, entries)
+	}
+	return memory, nil
+}
+
+func writeFileAtomic(path string, entries map[string]memoryEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,101 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository/repositorytest"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+func TestFile(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T, ttl time.Duration) pkg.Repository {
+		return newRepository(t, repository.Config{
+			Backend:  repository.BackendFile,
+			TTL:      ttl,
+			FilePath: filepath.Join(t.TempDir(), "alert_states.json"),
+		})
+	})
+}
+
+func TestFileSurvivesRestart(t *testing.T) {
+	config := repository.Config{
+		Backend:  repository.BackendFile,
+		TTL:      time.Hour,
+		FilePath: filepath.Join(t.TempDir(), "alert_states.json"),
+	}
+
+	_, err := newRepository(t, config).UpdateAlertState(context.Background(), "fp", func(state *model.AlertState) error {
+		state.Status = model.AlertStatusFiring
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update alert state: %v", err)
+	}
+
+	state, err := newRepository(t, config).GetAlertState(context.Background(), "fp")
+	if err != nil {
+		t.Fatalf("failed to get alert state after restart: %v", err)
+	}
+	if state.Status != model.AlertStatusFiring {
+		t.Errorf("expected status %s after restart, got %s", model.AlertStatusFiring, state.Status)
+	}
+}
+
+func TestFileKeepsStatesOnWriteFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("failed to create state directory: %v", err)
+	}
+	r := newRepository(t, repository.Config{
+		Backend:  repository.BackendFile,
+		TTL:      time.Hour,
+		FilePath: filepath.Join(dir, "alert_states.json"),
+	})
+	ctx := context.Background()
+	_, err := r.UpdateAlertState(ctx, "fp", func(state *model.AlertState) error {
+		state.Status = model.AlertStatusFiring
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update alert state: %v", err)
+	}
+
+	// Writes fail from now on.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("failed to remove state directory: %v", err)
+	}
+	_, err = r.UpdateAlertState(ctx, "fp", func(state *model.AlertState) error {
+		state.Status = model.AlertStatusResolved
+		return nil
+	})
+	if err == nil {
+		t.Fatal("UpdateAlertState() error = nil, want the write failure")
+	}
+	if _, err := r.UpdateAlertState(ctx, "new", func(state *model.AlertState) error { return nil }); err == nil {
+		t.Fatal("UpdateAlertState() error = nil for a new state, want the write failure")
+	}
+	if err := r.DeleteAlertState(ctx, "fp"); err == nil {
+		t.Fatal("DeleteAlertState() error = nil, want the write failure")
+	}
+	if deleted, err := r.DeleteAlertStateIf(ctx, "fp", func(*model.AlertState) bool { return true }); err == nil || deleted {
+		t.Fatalf("DeleteAlertStateIf() = %v, %v, want the write failure", deleted, err)
+	}
+
+	state, err := r.GetAlertState(ctx, "fp")
+	if err != nil {
+		t.Fatalf("failed to get alert state after the failed writes: %v", err)
+	}
+	if state.Status != model.AlertStatusFiring {
+		t.Errorf("status = %s after a failed write, want %s", state.Status, model.AlertStatusFiring)
+	}
+	if _, err := r.GetAlertState(ctx, "new"); !errors.Is(err, pkg.ErrNotFound) {
+		t.Errorf("GetAlertState() error = %v for a state that failed to be written, want not found", err)
+	}
+}
@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// instrumented records the duration and outcome of every operation of the
+// wrapped repository, and traces it.
+type instrumented struct {
+	repository pkg.Repository
+	backend    string
+}
+
+var (
+	_ pkg.Repository    = (*instrumented)(nil)
+	_ pkg.HealthChecker = (*instrumented)(nil)
+	_ LegacyMigrator    = (*instrumented)(nil)
+)
+
+func (i *instrumented) start(ctx context.Context, operation, key string) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{
+		attribute.String("repository.backend", i.backend),
+	}
+	if key != "" {
+		attributes = append(attributes, attribute.String("alert_id", key))
+	}
+	return tracing.Start(ctx, "repository."+operation, trace.WithAttributes(attributes...))
+}
+
+func (i *instrumented) GetAlertState(ctx context.Context, key string) (*model.AlertState, error) {
+	ctx, span := i.start(ctx, "get", key)
+	start := time.Now()
+	state, err := i.repository.GetAlertState(ctx, key)
+	// A state that is not tracked is an answer, not a failure.
+	if errors.Is(err, pkg.ErrNotFound) {
+		o11y.ObserveRepositoryOperation(i.backend, "get", start, nil)
+		span.SetAttributes(attribute.Bool("repository.found", false))
+		tracing.End(span, nil)
+		return state, err
+	}
+	o11y.ObserveRepositoryOperation(i.backend, "get", start, err)
+	tracing.End(span, err)
+	return state, err
+}
+
+func (i *instrumented) UpdateAlertState(ctx context.Context, key string, update func(state *model.AlertState) error) (*model.AlertState, error) {
+	ctx, span := i.start(ctx, "update", key)
+	start := time.Now()
+	state, err := i.repository.UpdateAlertState(ctx, key, update)
+	o11y.ObserveRepositoryOperation(i.backend, "update", start, err)
+	tracing.End(span, err)
+	return state, err
+}
+
+func (i *instrumented) DeleteAlertState(ctx context.Context, key string) error {
+	ctx, span := i.start(ctx, "delete", key)
+	start := time.Now()
+	err := i.repository.DeleteAlertState(ctx, key)
+	o11y.ObserveRepositoryOperation(i.backend, "delete", start, err)
+	tracing.End(span, err)
+	return err
+}
+
+func (i *instrumented) DeleteAlertStateIf(ctx context.Context, key string, check func(state *model.AlertState) bool) (bool, error) {
+	ctx, span := i.start(ctx, "delete", key)
+	start := time.Now()
+	deleted, err := i.repository.DeleteAlertStateIf(ctx, key, check)
+	o11y.ObserveRepositoryOperation(i.backend, "delete", start, err)
+	span.SetAttributes(attribute.Bool("repository.deleted", deleted))
+	tracing.End(span, err)
+	return deleted, err
+}
+
+func (i *instrumented) ListAlertStates(ctx context.Context) ([]*model.AlertState, error) {
+	ctx, span := i.start(ctx, "list", "")
+	start := time.Now()
+	states, err := i.repository.ListAlertStates(ctx)
+	o11y.ObserveRepositoryOperation(i.backend, "list", start, err)
+	span.SetAttributes(attribute.Int("repository.states", len(states)))
+	tracing.End(span, err)
+	return states, err
+}
+
+// CheckHealth forwards to backends that depend on a server; the others
+// are always healthy.
+func (i *instrumented) CheckHealth(ctx context.Context) error {
+	if checker, ok := i.repository.(pkg.HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
+
+// MigrateLegacyMessageIDs forwards to the backends older versions stored
+// message IDs in; the others have none.
+func (i *instrumented) MigrateLegacyMessageIDs(ctx context.Context) (int, error) {
+	if migrator, ok := i.repository.(LegacyMigrator); ok {
+		return migrator.MigrateLegacyMessageIDs(ctx)
+	}
+	return 0, nil
+}
+
+func (i *instrumented) Close() error {
+	if closer, ok := i.repository.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
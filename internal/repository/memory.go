@@ -0,0 +1,195 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// sweepInterval is how often expired states are dropped from memory. Reads
+// never return expired states in between.
+const sweepInterval = time.Minute
+
+type memoryEntry struct {
+	Data      json.RawMessage `json:"data"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// Memory keeps alert states in process memory. It is meant for development
+// and single replica installs, states are lost on restart unless persist is
+// set.
+type Memory struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	ttl       time.Duration
+	lastSweep time.Time
+
+	// persist is called with every change while the lock is held.
+	persist func(entries map[string]memoryEntry) error
+
+	logger *slog.Logger
+}
+
+var _ pkg.Repository = (*Memory)(nil)
+
+func newMemory(
+	ttl time.Duration,
+
+	logger *slog.Logger,
+) *Memory {
+	return &Memory{
+		entries:   make(map[string]memoryEntry),
+		ttl:       ttl,
+		lastSweep: time.Now(),
+		logger:    logger,
+	}
+}
+
+func (m *Memory) GetAlertState(ctx context.Context, key string) (*model.AlertState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.get(key)
+}
+
+func (m *Memory) UpdateAlertState(ctx context.Context, key string, update func(state *model.AlertState) error) (*model.AlertState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, err := m.get(key)
+	if errors.Is(err, pkg.ErrNotFound) {
+		state, err = &model.AlertState{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := update(state); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	m.sweep()
+	err = m.change(key, &memoryEntry{
+		Data:      data,
+		ExpiresAt: time.Now().Add(m.ttl),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (m *Memory) DeleteAlertState(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.change(key, nil)
+}
+
+func (m *Memory) DeleteAlertStateIf(ctx context.Context, key string, check func(state *model.AlertState) bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, err := m.get(key)
+	if errors.Is(err, pkg.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !check(state) {
+		return false, nil
+	}
+	if err := m.change(key, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *Memory) ListAlertStates(ctx context.Context) ([]*model.AlertState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make([]*model.AlertState, 0, len(m.entries))
+	for key := range m.entries {
+		state, err := m.get(key)
+		if errors.Is(err, pkg.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// get returns a copy of the state, so callers never share it.
+func (m *Memory) get(key string) (*model.AlertState, error) {
+	entry, ok := m.entries[key]
+	if !ok || time.Now().After(entry.ExpiresAt) {
+		return nil, pkg.ErrNotFound
+	}
+
+	return decodeAlertState(entry.Data)
+}
+
+func (m *Memory) sweep() {
+	now := time.Now()
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, entry := range m.entries {
+		if now.After(entry.ExpiresAt) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// change sets the entry of the key, or deletes it when entry is nil, and
+// persists the states. The change is undone when they cannot be persisted,
+// so memory never holds a state the file lost.
+func (m *Memory) change(key string, entry *memoryEntry) error {
+	previous, existed := m.entries[key]
+	if entry == nil {
+		delete(m.entries, key)
+	} else {
+		m.entries[key] = *entry
+	}
+
+	if err := m.save(); err != nil {
+		if existed {
+			m.entries[key] = previous
+		} else {
+			delete(m.entries, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *Memory) save() error {
+	if m.persist == nil {
+		return nil
+	}
+	if err := m.persist(m.entries); err != nil {
+		return fmt.Errorf("failed to persist alert states: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package repository_test
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository/repositorytest"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+)
+
+func TestMemory(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T, ttl time.Duration) pkg.Repository {
+		return newRepository(t, repository.Config{
+			Backend: repository.BackendMemory,
+			TTL:     ttl,
+		})
+	})
+}
+
+// newRepository returns the repository of the config, closed when the test
+// ends.
+func newRepository(t *testing.T, config repository.Config) pkg.Repository {
+	t.Helper()
+
+	r, err := repository.New(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("failed to create %s repository: %v", config.Backend, err)
+	}
+	t.Cleanup(func() {
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+	return r
+}
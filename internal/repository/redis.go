@@ -1,46 +1,367 @@
 package repository
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"math/rand/v2"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-redis/redis"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
 )
 
+const (
+	// keyPrefix namespaces every key written by the app.
+	keyPrefix = "katulampa:larkapp:"
+
+	// maxUpdateRetries bounds how often an update is retried when another
+	// replica changes the same alert concurrently. Retries back off from
+	// minRetryBackoff to maxRetryBackoff, with jitter so that the writers
+	// spread out.
+	maxUpdateRetries = 50
+	minRetryBackoff  = 2 * time.Millisecond
+	maxRetryBackoff  = 100 * time.Millisecond
+
+	// scanCount is the number of keys asked for per SCAN call.
+	scanCount = 100
+)
+
+// errTooManyConflicts is returned when other replicas kept changing the
+// alert state through every retry.
+var errTooManyConflicts = errors.New("too many concurrent updates")
+
 type Redis struct {
-	client *redis.Client
+	client redis.UniversalClient
+	ttl    time.Duration
 
 	logger *slog.Logger
 }
 
-var _ pkg.Repository = (*Redis)(nil)
+var (
+	_ pkg.Repository    = (*Redis)(nil)
+	_ pkg.HealthChecker = (*Redis)(nil)
+	_ LegacyMigrator    = (*Redis)(nil)
+)
 
 func newRedis(
-	address, password string, db int,
+	config RedisConfig,
+	ttl time.Duration,
 
 	logger *slog.Logger,
-) pkg.Repository {
+) (pkg.Repository, error) {
+	client, err := newRedisClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail at startup rather than on the first page.
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	logger.Info("connected to redis",
+		slog.String("mode", config.mode()),
+	)
+
 	return &Redis{
-		client: redis.NewClient(&redis.Options{
-			Addr:     address,
-			Password: password,
-			DB:       db,
-		}),
+		client: client,
+		ttl:    ttl,
 		logger: logger,
+	}, nil
+}
+
+func alertStateKey(key string) string {
+	return keyPrefix + "alert:" + key
+}
+
+func (r *Redis) GetAlertState(ctx context.Context, key string) (*model.AlertState, error) {
+	data, err := r.client.Get(alertStateKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, pkg.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeAlertState(data)
+}
+
+func (r *Redis) UpdateAlertState(ctx context.Context, key string, update func(state *model.AlertState) error) (*model.AlertState, error) {
+	var state *model.AlertState
+	txf := func(tx *redis.Tx) error {
+		data, err := tx.Get(alertStateKey(key)).Bytes()
+		switch {
+		case errors.Is(err, redis.Nil):
+			state = &model.AlertState{Key: key}
+		case err != nil:
+			return err
+		default:
+			if state, err = decodeAlertState(data); err != nil {
+				return err
+			}
+		}
+
+		if err := update(state); err != nil {
+			return err
+		}
+		data, err = json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(alertStateKey(key), data, r.ttl)
+			return nil
+		})
+		return err
+	}
+
+	if err := r.watch(ctx, key, "redis_update", txf); err != nil {
+		return nil, fmt.Errorf("failed to update alert state %s: %w", key, err)
+	}
+	return state, nil
+}
+
+func (r *Redis) DeleteAlertState(ctx context.Context, key string) error {
+	return r.client.Del(alertStateKey(key)).Err()
+}
+
+// DeleteAlertStateIf deletes the state when check approves it, watching the
+// key so a state changed since the check is checked again.
+func (r *Redis) DeleteAlertStateIf(ctx context.Context, key string, check func(state *model.AlertState) bool) (bool, error) {
+	var deleted bool
+	txf := func(tx *redis.Tx) error {
+		deleted = false
+		data, err := tx.Get(alertStateKey(key)).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		state, err := decodeAlertState(data)
+		if err != nil {
+			return err
+		}
+		if !check(state) {
+			return nil
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(alertStateKey(key))
+			return nil
+		})
+		deleted = err == nil
+		return err
+	}
+
+	if err := r.watch(ctx, key, "redis_delete", txf); err != nil {
+		return false, fmt.Errorf("failed to delete alert state %s: %w", key, err)
 	}
+	return deleted, nil
 }
 
-// TODO: add logging here
-func (r *Redis) SetMessageID(key string, value string) error {
-	return r.client.Set(key, value, 0).Err()
+// watch runs the transaction watching the alert key, and runs it again
+// after a backoff while other replicas change the key concurrently.
+func (r *Redis) watch(ctx context.Context, key, operation string, txf func(tx *redis.Tx) error) error {
+	backoff := minRetryBackoff
+	for range maxUpdateRetries {
+		err := r.client.Watch(txf, alertStateKey(key))
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		o11y.IncreaseRetryCounter(operation)
+		r.logger.Debug("alert state changed concurrently, retrying",
+			slog.String("alert_id", key),
+			slog.String("operation", operation),
+		)
+
+		timer := time.NewTimer(rand.N(backoff) + 1)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+	return errTooManyConflicts
+}
+
+// ListAlertStates scans the alert keys of every node, so it is meant for
+// background jobs rather than request paths.
+func (r *Redis) ListAlertStates(ctx context.Context) ([]*model.AlertState, error) {
+	states := make([]*model.AlertState, 0)
+	scan := func(client *redis.Client) error {
+		iter := client.Scan(0, alertStateKey("*"), scanCount).Iterator()
+		for iter.Next() {
+			data, err := client.Get(iter.Val()).Bytes()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			state, err := decodeAlertState(data)
+			if err != nil {
+				r.logger.Warn("skipping undecodable alert state",
+					slog.String("key", iter.Val()),
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+			states = append(states, state)
+		}
+		return iter.Err()
+	}
+
+	if err := r.scanNodes(scan); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// scanNodes runs scan with every master in cluster mode, one at a time, and
+// with the client otherwise.
+func (r *Redis) scanNodes(scan func(client *redis.Client) error) error {
+	var mu sync.Mutex
+	switch client := r.client.(type) {
+	case *redis.ClusterClient:
+		return client.ForEachMaster(func(node *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return scan(node)
+		})
+	case *redis.Client:
+		return scan(client)
+	default:
+		return fmt.Errorf("scanning keys is not supported by %T", r.client)
+	}
 }
 
-func (r *Redis) GetMessageID(key string) (string, error) {
-	return r.client.Get(key).Result()
+// legacyKeyPattern matches the keys older versions stored message IDs
+// under: the fingerprints of a callback ID, with or without the trailing
+// comma.
+var legacyKeyPattern = regexp.MustCompile(`^[0-9a-f]{16}(,[0-9a-f]{16})*,?$`)
+
+// MigrateLegacyMessageIDs moves the message IDs saved by older versions,
+// which stored them as plain strings under the bare callback ID and without
+// expiry, into alert states, and deletes the old keys. It scans every key,
+// so it is run once from the state migrate command rather than on lookups.
+func (r *Redis) MigrateLegacyMessageIDs(ctx context.Context) (int, error) {
+	migrated := 0
+	scan := func(client *redis.Client) error {
+		iter := client.Scan(0, "*", scanCount).Iterator()
+		for iter.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !legacyKeyPattern.MatchString(iter.Val()) {
+				continue
+			}
+			ok, err := r.migrateLegacyMessageID(iter.Val())
+			if err != nil {
+				return err
+			}
+			if ok {
+				migrated++
+			}
+		}
+		return iter.Err()
+	}
+
+	err := r.scanNodes(scan)
+	return migrated, err
 }
 
-func (r *Redis) DeleteMessageID(key string) error {
-	return r.client.Del(key).Err()
+// migrateLegacyMessageID moves the message ID of a legacy key into the
+// state of its alert, unless the alert already has one, and deletes the
+// key. Keys that do not hold a message ID are left alone.
+func (r *Redis) migrateLegacyMessageID(legacyKey string) (bool, error) {
+	if kind, err := r.client.Type(legacyKey).Result(); err != nil || kind != "string" {
+		return false, err
+	}
+	messageID, err := r.client.Get(legacyKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !strings.HasPrefix(messageID, "om_") {
+		return false, nil
+	}
+
+	key := strings.TrimSuffix(legacyKey, ",")
+	logger := r.logger.With(
+		slog.String("alert_id", key),
+		slog.String("message_id", messageID),
+	)
+
+	// The chat of legacy messages is unknown, so the copy is tracked under
+	// an empty chat ID and used for whichever chat asks first.
+	state := &model.AlertState{
+		Key:    key,
+		Status: model.AlertStatusFiring,
+		Messages: map[string]*model.AlertMessage{
+			"": {
+				MessageID: messageID,
+				Status:    model.AlertStatusFiring,
+			},
+		},
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return false, err
+	}
+	created, err := r.client.SetNX(alertStateKey(key), data, r.ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	if created {
+		logger.Info("migrated legacy message id to alert state")
+	} else {
+		logger.Info("alert state already exists, dropping legacy message id")
+	}
+	if err := r.client.Del(legacyKey).Err(); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+func decodeAlertState(data []byte) (*model.AlertState, error) {
+	var state model.AlertState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode alert state: %w", err)
+	}
+	return &state, nil
+}
+
+// CheckHealth pings redis, every master in cluster mode.
+func (r *Redis) CheckHealth(ctx context.Context) error {
+	var err error
+	switch client := r.client.(type) {
+	case *redis.ClusterClient:
+		err = client.ForEachMaster(func(node *redis.Client) error {
+			return node.WithContext(ctx).Ping().Err()
+		})
+	case *redis.Client:
+		err = client.WithContext(ctx).Ping().Err()
+	default:
+		err = client.Ping().Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to ping redis: %w", err)
+	}
+	return nil
 }
 
 func (r *Redis) Close() error {
@@ -0,0 +1,206 @@
+package repository
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type RedisConfig struct {
+	// URL is a redis:// or rediss:// URL of a single node. It selects the
+	// database itself, so DB must be left 0, and a password in the URL wins
+	// over Password.
+	URL      string
+	Address  string
+	Password string
+	DB       int
+
+	// SentinelMasterName and SentinelAddresses select a Sentinel managed
+	// master.
+	SentinelMasterName string
+	SentinelAddresses  []string
+
+	// ClusterAddresses is the seed list of a Redis Cluster.
+	ClusterAddresses []string
+
+	TLS RedisTLSConfig
+
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolTimeout  time.Duration
+	IdleTimeout  time.Duration
+}
+
+type RedisTLSConfig struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func (c RedisConfig) mode() string {
+	switch {
+	case len(c.ClusterAddresses) > 0:
+		return "cluster"
+	case c.SentinelMasterName != "":
+		return "sentinel"
+	default:
+		return "single"
+	}
+}
+
+func (c RedisConfig) validate() error {
+	switch c.mode() {
+	case "cluster":
+		if c.SentinelMasterName != "" {
+			return fmt.Errorf("redis cluster and sentinel are mutually exclusive")
+		}
+	case "sentinel":
+		if len(c.SentinelAddresses) == 0 {
+			return fmt.Errorf("redis sentinel addresses are required with a sentinel master name")
+		}
+	default:
+		if c.URL == "" && c.Address == "" {
+			return fmt.Errorf("redis url or address is required")
+		}
+		if c.URL != "" && c.DB != 0 {
+			return fmt.Errorf("redis db cannot be combined with a url, select the database in the url path")
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("redis tls cert file and key file must be set together")
+	}
+	return nil
+}
+
+func newRedisClient(config RedisConfig) (redis.UniversalClient, error) {
+	options, err := redisOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	switch options := options.(type) {
+	case *redis.ClusterOptions:
+		return redis.NewClusterClient(options), nil
+	case *redis.FailoverOptions:
+		return redis.NewFailoverClient(options), nil
+	default:
+		return redis.NewClient(options.(*redis.Options)), nil
+	}
+}
+
+// redisOptions builds the client options of the mode of the config, a
+// *redis.ClusterOptions, *redis.FailoverOptions or *redis.Options.
+func redisOptions(config RedisConfig) (any, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	address := config.Address
+	if config.URL != "" {
+		options, err := redis.ParseURL(config.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url: %w", err)
+		}
+		address, config.DB = options.Addr, options.DB
+		if options.Password != "" {
+			config.Password = options.Password
+		}
+		if options.TLSConfig != nil {
+			config.TLS.Enabled = true
+			if config.TLS.ServerName == "" {
+				config.TLS.ServerName = options.TLSConfig.ServerName
+			}
+		}
+	}
+
+	tlsConfig, err := newRedisTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.mode() {
+	case "cluster":
+		return &redis.ClusterOptions{
+			Addrs:        config.ClusterAddresses,
+			Password:     config.Password,
+			PoolSize:     config.PoolSize,
+			MinIdleConns: config.MinIdleConns,
+			DialTimeout:  config.DialTimeout,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			PoolTimeout:  config.PoolTimeout,
+			IdleTimeout:  config.IdleTimeout,
+			TLSConfig:    tlsConfig,
+		}, nil
+	case "sentinel":
+		return &redis.FailoverOptions{
+			MasterName:    config.SentinelMasterName,
+			SentinelAddrs: config.SentinelAddresses,
+			Password:      config.Password,
+			DB:            config.DB,
+			PoolSize:      config.PoolSize,
+			MinIdleConns:  config.MinIdleConns,
+			DialTimeout:   config.DialTimeout,
+			ReadTimeout:   config.ReadTimeout,
+			WriteTimeout:  config.WriteTimeout,
+			PoolTimeout:   config.PoolTimeout,
+			IdleTimeout:   config.IdleTimeout,
+			TLSConfig:     tlsConfig,
+		}, nil
+	default:
+		return &redis.Options{
+			Addr:         address,
+			Password:     config.Password,
+			DB:           config.DB,
+			PoolSize:     config.PoolSize,
+			MinIdleConns: config.MinIdleConns,
+			DialTimeout:  config.DialTimeout,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			PoolTimeout:  config.PoolTimeout,
+			IdleTimeout:  config.IdleTimeout,
+			TLSConfig:    tlsConfig,
+		}, nil
+	}
+}
+
+func newRedisTLSConfig(config RedisTLSConfig) (*tls.Config, error) {
+	if !config.Enabled && config.CAFile == "" && config.CertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read redis tls ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in redis tls ca file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load redis tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,169 @@
+package repository
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestRedisOptions(t *testing.T) {
+	tuning := func(config RedisConfig) RedisConfig {
+		config.PoolSize = 20
+		config.MinIdleConns = 2
+		config.DialTimeout = time.Second
+		config.ReadTimeout = 2 * time.Second
+		config.WriteTimeout = 3 * time.Second
+		config.PoolTimeout = 4 * time.Second
+		config.IdleTimeout = time.Minute
+		return config
+	}
+
+	tests := []struct {
+		name    string
+		config  RedisConfig
+		want    any
+		wantTLS string
+		wantErr string
+	}{
+		{
+			name:   "address",
+			config: tuning(RedisConfig{Address: "redis:6379", Password: "secret", DB: 2}),
+			want: &redis.Options{
+				Addr:         "redis:6379",
+				Password:     "secret",
+				DB:           2,
+				PoolSize:     20,
+				MinIdleConns: 2,
+				DialTimeout:  time.Second,
+				ReadTimeout:  2 * time.Second,
+				WriteTimeout: 3 * time.Second,
+				PoolTimeout:  4 * time.Second,
+				IdleTimeout:  time.Minute,
+			},
+		},
+		{
+			name:   "url",
+			config: RedisConfig{URL: "redis://:from-url@redis:6380/3", Password: "secret"},
+			want:   &redis.Options{Addr: "redis:6380", Password: "from-url", DB: 3},
+		},
+		{
+			name:   "url without password",
+			config: RedisConfig{URL: "redis://redis:6380", Password: "secret"},
+			want:   &redis.Options{Addr: "redis:6380", Password: "secret"},
+		},
+		{
+			name:    "rediss url",
+			config:  RedisConfig{URL: "rediss://redis.example.com:6380/1"},
+			want:    &redis.Options{Addr: "redis.example.com:6380", DB: 1},
+			wantTLS: "redis.example.com",
+		},
+		{
+			name:    "url and db",
+			config:  RedisConfig{URL: "redis://redis:6380/3", DB: 4},
+			wantErr: "redis db cannot be combined with a url, select the database in the url path",
+		},
+		{
+			name:    "invalid url",
+			config:  RedisConfig{URL: "http://redis:6380"},
+			wantErr: "invalid redis url: invalid redis URL scheme: http",
+		},
+		{
+			name: "sentinel",
+			config: tuning(RedisConfig{
+				SentinelMasterName: "master",
+				SentinelAddresses:  []string{"sentinel-0:26379", "sentinel-1:26379"},
+				Password:           "secret",
+				DB:                 2,
+			}),
+			want: &redis.FailoverOptions{
+				MasterName:    "master",
+				SentinelAddrs: []string{"sentinel-0:26379", "sentinel-1:26379"},
+				Password:      "secret",
+				DB:            2,
+				PoolSize:      20,
+				MinIdleConns:  2,
+				DialTimeout:   time.Second,
+				ReadTimeout:   2 * time.Second,
+				WriteTimeout:  3 * time.Second,
+				PoolTimeout:   4 * time.Second,
+				IdleTimeout:   time.Minute,
+			},
+		},
+		{
+			name:    "sentinel without addresses",
+			config:  RedisConfig{SentinelMasterName: "master"},
+			wantErr: "redis sentinel addresses are required with a sentinel master name",
+		},
+		{
+			name: "cluster",
+			config: tuning(RedisConfig{
+				ClusterAddresses: []string{"redis-0:6379", "redis-1:6379"},
+				Password:         "secret",
+				TLS:              RedisTLSConfig{Enabled: true, ServerName: "redis.example.com"},
+			}),
+			want: &redis.ClusterOptions{
+				Addrs:        []string{"redis-0:6379", "redis-1:6379"},
+				Password:     "secret",
+				PoolSize:     20,
+				MinIdleConns: 2,
+				DialTimeout:  time.Second,
+				ReadTimeout:  2 * time.Second,
+				WriteTimeout: 3 * time.Second,
+				PoolTimeout:  4 * time.Second,
+				IdleTimeout:  time.Minute,
+			},
+			wantTLS: "redis.example.com",
+		},
+		{
+			name:    "cluster and sentinel",
+			config:  RedisConfig{ClusterAddresses: []string{"redis-0:6379"}, SentinelMasterName: "master"},
+			wantErr: "redis cluster and sentinel are mutually exclusive",
+		},
+		{
+			name:    "nothing",
+			config:  RedisConfig{},
+			wantErr: "redis url or address is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := redisOptions(tt.config)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("redisOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("redisOptions() error = %v", err)
+			}
+
+			serverName := ""
+			switch options := options.(type) {
+			case *redis.Options:
+				if options.TLSConfig != nil {
+					serverName = options.TLSConfig.ServerName
+				}
+				options.TLSConfig = nil
+			case *redis.FailoverOptions:
+				if options.TLSConfig != nil {
+					serverName = options.TLSConfig.ServerName
+				}
+				options.TLSConfig = nil
+			case *redis.ClusterOptions:
+				if options.TLSConfig != nil {
+					serverName = options.TLSConfig.ServerName
+				}
+				options.TLSConfig = nil
+			}
+			if !reflect.DeepEqual(options, tt.want) {
+				t.Errorf("redisOptions() = %+v, want %+v", options, tt.want)
+			}
+			if serverName != tt.wantTLS {
+				t.Errorf("tls server name = %q, want %q", serverName, tt.wantTLS)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package repository_test
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/repository/repositorytest"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// defaultTestRedisDB is the database the test uses unless TEST_REDIS_DB is
+// set, the last one of a default Redis.
+const defaultTestRedisDB = 15
+
+// TestRedis runs against the Redis at TEST_REDIS_ADDRESS, e.g. the one of
+// docker/docker-compose.yaml, in the database TEST_REDIS_DB. The database
+// must hold no alert states, and only the states written by the test are
+// deleted afterwards.
+func TestRedis(t *testing.T) {
+	address := os.Getenv("TEST_REDIS_ADDRESS")
+	if address == "" {
+		t.Skip("TEST_REDIS_ADDRESS is not set")
+	}
+	db := defaultTestRedisDB
+	if value := os.Getenv("TEST_REDIS_DB"); value != "" {
+		var err error
+		if db, err = strconv.Atoi(value); err != nil {
+			t.Fatalf("invalid TEST_REDIS_DB %q: %v", value, err)
+		}
+	}
+	config := repository.Config{
+		Backend: repository.BackendRedis,
+		Redis: repository.RedisConfig{
+			Address:  address,
+			Password: os.Getenv("TEST_REDIS_PASSWORD"),
+			DB:       db,
+		},
+	}
+
+	states, err := newRepository(t, config).ListAlertStates(context.Background())
+	if err != nil {
+		t.Fatalf("failed to list alert states: %v", err)
+	}
+	if len(states) > 0 {
+		t.Fatalf("redis database %d holds %d alert states, use an empty one with TEST_REDIS_DB", db, len(states))
+	}
+
+	repositorytest.Run(t, func(t *testing.T, ttl time.Duration) pkg.Repository {
+		config := config
+		config.TTL = ttl
+		r := &recordingRepository{
+			Repository: newRepository(t, config),
+			keys:       make(map[string]bool),
+		}
+		t.Cleanup(func() {
+			for key := range r.keys {
+				if err := r.DeleteAlertState(context.Background(), key); err != nil {
+					t.Errorf("failed to delete alert state %s: %v", key, err)
+				}
+			}
+		})
+		return r
+	})
+}
+
+// recordingRepository records the keys updated through it, so that the
+// test deletes nothing but its own states.
+type recordingRepository struct {
+	pkg.Repository
+
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (r *recordingRepository) UpdateAlertState(ctx context.Context, key string, update func(state *model.AlertState) error) (*model.AlertState, error) {
+	r.mu.Lock()
+	r.keys[key] = true
+	r.mu.Unlock()
+	return r.Repository.UpdateAlertState(ctx, key, update)
+}
@@ -1,14 +1,71 @@
 package repository
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"time"
 
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
 )
 
+// DefaultTTL is how long an alert state is kept after its last update.
+const DefaultTTL = 7 * 24 * time.Hour
+
+const (
+	BackendRedis  = "redis"
+	BackendMemory = "memory"
+	BackendFile   = "file"
+)
+
+// LegacyMigrator moves the message IDs stored by versions before alert
+// states into alert states.
+type LegacyMigrator interface {
+	MigrateLegacyMessageIDs(ctx context.Context) (int, error)
+}
+
+type Config struct {
+	Backend string
+	TTL     time.Duration
+
+	Redis RedisConfig
+
+	FilePath string
+}
+
 func New(
-	address, password string, db int,
+	config Config,
+
 	logger *slog.Logger,
-) pkg.Repository {
-	return newRedis(address, password, db, logger)
+) (pkg.Repository, error) {
+	if config.TTL <= 0 {
+		config.TTL = DefaultTTL
+	}
+
+	var (
+		repository pkg.Repository
+		err        error
+	)
+	switch config.Backend {
+	case BackendRedis, "":
+		config.Backend = BackendRedis
+		repository, err = newRedis(config.Redis, config.TTL, logger)
+	case BackendMemory:
+		repository = newMemory(config.TTL, logger)
+	case BackendFile:
+		if config.FilePath == "" {
+			return nil, fmt.Errorf("file path is required for the %s backend", BackendFile)
+		}
+		repository, err = newFile(config.FilePath, config.TTL, logger)
+	default:
+		return nil, fmt.Errorf("unknown repository backend %q", config.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &instrumented{
+		repository: repository,
+		backend:    config.Backend,
+	}, nil
 }
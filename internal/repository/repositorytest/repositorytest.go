@@ -0,0 +1,236 @@
+// Package repositorytest is the conformance suite every pkg.Repository
+// backend has to pass.
+package repositorytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// Factory returns an empty repository whose states expire after ttl.
+type Factory func(t *testing.T, ttl time.Duration) pkg.Repository
+
+// Run runs the conformance suite against the backend returned by factory.
+func Run(t *testing.T, factory Factory) {
+	t.Run("GetMissing", func(t *testing.T) {
+		repository := factory(t, time.Hour)
+
+		if _, err := repository.GetAlertState(context.Background(), "missing"); !errors.Is(err, pkg.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("UpdateCreatesState", func(t *testing.T) {
+		repository := factory(t, time.Hour)
+
+		firedAt := time.Now().UTC().Truncate(time.Second)
+		saved, err := repository.UpdateAlertState(context.Background(), "fp1,fp2", func(state *model.AlertState) error {
+			state.Messages = map[string]*model.AlertMessage{
+				"oc_chat": {ChatID: "oc_chat", MessageID: "om_message", Status: model.AlertStatusFiring},
+			}
+			state.Status = model.AlertStatusFiring
+			state.FirstFiredAt = firedAt
+			state.NotificationCount++
+			state.Labels = map[string]string{"alertname": "Test"}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to update alert state: %v", err)
+		}
+		if saved.Key != "fp1,fp2" {
+			t.Errorf("expected key fp1,fp2, got %q", saved.Key)
+		}
+
+		state, err := repository.GetAlertState(context.Background(), "fp1,fp2")
+		if err != nil {
+			t.Fatalf("failed to get alert state: %v", err)
+		}
+		message := state.Messages["oc_chat"]
+		if message == nil || message.MessageID != "om_message" || state.Status != model.AlertStatusFiring {
+			t.Errorf("unexpected alert state %+v", state)
+		}
+		if !state.FirstFiredAt.Equal(firedAt) {
+			t.Errorf("expected first fired at %s, got %s", firedAt, state.FirstFiredAt)
+		}
+		if state.NotificationCount != 1 || state.Labels["alertname"] != "Test" {
+			t.Errorf("unexpected alert state %+v", state)
+		}
+	})
+
+	t.Run("UpdateErrorKeepsState", func(t *testing.T) {
+		repository := factory(t, time.Hour)
+
+		mustUpdate(t, repository, "fp", func(state *model.AlertState) error {
+			state.Silences = []*model.AlertSilence{{ID: "silence"}}
+			return nil
+		})
+		_, err := repository.UpdateAlertState(context.Background(), "fp", func(state *model.AlertState) error {
+			state.Silences = []*model.AlertSilence{{ID: "other"}}
+			return errors.New("update failed")
+		})
+		if err == nil {
+			t.Fatal("expected the update error to be returned")
+		}
+
+		state, err := repository.GetAlertState(context.Background(), "fp")
+		if err != nil {
+			t.Fatalf("failed to get alert state: %v", err)
+		}
+		if len(state.Silences) != 1 || state.Silences[0].ID != "silence" {
+			t.Errorf("expected failed update to be discarded, got silences %v", state.Silences)
+		}
+	})
+
+	t.Run("StatesAreCopies", func(t *testing.T) {
+		repository := factory(t, time.Hour)
+
+		saved := mustUpdate(t, repository, "fp", func(state *model.AlertState) error {
+			state.Labels = map[string]string{"alertname": "Test"}
+			return nil
+		})
+		saved.Labels["alertname"] = "Changed"
+
+		state, err := repository.GetAlertState(context.Background(), "fp")
+		if err != nil {
+			t.Fatalf("failed to get alert state: %v", err)
+		}
+		if state.Labels["alertname"] != "Test" {
+			t.Errorf("expected stored state to be unaffected, got alertname %q", state.Labels["alertname"])
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		repository := factory(t, time.Hour)
+
+		mustUpdate(t, repository, "fp", func(state *model.AlertState) error { return nil })
+		if err := repository.DeleteAlertState(context.Background(), "fp"); err != nil {
+			t.Fatalf("failed to delete alert state: %v", err)
+		}
+		if _, err := repository.GetAlertState(context.Background(), "fp"); !errors.Is(err, pkg.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound after delete, got %v", err)
+		}
+		if err := repository.DeleteAlertState(context.Background(), "fp"); err != nil {
+			t.Fatalf("expected deleting a missing state to succeed, got %v", err)
+		}
+	})
+
+	t.Run("DeleteIf", func(t *testing.T) {
+		repository := factory(t, time.Hour)
+
+		mustUpdate(t, repository, "fp", func(state *model.AlertState) error {
+			state.Status = model.AlertStatusResolved
+			return nil
+		})
+
+		deleted, err := repository.DeleteAlertStateIf(context.Background(), "fp", func(state *model.AlertState) bool {
+			return state.Status == model.AlertStatusFiring
+		})
+		if err != nil || deleted {
+			t.Fatalf("expected the state to be kept, got deleted %v and %v", deleted, err)
+		}
+		if _, err := repository.GetAlertState(context.Background(), "fp"); err != nil {
+			t.Fatalf("failed to get kept alert state: %v", err)
+		}
+
+		deleted, err = repository.DeleteAlertStateIf(context.Background(), "fp", func(state *model.AlertState) bool {
+			return state.Status == model.AlertStatusResolved
+		})
+		if err != nil || !deleted {
+			t.Fatalf("expected the state to be deleted, got deleted %v and %v", deleted, err)
+		}
+		if _, err := repository.GetAlertState(context.Background(), "fp"); !errors.Is(err, pkg.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound after delete, got %v", err)
+		}
+
+		deleted, err = repository.DeleteAlertStateIf(context.Background(), "missing", func(state *model.AlertState) bool {
+			t.Error("check called for a missing state")
+			return true
+		})
+		if err != nil || deleted {
+			t.Fatalf("expected nothing to delete, got deleted %v and %v", deleted, err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		repository := factory(t, time.Hour)
+
+		for _, key := range []string{"fp1", "fp2"} {
+			mustUpdate(t, repository, key, func(state *model.AlertState) error { return nil })
+		}
+		states, err := repository.ListAlertStates(context.Background())
+		if err != nil {
+			t.Fatalf("failed to list alert states: %v", err)
+		}
+		keys := make([]string, 0, len(states))
+		for _, state := range states {
+			keys = append(keys, state.Key)
+		}
+		slices.Sort(keys)
+		if !slices.Equal(keys, []string{"fp1", "fp2"}) {
+			t.Errorf("expected states fp1 and fp2, got %v", keys)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		repository := factory(t, time.Second)
+
+		mustUpdate(t, repository, "fp", func(state *model.AlertState) error { return nil })
+		time.Sleep(1500 * time.Millisecond)
+
+		if _, err := repository.GetAlertState(context.Background(), "fp"); !errors.Is(err, pkg.ErrNotFound) {
+			t.Fatalf("expected state to expire, got %v", err)
+		}
+	})
+
+	t.Run("ConcurrentUpdates", func(t *testing.T) {
+		repository := factory(t, time.Hour)
+
+		const updates = 20
+		var wg sync.WaitGroup
+		for i := range updates {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := repository.UpdateAlertState(context.Background(), "fp", func(state *model.AlertState) error {
+					state.NotificationCount++
+					if state.Messages == nil {
+						state.Messages = make(map[string]*model.AlertMessage)
+					}
+					chatID := fmt.Sprintf("oc_%d", i)
+					state.Messages[chatID] = &model.AlertMessage{ChatID: chatID}
+					return nil
+				})
+				if err != nil {
+					t.Errorf("failed to update alert state: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		state, err := repository.GetAlertState(context.Background(), "fp")
+		if err != nil {
+			t.Fatalf("failed to get alert state: %v", err)
+		}
+		if state.NotificationCount != updates || len(state.Messages) != updates {
+			t.Errorf("expected %d notifications and messages, got %d and %d", updates, state.NotificationCount, len(state.Messages))
+		}
+	})
+}
+
+func mustUpdate(t *testing.T, repository pkg.Repository, key string, update func(state *model.AlertState) error) *model.AlertState {
+	t.Helper()
+
+	state, err := repository.UpdateAlertState(context.Background(), key, update)
+	if err != nil {
+		t.Fatalf("failed to update alert state: %v", err)
+	}
+	return state
+}
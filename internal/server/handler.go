@@ -1,179 +1,395 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"strings"
 
-	"time"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
-	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/alertmanager"
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/logging"
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/o11y"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/tracing"
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
 )
 
-func (s *Server) Start() error {
-	http.HandleFunc("/ping", s.pingHandler)
-	http.HandleFunc("/notify", s.notifyHandler)
-	http.HandleFunc("/callback", s.HandleCallback)
+func (s *Server) pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", s.port), nil); err != nil {
-		return err
+func (s *Server) notifyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "notify", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		tracing.Fail(span, err)
+		writeReadError(w, err)
+		return
 	}
 
-	return nil
-}
+	native, err := lark.IsAlertmanagerPayload(body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if native {
+		s.notifyAlertmanagerHandler(w, r, body)
+		return
+	}
 
-func (s *Server) pingHandler(w http.ResponseWriter, r *http.Request) {
+	var webhook model.Webhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		tracing.Fail(span, err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	tenant, err := s.notifyTenant(r, webhook.Channel)
+	if err != nil {
+		tracing.Fail(span, err)
+		writeTenantError(w, err)
+		return
+	}
+	ctx = lark.WithTenant(ctx, tenant.Name)
+	span.SetAttributes(
+		attribute.String("notify.type", "webhook"),
+		attribute.String("chat_id", webhook.Channel),
+		attribute.String("tenant", tenant.Name),
+		attribute.Int("notify.alerts", len(webhook.Alerts)),
+	)
+
+	err = o11y.ObserveEventHandler("webhook", func() error {
+		return s.notifier.NotifyAlerts(ctx, webhook)
+	})
+	o11y.IncreasePostToLarkCounter(webhook.Channel, "webhook", err == nil)
+	if err != nil {
+		tracing.Fail(span, err)
+		writeNotifyError(w, err)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
 }
 
-func (s *Server) notifyHandler(w http.ResponseWriter, r *http.Request) {
-	var webhook model.Webhook
+// previewHandler answers with the cards a /notify body would be posted
+// as, without posting them, for developing the Alertmanager templates.
+func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeReadError(w, err)
+		return
+	}
+
+	preview, err := s.notifier.Preview(body)
+	if err != nil {
+		http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
+
+// writeReadError answers a request whose body could not be read.
+func writeReadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "bad request", http.StatusBadRequest)
+}
+
+// notifyAlertmanagerHandler handles a native Alertmanager webhook. The chat
+// is taken from the chat_id query parameter of the receiver URL.
+func (s *Server) notifyAlertmanagerHandler(w http.ResponseWriter, r *http.Request, body []byte) {
+	span := trace.SpanFromContext(r.Context())
+	channel := r.URL.Query().Get("chat_id")
+	if channel == "" {
+		http.Error(w, "chat_id query parameter is required", http.StatusBadRequest)
+		return
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+	var webhook model.AlertmanagerWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		tracing.Fail(span, err)
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
+	tenant, err := s.notifyTenant(r, channel)
+	if err != nil {
+		tracing.Fail(span, err)
+		writeTenantError(w, err)
+		return
+	}
+	ctx := lark.WithTenant(r.Context(), tenant.Name)
+	span.SetAttributes(
+		attribute.String("notify.type", "alertmanager"),
+		attribute.String("chat_id", channel),
+		attribute.String("tenant", tenant.Name),
+		attribute.String("alertmanager.receiver", webhook.Receiver),
+		attribute.String("alert.status", webhook.Status),
+		attribute.Int("notify.alerts", len(webhook.Alerts)),
+	)
 
-	err := s.notifier.NotifyAlerts(webhook)
+	err = o11y.ObserveEventHandler("alertmanager", func() error {
+		return s.notifier.NotifyAlertmanager(ctx, webhook, channel)
+	})
+	o11y.IncreasePostToLarkCounter(channel, "alertmanager", err == nil)
 	if err != nil {
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		tracing.Fail(span, err)
+		writeNotifyError(w, err)
 		return
 	}
-	o11y.IncreasePostToLarkCounter(webhook.Channel, "webhook", err == nil)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
 
-// HandleCallback handles the callback request and verifies the signature.
+// Card action types and outcomes, as recorded in the callback metrics.
+// Reminder buttons are recorded under their action value.
+const (
+	callbackActionURLVerification = "url_verification"
+	callbackActionSilence         = "silence"
+	callbackActionUnknown         = "unknown"
+
+	callbackOutcomeSuccess         = "success"
+	callbackOutcomePartial         = "partial"
+	callbackOutcomeAlreadySilenced = "already_silenced"
+	callbackOutcomeFailed          = "failed"
+	callbackOutcomeInvalid         = "invalid"
+	callbackOutcomeIgnored         = "ignored"
+)
+
+// HandleCallback handles a callback of the tenant it was sent to, see
+// callbackTenant, after checking its verification token.
 func (s *Server) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Start(r.Context(), "callback", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	// Read the request body
 	payloadBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		slog.Error("error reading payload", "ERROR: ", err)
+		s.logger.ErrorContext(ctx, "failed to read callback body",
+			slog.String("error", err.Error()),
+		)
 		lark.WriteToast(w, "error", "Failed to read request body")
-		slog.Error("failed to read request body %v", "ERROR: ", err)
+		return
+	}
+
+	tenant, envelope, payloadBytes, err := s.callbackTenant(r, payloadBytes)
+	if err != nil {
+		tracing.Fail(span, err)
+		s.logger.WarnContext(ctx, "rejected callback",
+			slog.String("error", err.Error()),
+		)
+		o11y.IncreaseCallbackActionCounter(callbackActionUnknown, callbackOutcomeInvalid)
+		writeTenantError(w, err)
+		return
+	}
+	span.SetAttributes(attribute.String("tenant", tenant.Name))
+	ctx = lark.WithTenant(ctx, tenant.Name)
+
+	if envelope.Type == "url_verification" {
+		lark.SendChallengeResponse(w, envelope.Challenge)
+		o11y.IncreaseCallbackActionCounter(callbackActionURLVerification, callbackOutcomeSuccess)
 		return
 	}
 	lark.WriteToast(w, "info", "Request received, processing...")
 
+	// Tracked so a shutdown waits for the action to finish. The action
+	// outlives the request, so its context is not canceled with it.
+	s.callbacks.Add(1)
+	done := o11y.TrackCallback()
+	ctx, actionSpan := tracing.Start(context.WithoutCancel(ctx), "callback.action")
 	go func(payloadBytes []byte) {
-		var payload model.URLVerificationRequest
-		if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-			slog.Error("not url verification", "ERROR: ", err)
+		defer s.callbacks.Done()
+		defer done()
+		defer actionSpan.End()
+
+		logger := s.logger.With(
+			slog.String("tenant", tenant.Name),
+		)
+		//read body request
+		var payload_event model.CardActionPayload
+		if err := json.Unmarshal(payloadBytes, &payload_event); err != nil {
+			logger.ErrorContext(ctx, "failed to unmarshal card action payload",
+				slog.String("error", err.Error()),
+			)
+			o11y.IncreaseCallbackActionCounter(callbackActionUnknown, callbackOutcomeInvalid)
+			return
 		}
 
-		if payload.Type == "url_verification" {
-			lark.SendChallengeResponse(w, *r, payload.Token, payload.Challenge)
-		} else if payload.Type != "url_verification" {
-			//read body request
-			var payload_event model.CardActionPayload
-			if err := json.Unmarshal(payloadBytes, &payload_event); err != nil {
-				slog.Info("not event_type")
-				slog.Error("failed to unmarshal webhook payload_event", "ERROR: ", err)
+		// Process silence creation for both select_static (dropdown) and button actions
+		if payload_event.Event.Action.Tag == "select_static" || payload_event.Event.Action.Tag == "button" {
+			var duration string
+			if payload_event.Event.Action.Tag == "select_static" {
+				duration = payload_event.Event.Action.Option
+			} else {
+				duration = "default"
+			}
+			// Only known actions are recorded, the value comes from the card.
+			action := callbackActionSilence
+			if value := payload_event.Event.Action.Value.Action; value == lark.SilenceActionExtend || value == lark.SilenceActionLetExpire {
+				action = value
+			}
+			alert_id := strings.TrimSuffix(payload_event.Event.Action.Value.AlertID, ",")
+			open_id := payload_event.Event.Operator.OpenID
+			actionSpan.SetAttributes(
+				attribute.String("callback.action", action),
+				attribute.String("alert_id", alert_id),
+				attribute.String("message_id", payload_event.Event.Context.OpenMessageID),
+				attribute.String("chat_id", payload_event.Event.Context.OpenChatID),
+			)
+			logger = logger.With(
+				slog.String("callback_action", action),
+				slog.String("alert_id", alert_id),
+				slog.String("message_id", payload_event.Event.Context.OpenMessageID),
+				slog.String("chat_id", payload_event.Event.Context.OpenChatID),
+			)
+			logger.DebugContext(ctx, "card action received",
+				slog.String("tag", payload_event.Event.Action.Tag),
+				slog.String("duration", duration),
+			)
+			user, err := s.notifier.GetUserInfo(ctx, open_id)
+			if err != nil {
+				tracing.Fail(actionSpan, err)
+				logger.ErrorContext(ctx, "failed to get operator info",
+					slog.String("error", err.Error()),
+				)
+				o11y.IncreaseCallbackActionCounter(action, callbackOutcomeFailed)
 				return
 			}
+			email := *user.Email
+			logger = logger.With(
+				slog.String("operator", email),
+			)
+			ctx = logging.NewContext(ctx, logger)
+			stateKey := payload_event.Event.Action.Value.GroupKey
+			if stateKey == "" {
+				stateKey = alert_id
+			}
 
-			// Process silence creation for both select_static (dropdown) and button actions
-			if payload_event.Event.Action.Tag == "select_static" || payload_event.Event.Action.Tag == "button" {
-				var duration string
-				slog.Info("Raw payload: " + string(payloadBytes))
-
-				if payload_event.Event.Action.Tag == "select_static" {
-					duration = payload_event.Event.Action.Option
-					slog.Info("Dropdown action detected, duration set to ", "duration: ", duration)
-					slog.Info("Dropdown callback payload", "payload_event", payload_event)
-				} else {
-					duration = "default"
-					slog.Info("Button action detected, using default duration")
-				}
-				alert_id := strings.TrimSuffix(payload_event.Event.Action.Value.AlertID, ",")
-				open_id := payload_event.Event.Operator.OpenID
-				user, err := s.notifier.GetUserInfo(open_id)
-				if err != nil {
-					slog.Error("Failed to get user info", "ERROR: ", err)
-					return
+			// Buttons of silence expiry reminders.
+			switch payload_event.Event.Action.Value.Action {
+			case lark.SilenceActionExtend:
+				s.extendSilence(ctx, payload_event, stateKey, email)
+				return
+			case lark.SilenceActionLetExpire:
+				text := fmt.Sprintf("%s lets the silence expire.", email)
+				if err := s.notifier.SendResponseCreatedSilence(ctx, payload_event.Event.Context.OpenMessageID, payload_event.Event.Context.OpenChatID, text); err != nil {
+					logger.ErrorContext(ctx, "failed to send response to Lark",
+						slog.String("error", err.Error()),
+					)
 				}
-				email := *user.Email
-				am := alertmanager.NewAlertmanager(s.alertmanagerHost)
-				silence := lark.NewHandler(am)
-				slog.Info("request silence by ", "open_id: ", open_id, ", email: ", email, ", and alert_id: ", alert_id)
-				if err := silence.HandleCreateSilence(alert_id, email, duration); err != nil {
-					slog.Error("error failed to creating silence ", "ERROR: ", err)
+				o11y.IncreaseCallbackActionCounter(action, callbackOutcomeSuccess)
+				return
+			}
+			logger.InfoContext(ctx, "silence requested",
+				slog.String("duration", duration),
+			)
+			result, silenceErr := s.silence.HandleCreateSilence(ctx, stateKey, alert_id, email, duration)
+			if silenceErr != nil {
+				tracing.Fail(actionSpan, silenceErr)
+				logger.ErrorContext(ctx, "failed to create silence",
+					slog.String("error", silenceErr.Error()),
+				)
+				// A partial result still reports the silences created.
+				if result == nil {
+					o11y.IncreaseCallbackActionCounter(action, callbackOutcomeFailed)
 					return
 				}
+			}
 
-				//reply message confirmation silence created
-				messageID := payload_event.Event.Context.OpenMessageID
-				chatID := payload_event.Event.Context.OpenChatID
-
-				// endtime add 7 hours for convert it into WIB and another 6 hours for silence duration
-				//check value of duration
-				var endtime time.Time
-				switch duration {
-				case "", "default":
-					endtime = time.Now().Add(6*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration is not set, using default 6 hours")
-				case "30m":
-					endtime = time.Now().Add(30*time.Minute + 7*time.Hour) // add 7 hours for convert it into WIB
-					slog.Info("Silence duration set to 30 minutes")
-				case "1h":
-					endtime = time.Now().Add(1*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 1 hour")
-				case "3h":
-					endtime = time.Now().Add(3*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 3 hours")
-				case "6h":
-					endtime = time.Now().Add(6*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 6 hours")
-				case "12h":
-					endtime = time.Now().Add(12*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 12 hours")
-				case "1d":
-					endtime = time.Now().Add(24*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 1 day")
-				case "3d":
-					endtime = time.Now().Add((24*3)*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 3 days")
-				case "1w":
-					endtime = time.Now().Add((24*7)*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 1 week")
-				case "3w":
-					endtime = time.Now().Add((24*7*3)*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 3 weeks")
-				case "1M":
-					endtime = time.Now().Add((24*30)*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 1 month")
-				case "1Y":
-					endtime = time.Now().Add((24*365)*time.Hour + 7*time.Hour)
-					slog.Info("Silence duration set to 1 year")
-				default:
-					slog.Error("Invalid silence duration specified ", "duration: ", duration)
-					return
-				}
-				endtimestr := endtime.Format("2006-01-02 15:04:05") + " WIB"
-				text := fmt.Sprintf("Silence created successfully. It will expire at %s by %s.", endtimestr, email)
-				text_failed := fmt.Sprintf("Failed to create silence for alert %s by %s.", alert_id, email)
-				slog.Info("sending silence response message by ", "messageID: ", messageID, ", chatID: ", chatID, ", text: ", text)
-				if err := s.notifier.SendResponseCreatedSilence(messageID, chatID, text); err != nil {
-					slog.Error("Failed to send response to Lark", "ERROR: ", err)
-					s.notifier.SendResponseCreatedSilence(messageID, chatID, text_failed)
-				}
-			} else {
-				slog.Info("non-silence action detected, ignoring callback")
-				return
+			//reply message confirmation silence created
+			messageID := payload_event.Event.Context.OpenMessageID
+			chatID := payload_event.Event.Context.OpenChatID
+
+			endtimestr := lark.FormatSilenceTime(result.EndsAt())
+			text := fmt.Sprintf("Silence created successfully. It will expire at %s by %s.\n%s", endtimestr, email, result.Summary())
+			outcome := callbackOutcomeSuccess
+			if len(result.Silences) == 0 {
+				text = fmt.Sprintf("No silence created, the alerts are already silenced for longer.\n%s", result.Summary())
+				outcome = callbackOutcomeAlreadySilenced
+			} else if silenceErr != nil {
+				text = fmt.Sprintf("Silence partially created, some silences failed. It will expire at %s by %s.\n%s", endtimestr, email, result.Summary())
+				outcome = callbackOutcomePartial
+			}
+			o11y.IncreaseCallbackActionCounter(action, outcome)
+			text_failed := fmt.Sprintf("Failed to create silence for alert %s by %s.", alert_id, email)
+			logger.InfoContext(ctx, "sending silence response",
+				slog.String("outcome", outcome),
+			)
+			if err := s.notifier.SendResponseCreatedSilence(ctx, messageID, chatID, text); err != nil {
+				logger.ErrorContext(ctx, "failed to send response to Lark",
+					slog.String("error", err.Error()),
+				)
+				s.notifier.SendResponseCreatedSilence(ctx, messageID, chatID, text_failed)
+			}
+			if err := s.notifier.RecordSilence(ctx, stateKey, result.Silences, email, messageID, text); err != nil {
+				logger.WarnContext(ctx, "failed to record silence in alert state",
+					slog.String("error", err.Error()),
+				)
 			}
 		} else {
-			slog.Error("missing or incorrect 'type' or 'event_type' field in payload")
-			slog.Info("incorrect field")
-			//lark.WriteToast(w, "error", "Missing or incorrect 'type' or 'event_type' field in payload")
+			logger.DebugContext(ctx, "ignoring card action that is not a silence",
+				slog.String("tag", payload_event.Event.Action.Tag),
+			)
+			o11y.IncreaseCallbackActionCounter(callbackActionUnknown, callbackOutcomeIgnored)
 			return
 		}
-
 	}(payloadBytes)
 }
+
+// extendSilence extends the silence of an expiry reminder and announces it
+// in the thread of every firing copy of the alert.
+func (s *Server) extendSilence(ctx context.Context, payload model.CardActionPayload, key, email string) {
+	logger := logging.FromContext(ctx)
+	messageID := payload.Event.Context.OpenMessageID
+	chatID := payload.Event.Context.OpenChatID
+	value := payload.Event.Action.Value
+
+	silence, err := s.silence.HandleExtendSilence(ctx, key, value.SilenceID, value.Duration)
+	if err != nil {
+		tracing.Fail(trace.SpanFromContext(ctx), err)
+		o11y.IncreaseCallbackActionCounter(value.Action, callbackOutcomeFailed)
+		logger.ErrorContext(ctx, "failed to extend silence",
+			slog.String("silence_id", value.SilenceID),
+			slog.String("error", err.Error()),
+		)
+		text := fmt.Sprintf("Failed to extend silence %s by %s: %s", value.SilenceID, email, err)
+		if err := s.notifier.SendResponseCreatedSilence(ctx, messageID, chatID, text); err != nil {
+			logger.ErrorContext(ctx, "failed to send response to Lark",
+				slog.String("error", err.Error()),
+			)
+		}
+		return
+	}
+
+	o11y.IncreaseCallbackActionCounter(value.Action, callbackOutcomeSuccess)
+
+	endtimestr := lark.FormatSilenceTime(silence.EndsAt)
+	text := fmt.Sprintf("Silence extended by %s. It will expire at %s.", email, endtimestr)
+	// The reminder was posted in every firing copy, so is the extension.
+	if err := s.notifier.RecordSilence(ctx, key, []*model.AlertSilence{silence}, email, "", text); err != nil {
+		logger.WarnContext(ctx, "failed to record silence in alert state",
+			slog.String("error", err.Error()),
+		)
+		if err := s.notifier.SendResponseCreatedSilence(ctx, messageID, chatID, text); err != nil {
+			logger.ErrorContext(ctx, "failed to send response to Lark",
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/health"
+)
+
+// livenessHandler answers as long as the process serves requests. It does
+// not check dependencies, an outage of Redis or Lark is not fixed by a
+// restart.
+func (s *Server) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, http.StatusOK, health.Report{Status: health.StatusOK})
+}
+
+// readinessHandler reports the result of every dependency check, with a
+// 503 when any of them failed.
+func (s *Server) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.health.Ready(r.Context())
+	status := http.StatusOK
+	if report.Status != health.StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealthReport(w, status, report)
+}
+
+func writeHealthReport(w http.ResponseWriter, status int, report health.Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -1,34 +1,229 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/health"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg"
 )
 
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 30 * time.Second
+	DefaultWriteTimeout      = time.Minute
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultShutdownTimeout   = 30 * time.Second
+	DefaultMaxBodyBytes      = 4 << 20
+	DefaultMetricsPath       = "/metrics"
+)
+
+type Config struct {
+	Port int
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	// WriteTimeout bounds a whole notification, including the Lark calls.
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout bounds how long in-flight requests and callbacks are
+	// drained on shutdown.
+	ShutdownTimeout time.Duration
+	// MaxBodyBytes caps request bodies, larger ones get a 413.
+	MaxBodyBytes int64
+
+	// TLS serves HTTPS when both files are set. The certificate is reloaded
+	// when the files change.
+	TLS TLSConfig
+
+	// MetricsPort serves the metrics on a separate plain HTTP port when set,
+	// and on the main port otherwise.
+	MetricsPort int
+	MetricsPath string
+}
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
 type Server struct {
-	port              int
-	notifier          pkg.Notifier
-	alertmanagerHost  string
-	verificationToken string
+	config   Config
+	notifier pkg.Notifier
+	silence  lark.EventSilence
+	health   *health.Health
+	tenants  *lark.Tenants
+	// callbacks tracks the card actions processed after their response.
+	callbacks sync.WaitGroup
 
 	logger *slog.Logger
 }
 
 func New(
 	notifier pkg.Notifier,
-	port int,
-	alertmanagerHost string,
-	verificationToken string,
+	silence lark.EventSilence,
+	health *health.Health,
+	config Config,
+	tenants *lark.Tenants,
 
 	logger *slog.Logger,
 ) *Server {
+	if config.ReadHeaderTimeout <= 0 {
+		config.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = DefaultReadTimeout
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if config.MetricsPath == "" {
+		config.MetricsPath = DefaultMetricsPath
+	}
+
 	return &Server{
-		port:              port,
-		notifier:          notifier,
-		alertmanagerHost:  alertmanagerHost,
-		verificationToken: verificationToken,
+		config:   config,
+		notifier: notifier,
+		silence:  silence,
+		health:   health,
+		tenants:  tenants,
 
 		logger: logger,
 	}
 }
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", s.pingHandler)
+	mux.HandleFunc("/healthz", s.livenessHandler)
+	mux.HandleFunc("/readyz", s.readinessHandler)
+	mux.HandleFunc("/notify", s.notifyHandler)
+	mux.HandleFunc("/notify/{tenant}", s.notifyHandler)
+	mux.HandleFunc("/preview", s.previewHandler)
+	mux.HandleFunc("/callback", s.HandleCallback)
+	mux.HandleFunc("/callback/{tenant}", s.HandleCallback)
+	if !s.separateMetrics() {
+		mux.Handle(s.config.MetricsPath, promhttp.Handler())
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxBodyBytes)
+		// Continue the trace of the caller, when it sent one.
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		mux.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// separateMetrics tells whether metrics are served on their own port.
+func (s *Server) separateMetrics() bool {
+	return s.config.MetricsPort != 0 && s.config.MetricsPort != s.config.Port
+}
+
+func (s *Server) newHTTPServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		ReadTimeout:       s.config.ReadTimeout,
+		WriteTimeout:      s.config.WriteTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelWarn),
+	}
+}
+
+// Run serves until ctx is done, then stops accepting connections and
+// drains in-flight requests and callbacks for up to the shutdown timeout.
+func (s *Server) Run(ctx context.Context) error {
+	httpServer := s.newHTTPServer(s.config.Port, s.handler())
+	serve := map[*http.Server]func() error{
+		httpServer: httpServer.ListenAndServe,
+	}
+	if s.config.TLS.CertFile != "" || s.config.TLS.KeyFile != "" {
+		certificates, err := newCertificateReloader(s.config.TLS.CertFile, s.config.TLS.KeyFile, s.logger)
+		if err != nil {
+			return err
+		}
+		httpServer.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificates.GetCertificate,
+		}
+		serve[httpServer] = func() error {
+			return httpServer.ListenAndServeTLS("", "")
+		}
+	}
+	if s.separateMetrics() {
+		mux := http.NewServeMux()
+		mux.Handle(s.config.MetricsPath, promhttp.Handler())
+		metricsServer := s.newHTTPServer(s.config.MetricsPort, mux)
+		serve[metricsServer] = metricsServer.ListenAndServe
+	}
+
+	errs := make(chan error, len(serve))
+	for server, listen := range serve {
+		go func() {
+			s.logger.Info("http server listening",
+				slog.String("address", server.Addr),
+				slog.Bool("tls", server.TLSConfig != nil),
+			)
+			errs <- listen()
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-errs:
+		// One server failed, e.g. its port is taken, the others stop too.
+		s.logger.Error("http server failed",
+			slog.String("error", err.Error()),
+		)
+	case <-ctx.Done():
+	}
+
+	s.logger.Info("shutting down http server, draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+
+	running := len(serve)
+	if err != nil {
+		running--
+	}
+	for server := range serve {
+		err = errors.Join(err, server.Shutdown(shutdownCtx))
+	}
+	for range running {
+		if serveErr := <-errs; !errors.Is(serveErr, http.ErrServerClosed) {
+			err = errors.Join(err, serveErr)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.callbacks.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		err = errors.Join(err, fmt.Errorf("callbacks still running after %s", s.config.ShutdownTimeout))
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+// tenantHeader names the tenant of a request sent to /notify or /callback,
+// as the /notify/{tenant} and /callback/{tenant} paths do.
+const tenantHeader = "X-Lark-Tenant"
+
+var (
+	errUnknownTenant = errors.New("unknown tenant")
+	errInvalidToken  = errors.New("invalid verification token")
+)
+
+// requestTenant returns the tenant named by the path or the header, and
+// false when the request names none.
+func (s *Server) requestTenant(r *http.Request) (lark.Tenant, bool, error) {
+	name := r.PathValue("tenant")
+	if name == "" {
+		name = r.Header.Get(tenantHeader)
+	}
+	if name == "" {
+		return lark.Tenant{}, false, nil
+	}
+	tenant, ok := s.tenants.Get(name)
+	if !ok {
+		return lark.Tenant{}, false, fmt.Errorf("%w %q", errUnknownTenant, name)
+	}
+	return tenant, true, nil
+}
+
+// notifyTenant returns the tenant posting a notification to the chat: the
+// one the request names, the one of the app_id query parameter, or the
+// first one listing the chat, the default one otherwise.
+func (s *Server) notifyTenant(r *http.Request, chatID string) (lark.Tenant, error) {
+	tenant, ok, err := s.requestTenant(r)
+	if err != nil || ok {
+		return tenant, err
+	}
+	if appID := r.URL.Query().Get("app_id"); appID != "" {
+		tenant, ok := s.tenants.ByAppID(appID)
+		if !ok {
+			return lark.Tenant{}, fmt.Errorf("%w of app %q", errUnknownTenant, appID)
+		}
+		return tenant, nil
+	}
+	return s.tenants.ForChat(chatID), nil
+}
+
+// callbackTenant returns the tenant a callback was sent to, with the
+// callback decrypted: the tenant the request names, or else the one whose
+// encrypt key decrypts it, whose app sent it or whose verification token
+// it carries, the default one otherwise. The verification token of the
+// tenant is checked.
+func (s *Server) callbackTenant(r *http.Request, body []byte) (lark.Tenant, *model.CallbackEnvelope, []byte, error) {
+	tenant, ok, err := s.requestTenant(r)
+	if err != nil {
+		return lark.Tenant{}, nil, nil, err
+	}
+
+	envelope := &model.CallbackEnvelope{}
+	if err := json.Unmarshal(body, envelope); err != nil {
+		return lark.Tenant{}, nil, nil, fmt.Errorf("invalid callback payload: %w", err)
+	}
+	if envelope.Encrypt != "" {
+		if ok {
+			body, err = tenant.Decrypt(envelope.Encrypt)
+		} else {
+			body, tenant, err = s.tenants.Decrypt(envelope.Encrypt)
+			ok = err == nil
+		}
+		if err != nil {
+			return lark.Tenant{}, nil, nil, err
+		}
+		envelope = &model.CallbackEnvelope{}
+		if err := json.Unmarshal(body, envelope); err != nil {
+			return lark.Tenant{}, nil, nil, fmt.Errorf("invalid callback payload: %w", err)
+		}
+	}
+
+	// Card actions carry the token in their header, URL verifications and
+	// older callbacks at the top.
+	token := envelope.Token
+	if envelope.Header.Token != "" {
+		token = envelope.Header.Token
+	}
+	if !ok {
+		if tenant, ok = s.tenants.ByAppID(envelope.Header.AppID); !ok {
+			if tenant, ok = s.tenants.ByVerificationToken(token); !ok {
+				tenant, _ = s.tenants.Get(s.tenants.Default())
+			}
+		}
+	}
+	if tenant.VerificationToken != "" && token != tenant.VerificationToken {
+		return lark.Tenant{}, nil, nil, fmt.Errorf("%w for tenant %s", errInvalidToken, tenant.Name)
+	}
+	return tenant, envelope, body, nil
+}
+
+// writeTenantError answers a request whose tenant could not be resolved or
+// authenticated.
+func writeTenantError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownTenant):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errInvalidToken):
+		http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+// writeNotifyError answers a notification that could not be posted.
+func writeNotifyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, lark.ErrChatNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/internal/lark"
+)
+
+// encryptCallback encrypts the body as Lark does with the encrypt key of
+// an app.
+func encryptCallback(t *testing.T, key, body string) string {
+	t.Helper()
+	secret := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(secret[:])
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	padding := aes.BlockSize - len(body)%aes.BlockSize
+	plain := append([]byte(body), make([]byte, padding)...)
+	for i := len(body); i < len(plain); i++ {
+		plain[i] = byte(padding)
+	}
+	// A fixed IV keeps the result of a wrong key the same on every run.
+	out := make([]byte, aes.BlockSize+len(plain))
+	copy(out, "0123456789abcdef")
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], plain)
+	return base64.StdEncoding.EncodeToString(out)
+}
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tenants, err := lark.NewTenants([]lark.Tenant{
+		{Name: "payments", AppID: "cli_payments", VerificationToken: "token-payments"},
+		{Name: "logistics", AppID: "cli_logistics", VerificationToken: "token-logistics", EncryptKey: "key-logistics", Chats: []string{"oc_logistics"}},
+		{Name: "ops", AppID: "cli_ops", VerificationToken: "token-ops", EncryptKey: "key-ops", Chats: []string{"oc_ops"}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewTenants() error = %v", err)
+	}
+	return New(nil, nil, nil, Config{}, tenants, logger)
+}
+
+// tenantRequest is a request to the target naming the tenant in the path
+// and header when given.
+func tenantRequest(target, pathTenant, headerTenant string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, nil)
+	if pathTenant != "" {
+		r.SetPathValue("tenant", pathTenant)
+	}
+	if headerTenant != "" {
+		r.Header.Set(tenantHeader, headerTenant)
+	}
+	return r
+}
+
+func TestNotifyTenant(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name         string
+		target       string
+		pathTenant   string
+		headerTenant string
+		chat         string
+		want         string
+		wantErr      error
+	}{
+		{name: "path", target: "/notify/ops", pathTenant: "ops", chat: "oc_logistics", want: "ops"},
+		{name: "path over header", target: "/notify/ops", pathTenant: "ops", headerTenant: "logistics", want: "ops"},
+		{name: "header", target: "/notify", headerTenant: "logistics", want: "logistics"},
+		{name: "header over app id", target: "/notify?app_id=cli_ops", headerTenant: "logistics", want: "logistics"},
+		{name: "app id", target: "/notify?app_id=cli_ops", chat: "oc_logistics", want: "ops"},
+		{name: "chat", target: "/notify", chat: "oc_logistics", want: "logistics"},
+		{name: "default", target: "/notify", chat: "oc_other", want: "payments"},
+		{name: "unknown path tenant", target: "/notify/billing", pathTenant: "billing", wantErr: errUnknownTenant},
+		{name: "unknown header tenant", target: "/notify", headerTenant: "billing", wantErr: errUnknownTenant},
+		{name: "unknown app id", target: "/notify?app_id=cli_billing", wantErr: errUnknownTenant},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant, err := s.notifyTenant(tenantRequest(tt.target, tt.pathTenant, tt.headerTenant), tt.chat)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("notifyTenant() error = %v, want %v", err, tt.wantErr)
+			}
+			if tenant.Name != tt.want {
+				t.Errorf("notifyTenant() = %q, want %q", tenant.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallbackTenant(t *testing.T) {
+	s := newTestServer(t)
+	cardAction := func(appID, token string) string {
+		return fmt.Sprintf(`{"schema":"2.0","header":{"app_id":%q,"token":%q}}`, appID, token)
+	}
+	encrypted := func(key, body string) string {
+		return fmt.Sprintf(`{"encrypt":%q}`, encryptCallback(t, key, body))
+	}
+
+	tests := []struct {
+		name       string
+		pathTenant string
+		body       string
+		want       string
+		wantBody   string
+		wantErr    error
+	}{
+		{
+			name:       "path",
+			pathTenant: "logistics",
+			body:       cardAction("cli_ops", "token-logistics"),
+			want:       "logistics",
+		},
+		{
+			name: "app id",
+			body: cardAction("cli_ops", "token-ops"),
+			want: "ops",
+		},
+		{
+			name: "verification token",
+			body: `{"type":"url_verification","challenge":"c","token":"token-logistics"}`,
+			want: "logistics",
+		},
+		{
+			name: "default",
+			body: `{"type":"url_verification","challenge":"c","token":"token-payments"}`,
+			want: "payments",
+		},
+		{
+			name:       "decrypted with the key of the named tenant",
+			pathTenant: "ops",
+			body:       encrypted("key-ops", cardAction("cli_ops", "token-ops")),
+			want:       "ops",
+			wantBody:   cardAction("cli_ops", "token-ops"),
+		},
+		{
+			name:     "decrypted with the key of any tenant",
+			body:     encrypted("key-logistics", cardAction("", "token-logistics")),
+			want:     "logistics",
+			wantBody: cardAction("", "token-logistics"),
+		},
+		{
+			name:       "encrypted with the key of another tenant",
+			pathTenant: "ops",
+			body:       encrypted("key-logistics", cardAction("cli_logistics", "token-logistics")),
+			wantErr:    errDecrypt,
+		},
+		{
+			name:    "encrypted with the key of no tenant",
+			body:    encrypted("key-billing", cardAction("cli_ops", "token-ops")),
+			wantErr: errDecrypt,
+		},
+		{
+			name:       "token of another tenant",
+			pathTenant: "ops",
+			body:       cardAction("cli_ops", "token-logistics"),
+			wantErr:    errInvalidToken,
+		},
+		{
+			name:    "token not matching the app",
+			body:    cardAction("cli_ops", "token-logistics"),
+			wantErr: errInvalidToken,
+		},
+		{
+			name:    "token of no tenant",
+			body:    `{"type":"url_verification","challenge":"c","token":"forged"}`,
+			wantErr: errInvalidToken,
+		},
+		{
+			name:    "missing token",
+			body:    cardAction("cli_payments", ""),
+			wantErr: errInvalidToken,
+		},
+		{
+			name:       "unknown tenant",
+			pathTenant: "billing",
+			body:       cardAction("cli_ops", "token-ops"),
+			wantErr:    errUnknownTenant,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant, envelope, body, err := s.callbackTenant(tenantRequest("/callback", tt.pathTenant, ""), []byte(tt.body))
+			if tt.wantErr == errDecrypt {
+				if err == nil || errors.Is(err, errInvalidToken) || errors.Is(err, errUnknownTenant) {
+					t.Fatalf("callbackTenant() error = %v, want a decrypt error", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("callbackTenant() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tenant.Name != tt.want {
+				t.Errorf("callbackTenant() = %q, want %q", tenant.Name, tt.want)
+			}
+			wantBody := tt.body
+			if tt.wantBody != "" {
+				wantBody = tt.wantBody
+			}
+			if string(body) != wantBody {
+				t.Errorf("callbackTenant() body = %s, want %s", body, wantBody)
+			}
+			if envelope.Encrypt != "" {
+				t.Errorf("callbackTenant() envelope is still encrypted")
+			}
+		})
+	}
+}
+
+// errDecrypt stands for the errors of callbacks that cannot be decrypted.
+var errDecrypt = errors.New("decrypt error")
+
+func TestWriteTenantError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		notify bool
+		want   int
+	}{
+		{"unknown tenant", fmt.Errorf("%w %q", errUnknownTenant, "billing"), false, http.StatusNotFound},
+		{"invalid token", fmt.Errorf("%w for tenant ops", errInvalidToken), false, http.StatusUnauthorized},
+		{"undecryptable callback", errors.New("no tenant encrypt key decrypts the callback"), false, http.StatusBadRequest},
+		{"chat not allowed", fmt.Errorf("%w: ops does not post to oc_payments", lark.ErrChatNotAllowed), true, http.StatusForbidden},
+		{"notification failed", errors.New("lark is down"), true, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if tt.notify {
+				writeNotifyError(w, tt.err)
+			} else {
+				writeTenantError(w, tt.err)
+			}
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
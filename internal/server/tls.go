@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateReloader serves the certificate of the files, loading it again
+// when either file changed, so renewed certificates apply without a restart.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+
+	logger *slog.Logger
+}
+
+func newCertificateReloader(certFile, keyFile string, logger *slog.Logger) (*certificateReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("tls cert file and key file must be set together")
+	}
+
+	r := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if modTime, err := r.latestModTime(); err == nil && modTime.After(r.modTime) {
+		if err := r.reload(); err != nil {
+			// Keep serving the previous certificate, e.g. while only one of
+			// the files was replaced, and retry once either changes again.
+			r.modTime = modTime
+			r.logger.Warn("failed to reload tls certificate",
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+	return r.certificate, nil
+}
+
+func (r *certificateReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certificateReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return fmt.Errorf("failed to stat tls certificate: %w", err)
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	r.certificate = &certificate
+	r.modTime = modTime
+	r.logger.Info("loaded tls certificate",
+		slog.String("cert_file", r.certFile),
+	)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Package tracing sets up OpenTelemetry tracing and the helpers used to
+// trace a notification from the webhook to Lark, and a card action to the
+// silence it creates.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultServiceName = "katulampa-lark-app"
+	DefaultSampleRatio = 1.0
+
+	tracerName = "source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app"
+)
+
+type Config struct {
+	// Enabled exports spans over OTLP/HTTP. Spans are not recorded
+	// otherwise.
+	Enabled bool
+	// Endpoint is the URL spans are sent to, e.g.
+	// http://otel-collector:4318/v1/traces. When empty the standard
+	// OTEL_EXPORTER_OTLP_* environment variables apply.
+	Endpoint string
+	// SampleRatio is the ratio of new traces that are recorded. Traces
+	// started upstream keep their sampling decision.
+	SampleRatio float64
+	ServiceName string
+}
+
+// Setup installs the global tracer provider and propagator, and returns the
+// function flushing the remaining spans on shutdown.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = DefaultServiceName
+	}
+
+	options := make([]otlptracehttp.Option, 0)
+	if config.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(config.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, options...)
+}
+
+// Fail marks the span failed with err.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End marks the span failed when err is set, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		Fail(span, err)
+	}
+	span.End()
+}
@@ -0,0 +1,13 @@
+package pkg
+
+import (
+	"context"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+type Grapher interface {
+	// Render returns a PNG graph for the alert, or nil when the alert
+	// carries nothing to graph.
+	Render(ctx context.Context, alert model.WebhookAlert) ([]byte, error)
+}
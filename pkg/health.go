@@ -0,0 +1,9 @@
+package pkg
+
+import "context"
+
+// HealthChecker is a dependency verified by the readiness probe.
+type HealthChecker interface {
+	// CheckHealth returns an error when the dependency cannot be used.
+	CheckHealth(ctx context.Context) error
+}
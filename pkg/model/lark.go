@@ -23,9 +23,22 @@ type LarkCardHeader struct {
 }
 
 type LarkCardElement struct {
-	Tag     string                   `json:"tag"`
-	Text    *LarkCardText            `json:"text,omitempty"`
-	Actions []*LarkCardElementAction `json:"actions,omitempty"`
+	Tag      string                   `json:"tag"`
+	Content  string                   `json:"content,omitempty"`
+	Text     *LarkCardText            `json:"text,omitempty"`
+	Fields   []*LarkCardField         `json:"fields,omitempty"`
+	Extra    *LarkCardElement         `json:"extra,omitempty"`
+	Elements []*LarkCardElement       `json:"elements,omitempty"`
+	Actions  []*LarkCardElementAction `json:"actions,omitempty"`
+	ImgKey   string                   `json:"img_key,omitempty"`
+	Alt      *LarkCardText            `json:"alt,omitempty"`
+	Mode     string                   `json:"mode,omitempty"`
+	Preview  bool                     `json:"preview,omitempty"`
+}
+
+type LarkCardField struct {
+	IsShort bool          `json:"is_short"`
+	Text    *LarkCardText `json:"text"`
 }
 
 type LarkCardElementAction struct {
@@ -0,0 +1,12 @@
+package model
+
+import "encoding/json"
+
+// CardPreview is what a notification would be posted as, with what its
+// templates likely got wrong.
+type CardPreview struct {
+	// Cards holds the messages of each card. A card over the size limit
+	// is split or truncated into several.
+	Cards    [][]json.RawMessage `json:"cards"`
+	Warnings []string            `json:"warnings"`
+}
@@ -0,0 +1,73 @@
+package model
+
+import "time"
+
+const (
+	AlertStatusFiring   = "firing"
+	AlertStatusResolved = "resolved"
+)
+
+// AlertState is everything tracked about an alert group posted to Lark.
+// The same group can be posted to several chats, each copy is tracked in
+// Messages by chat ID. The alerts of the group come and go over its
+// lifecycle, each is tracked in Alerts by fingerprint.
+type AlertState struct {
+	Key               string                   `json:"key"`
+	Status            string                   `json:"status"`
+	FirstFiredAt      time.Time                `json:"first_fired_at"`
+	LastFiredAt       time.Time                `json:"last_fired_at"`
+	ResolvedAt        time.Time                `json:"resolved_at,omitempty"`
+	NotificationCount int                      `json:"notification_count"`
+	Silences          []*AlertSilence          `json:"silences,omitempty"`
+	AckedBy           string                   `json:"acked_by,omitempty"`
+	Labels            map[string]string        `json:"labels,omitempty"`
+	Receiver          string                   `json:"receiver,omitempty"`
+	Messages          map[string]*AlertMessage `json:"messages,omitempty"`
+	Alerts            map[string]*TrackedAlert `json:"alerts,omitempty"`
+	// ActionLease is held while a card action on the group runs, so clicks
+	// on any replica are handled one at a time.
+	ActionLease *Lease `json:"action_lease,omitempty"`
+}
+
+// Lease is held by Owner until it releases it or ExpiresAt passes.
+type Lease struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TrackedAlert is a member of an alert group, by fingerprint, with the name
+// of the Alertmanager it came from.
+type TrackedAlert struct {
+	Fingerprint  string            `json:"fingerprint"`
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	StartsAt     time.Time         `json:"starts_at,omitempty"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	Alertmanager string            `json:"alertmanager,omitempty"`
+}
+
+// AlertSilence is a silence created for an alert group, on the named
+// Alertmanager.
+type AlertSilence struct {
+	ID           string    `json:"id"`
+	Alertmanager string    `json:"alertmanager,omitempty"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	StartsAt     time.Time `json:"starts_at"`
+	EndsAt       time.Time `json:"ends_at"`
+	// RemindedFor is the end the expiry reminder was posted for.
+	RemindedFor time.Time `json:"reminded_for,omitempty"`
+	// Replaces is the silence this one was extended from, when the
+	// Alertmanager gave the extension a new ID.
+	Replaces string `json:"replaces,omitempty"`
+}
+
+// AlertMessage is the copy of an alert group posted to one chat, by the
+// named Lark tenant.
+type AlertMessage struct {
+	ChatID    string    `json:"chat_id"`
+	MessageID string    `json:"message_id"`
+	ThreadID  string    `json:"thread_id,omitempty"`
+	Status    string    `json:"status"`
+	SentAt    time.Time `json:"sent_at"`
+	Tenant    string    `json:"tenant,omitempty"`
+}
@@ -1,21 +1,42 @@
 package model
 
+import "encoding/json"
+
 type WebhookAlert struct {
 	Color      string               `json:"color"`
 	CallbackID string               `json:"callback_id"`
 	Footer     string               `json:"footer"`
+	FooterIcon string               `json:"footer_icon"`
+	Ts         json.Number          `json:"ts"`
 	MrkdwnIn   []string             `json:"mrkdwn_in"`
 	TitleLink  string               `json:"title_link"`
+	Pretext    string               `json:"pretext"`
 	Text       string               `json:"text"`
 	Title      string               `json:"title"`
 	Fallback   string               `json:"fallback"`
+	AuthorName string               `json:"author_name"`
+	AuthorLink string               `json:"author_link"`
+	ImageURL   string               `json:"image_url"`
+	ThumbURL   string               `json:"thumb_url"`
+	Fields     []WebhookAlertField  `json:"fields"`
 	Actions    []WebhookAlertAction `json:"actions"`
+
+	// GroupKey is the stable identity of the alert group, set by the app.
+	GroupKey string `json:"-"`
+}
+
+type WebhookAlertField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
 }
 
 type WebhookAlertAction struct {
-	Text string `json:"text"`
-	Type string `json:"type"`
-	URL  string `json:"url,omitempty"`
+	Text  string `json:"text"`
+	Type  string `json:"type"`
+	URL   string `json:"url,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
 }
 
 type Webhook struct {
@@ -30,6 +51,17 @@ type URLVerificationRequest struct {
 	Token     string `json:"token"`
 }
 
+// CallbackEnvelope is what tells who sent a callback, whatever its type:
+// an encrypted one, a URL verification or a card action.
+type CallbackEnvelope struct {
+	URLVerificationRequest
+	Encrypt string `json:"encrypt"`
+	Header  struct {
+		AppID string `json:"app_id"`
+		Token string `json:"token"`
+	} `json:"header"`
+}
+
 type CardActionPayload struct {
 	Schema string `json:"schema"`
 	Header struct {
@@ -49,7 +81,11 @@ type CardActionPayload struct {
 		Action struct {
 			Tag   string `json:"tag"`
 			Value struct {
-				AlertID string `json:"alert_id"`
+				AlertID   string `json:"alert_id"`
+				GroupKey  string `json:"group_key"`
+				Action    string `json:"action"`
+				SilenceID string `json:"silence_id"`
+				Duration  string `json:"duration"`
 			} `json:"value"`
 			Option string `json:"option"` // add this field for select option
 		} `json:"action"`
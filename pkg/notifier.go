@@ -1,12 +1,22 @@
 package pkg
 
 import (
+	"context"
+
 	larkcontact "github.com/larksuite/oapi-sdk-go/v3/service/contact/v3"
 	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
 )
 
 type Notifier interface {
-	NotifyAlerts(alert model.Webhook) error
-	SendResponseCreatedSilence(message_id string, chat_id string, text string) error
-	GetUserInfo(openID string) (*larkcontact.User, error)
+	NotifyAlerts(ctx context.Context, alert model.Webhook) error
+	NotifyAlertmanager(ctx context.Context, webhook model.AlertmanagerWebhook, channel string) error
+	SendResponseCreatedSilence(ctx context.Context, message_id string, chat_id string, text string) error
+	GetUserInfo(ctx context.Context, openID string) (*larkcontact.User, error)
+	RecordSilence(ctx context.Context, alertID string, silences []*model.AlertSilence, createdBy, sourceMessageID, text string) error
+	SendSilenceReminder(ctx context.Context, key string, silence *model.AlertSilence) error
+	SendSilenceExpired(ctx context.Context, key string, silence *model.AlertSilence) error
+	SendResolvedInferred(ctx context.Context, state *model.AlertState) error
+	// Preview renders the cards of a notification body without posting
+	// them.
+	Preview(body []byte) (*model.CardPreview, error)
 }
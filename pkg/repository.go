@@ -1,7 +1,26 @@
 package pkg
 
+import (
+	"context"
+	"errors"
+
+	"source.golabs.io/cloud-platform/observability/katulampa/katulampa-lark-app/pkg/model"
+)
+
+var ErrNotFound = errors.New("not found")
+
 type Repository interface {
-	SetMessageID(key, value string) error
-	GetMessageID(key string) (string, error)
-	DeleteMessageID(key string) error
+	// GetAlertState returns ErrNotFound when the alert is not tracked.
+	GetAlertState(ctx context.Context, key string) (*model.AlertState, error)
+	// UpdateAlertState atomically applies update to the state of the alert,
+	// starting from an empty state when it is not tracked yet, and returns
+	// the saved state.
+	UpdateAlertState(ctx context.Context, key string, update func(state *model.AlertState) error) (*model.AlertState, error)
+	DeleteAlertState(ctx context.Context, key string) error
+	// DeleteAlertStateIf atomically deletes the state of the alert when
+	// check returns true for it, and tells whether it was deleted. States
+	// that are not tracked are not deleted.
+	DeleteAlertStateIf(ctx context.Context, key string, check func(state *model.AlertState) bool) (bool, error)
+	// ListAlertStates returns every alert state that has not expired.
+	ListAlertStates(ctx context.Context) ([]*model.AlertState, error)
 }